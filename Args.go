@@ -0,0 +1,88 @@
+package LuaVM
+
+// Helpers for GOFUNC implementations to fetch and check their arguments.
+// Argument numbers are 1-based, as in Lua error messages.
+
+func arg(params []*Value, n int) *Value {
+	if n > len(params) || params[n-1] == nil {
+		return &Value{Type: NIL}
+	}
+	return params[n-1]
+}
+
+func (v *VM) argError(n int, fname string, msg string) {
+	v.Error("bad argument #%d to '%s' (%s)", n, fname, msg)
+}
+
+func (v *VM) typeError(params []*Value, n int, fname string, expected string) {
+	got := "no value"
+	if n <= len(params) {
+		got = arg(params, n).TypeName()
+	}
+	v.argError(n, fname, expected+" expected, got "+got)
+}
+
+func (v *VM) checkAny(params []*Value, n int, fname string) *Value {
+	if n > len(params) {
+		v.argError(n, fname, "value expected")
+	}
+	return arg(params, n)
+}
+
+func (v *VM) checkTable(params []*Value, n int, fname string) *Table {
+	a := arg(params, n)
+	if a.Type != TABLE {
+		v.typeError(params, n, fname, "table")
+	}
+	return a.Val.(*Table)
+}
+
+func (v *VM) checkNumber(params []*Value, n int, fname string) Number {
+	num, ok := toNumber(arg(params, n))
+	if !ok {
+		v.typeError(params, n, fname, "number")
+	}
+	return num
+}
+
+func (v *VM) checkInt(params []*Value, n int, fname string) int {
+	return int(v.checkNumber(params, n, fname))
+}
+
+func (v *VM) checkString(params []*Value, n int, fname string) string {
+	a := arg(params, n)
+	switch a.Type {
+	case STRING:
+		return a.Val.(string)
+	case NUMBER:
+		return a.String()
+	}
+	v.typeError(params, n, fname, "string")
+	return ""
+}
+
+func (v *VM) optNumber(params []*Value, n int, fname string, def Number) Number {
+	if arg(params, n).Type == NIL {
+		return def
+	}
+	return v.checkNumber(params, n, fname)
+}
+
+func (v *VM) optInt(params []*Value, n int, fname string, def int) int {
+	return int(v.optNumber(params, n, fname, Number(def)))
+}
+
+func (v *VM) optString(params []*Value, n int, fname string, def string) string {
+	if arg(params, n).Type == NIL {
+		return def
+	}
+	return v.checkString(params, n, fname)
+}
+
+func (v *VM) checkFunction(params []*Value, n int, fname string) *Value {
+	a := arg(params, n)
+	if a.Type != CLOSURE && a.Type != GOFUNCTION {
+		v.typeError(params, n, fname, "function")
+	}
+	return a
+}
@@ -0,0 +1,313 @@
+package LuaVM
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"math/bits"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func openBase(v *VM) *Table {
+	v.G.SetTable("_G", v.G)
+	v.G.SetString("_VERSION", "Lua 5.1")
+	v.G.SetFunc("assert", base_assert)
+	v.G.SetFunc("collectgarbage", base_collectgarbage)
+	v.G.SetFunc("error", base_error)
+	v.G.SetFunc("getmetatable", getmetatable)
+	v.G.SetFunc("ipairs", base_ipairs)
+	v.G.Set(Value{Type: STRING, Val: "next"}, &Value{Type: GOFUNCTION, Val: nextFunction})
+	v.G.SetFunc("pairs", base_pairs)
+	v.G.SetFunc("pcall", base_pcall)
+	v.G.SetFunc("print", base_print)
+	v.G.SetFunc("rawequal", base_rawequal)
+	v.G.SetFunc("rawget", base_rawget)
+	v.G.SetFunc("rawlen", base_rawlen)
+	v.G.SetFunc("rawset", base_rawset)
+	v.G.SetFunc("select", base_select)
+	v.G.SetFunc("setmetatable", setmetatable)
+	v.G.SetFunc("tonumber", base_tonumber)
+	v.G.SetFunc("tostring", base_tostring)
+	v.G.SetFunc("type", base_type)
+	v.G.SetFunc("unpack", tab_unpack)
+	if !v.sandbox {
+		v.G.SetFunc("load", base_load)
+		v.G.SetFunc("loadstring", base_loadstring)
+		v.G.SetFunc("loadfile", base_loadfile)
+		v.G.SetFunc("dofile", base_dofile)
+	}
+	return v.G
+}
+
+func base_print(params []*Value, v *VM) []*Value {
+	for k, p := range params {
+		if k > 0 {
+			fmt.Fprint(v.Stdout, "\t")
+		}
+		fmt.Fprint(v.Stdout, v.tostring(p))
+	}
+	fmt.Fprintln(v.Stdout)
+	return nil
+}
+
+func base_assert(params []*Value, v *VM) []*Value {
+	if !truthy(v.checkAny(params, 1, "assert")) {
+		v.Error("%s", v.optString(params, 2, "assert", "assertion failed!"))
+	}
+	return params
+}
+
+func base_type(params []*Value, v *VM) []*Value {
+	return []*Value{NewString(v.checkAny(params, 1, "type").TypeName())}
+}
+
+// tostring converts val to a string as Lua's tostring does, calling its
+// __tostring metamethod if it has one.
+func (v *VM) tostring(val *Value) string {
+	if m := v.getMetamethod(val, "__tostring"); m != nil {
+		r := v.Call(m, []*Value{val})
+		if len(r) == 0 || r[0].Type != STRING {
+			v.Error("'__tostring' must return a string")
+		}
+		return r[0].Val.(string)
+	}
+	switch val.Type {
+	case NIL:
+		return "nil"
+	case BOOLEAN:
+		return strconv.FormatBool(truthy(val))
+	case NUMBER, STRING:
+		return val.String()
+	}
+	return fmt.Sprintf("%s: %p", val.TypeName(), val.Val)
+}
+
+func base_tostring(params []*Value, v *VM) []*Value {
+	return []*Value{NewString(v.tostring(v.checkAny(params, 1, "tostring")))}
+}
+
+func base_tonumber(params []*Value, v *VM) []*Value {
+	base := v.optInt(params, 2, "tonumber", 10)
+	if base == 10 {
+		a := v.checkAny(params, 1, "tonumber")
+		switch a.Type {
+		case NUMBER:
+			return []*Value{a}
+		case STRING:
+			if n, ok := str2number(a.Val.(string)); ok {
+				return []*Value{{Type: NUMBER, Num: n}}
+			}
+		}
+		return []*Value{NewNil()}
+	}
+	s := v.checkString(params, 1, "tonumber")
+	if base < 2 || base > 36 {
+		v.argError(2, "tonumber", "base out of range")
+	}
+	n, ok := strtoul(s, base)
+	if !ok {
+		return []*Value{NewNil()}
+	}
+	return []*Value{NewNumber(float64(n))}
+}
+
+// strtoul converts s to an integer in base as C's strtoul does for the
+// reference tonumber, and reports whether all of s but surrounding
+// whitespace was used. A sign may precede the digits, and in base 16 so may
+// "0x". As in C, a minus sign negates the result modulo 2^64 and a value
+// out of range is the largest one.
+func strtoul(s string, base int) (uint64, bool) {
+	s = strings.Trim(s, " \t\n\v\f\r")
+	neg := false
+	if s != "" && (s[0] == '-' || s[0] == '+') {
+		neg = s[0] == '-'
+		s = s[1:]
+	}
+	if base == 16 && len(s) > 2 && s[0] == '0' && s[1]|0x20 == 'x' && digitValue(s[2]) < 16 {
+		s = s[2:]
+	}
+	if s == "" {
+		return 0, false
+	}
+	var n uint64
+	overflow := false
+	for l1 := 0; l1 < len(s); l1++ {
+		d := digitValue(s[l1])
+		if d >= base {
+			return 0, false
+		}
+		hi, lo := bits.Mul64(n, uint64(base))
+		lo, carry := bits.Add64(lo, uint64(d), 0)
+		overflow = overflow || hi != 0 || carry != 0
+		n = lo
+	}
+	switch {
+	case overflow:
+		return math.MaxUint64, true
+	case neg:
+		return -n, true
+	}
+	return n, true
+}
+
+// digitValue returns the value of c as a digit in bases up to 36, or 36 if
+// it is not one.
+func digitValue(c byte) int {
+	switch {
+	case '0' <= c && c <= '9':
+		return int(c - '0')
+	case 'a' <= c|0x20 && c|0x20 <= 'z':
+		return int(c|0x20-'a') + 10
+	}
+	return 36
+}
+
+func base_next(params []*Value, v *VM) []*Value {
+	t := v.checkTable(params, 1, "next")
+	k, val, ok := t.Next(*arg(params, 2))
+	if !ok {
+		v.Error("invalid key to 'next'")
+	}
+	if k.Type == NIL {
+		return []*Value{NewNil()}
+	}
+	return []*Value{k.Copy(), val}
+}
+
+// The iterators pairs and ipairs return, which are the same function each
+// time as in reference Lua. pairs returns next itself.
+var (
+	nextFunction = &GoFunction{Fn: base_next}
+	ipairsAux    = &GoFunction{Fn: ipairs_aux}
+)
+
+func base_pairs(params []*Value, v *VM) []*Value {
+	v.checkTable(params, 1, "pairs")
+	return []*Value{{Type: GOFUNCTION, Val: nextFunction}, params[0], NewNil()}
+}
+
+func ipairs_aux(params []*Value, v *VM) []*Value {
+	t := v.checkTable(params, 1, "ipairs")
+	i := v.checkInt(params, 2, "ipairs") + 1
+	val := t.GetInt(i)
+	if val.Type == NIL {
+		return []*Value{NewNil()}
+	}
+	return []*Value{NewNumber(float64(i)), val}
+}
+
+func base_ipairs(params []*Value, v *VM) []*Value {
+	v.checkTable(params, 1, "ipairs")
+	return []*Value{{Type: GOFUNCTION, Val: ipairsAux}, params[0], NewNumber(0)}
+}
+
+func base_select(params []*Value, v *VM) []*Value {
+	if a := arg(params, 1); a.Type == STRING && a.Val.(string) == "#" {
+		return []*Value{NewNumber(float64(len(params) - 1))}
+	}
+	n := v.checkInt(params, 1, "select")
+	if n < 0 {
+		n = len(params) + n
+	} else if n > len(params) {
+		n = len(params)
+	}
+	if n < 1 {
+		v.argError(1, "select", "index out of range")
+	}
+	return params[n:]
+}
+
+func base_rawequal(params []*Value, v *VM) []*Value {
+	a := v.checkAny(params, 1, "rawequal")
+	b := v.checkAny(params, 2, "rawequal")
+	return []*Value{NewBool(rawEquals(a, b))}
+}
+
+func base_rawget(params []*Value, v *VM) []*Value {
+	t := v.checkTable(params, 1, "rawget")
+	return []*Value{t.Get(*v.checkAny(params, 2, "rawget"))}
+}
+
+func base_rawset(params []*Value, v *VM) []*Value {
+	t := v.checkTable(params, 1, "rawset")
+	v.checkAny(params, 2, "rawset")
+	v.checkAny(params, 3, "rawset")
+	t.Set(*params[1], params[2].Copy())
+	return params[:1]
+}
+
+func base_rawlen(params []*Value, v *VM) []*Value {
+	switch a := arg(params, 1); a.Type {
+	case TABLE:
+		return []*Value{NewNumber(float64(a.Val.(*Table).border()))}
+	case STRING:
+		return []*Value{NewNumber(float64(len(a.Val.(string))))}
+	}
+	v.argError(1, "rawlen", "table or string expected")
+	return nil
+}
+
+func base_error(params []*Value, v *VM) []*Value {
+	v.Raise(arg(params, 1))
+	return nil
+}
+
+func base_pcall(params []*Value, v *VM) []*Value {
+	fn := v.checkAny(params, 1, "pcall")
+	results, err := v.PCall(fn, params[1:])
+	if err != nil {
+		return []*Value{NewBool(false), err.(*LuaError).Value}
+	}
+	return append([]*Value{NewBool(true)}, results...)
+}
+
+// Only binary chunks can be loaded, as LuaVM has no compiler.
+func loadChunk(data []byte) []*Value {
+	c, err := ReadLuaC(bytes.NewReader(data))
+	if err != nil {
+		return []*Value{NewNil(), NewString(err.Error())}
+	}
+	return []*Value{{Type: CLOSURE, Val: c}}
+}
+
+func base_load(params []*Value, v *VM) []*Value {
+	fn := v.checkFunction(params, 1, "load")
+	var buf bytes.Buffer
+	for {
+		r := v.Call(fn, nil)
+		if len(r) == 0 || r[0].Type == NIL {
+			break
+		}
+		if r[0].Type != STRING {
+			return []*Value{NewNil(), NewString("reader function must return a string")}
+		}
+		if r[0].Val.(string) == "" {
+			break
+		}
+		buf.WriteString(r[0].Val.(string))
+	}
+	return loadChunk(buf.Bytes())
+}
+
+func base_loadstring(params []*Value, v *VM) []*Value {
+	return loadChunk([]byte(v.checkString(params, 1, "loadstring")))
+}
+
+func base_loadfile(params []*Value, v *VM) []*Value {
+	name := v.checkString(params, 1, "loadfile")
+	data, err := os.ReadFile(name)
+	if err != nil {
+		return []*Value{NewNil(), NewString("cannot open " + name)}
+	}
+	return loadChunk(data)
+}
+
+func base_dofile(params []*Value, v *VM) []*Value {
+	r := base_loadfile(params, v)
+	if r[0].Type == NIL {
+		v.Raise(r[1])
+	}
+	return v.Call(r[0], nil)
+}
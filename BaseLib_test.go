@@ -0,0 +1,195 @@
+package LuaVM
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestToNumber(t *testing.T) {
+	vm := NewVM()
+	tests := []struct {
+		s    string
+		base float64
+		want *Value
+	}{
+		{"10", 10, NewNumber(10)},
+		{"  0x1F  ", 10, NewNumber(31)},
+		{"1e3", 10, NewNumber(1000)},
+		{"abc", 10, NewNil()},
+		{"inf", 10, NewNil()},
+		{"ff", 16, NewNumber(255)},
+		{"zz", 36, NewNumber(1295)},
+		{"ZZ", 36, NewNumber(1295)},
+		{"12", 2, NewNil()},
+		// Other bases follow strtoul: surrounding whitespace, a sign and, in
+		// base 16, a 0x prefix are allowed, and a minus sign wraps around.
+		{" \tff\n", 16, NewNumber(255)},
+		{"+ff", 16, NewNumber(255)},
+		{"0x1F", 16, NewNumber(31)},
+		{"-ff", 16, NewNumber(float64(math.MaxUint64 - 254))},
+		{"-101", 2, NewNumber(float64(math.MaxUint64 - 4))},
+		{"-0", 8, NewNumber(0)},
+		{"ffffffffffffffffff", 16, NewNumber(math.MaxUint64)},
+		{"-ffffffffffffffffff", 16, NewNumber(math.MaxUint64)},
+		{"0x", 16, NewNil()},
+		{"0x1F", 17, NewNil()},
+		{"-", 16, NewNil()},
+		{"", 16, NewNil()},
+		{"f f", 16, NewNil()},
+		{"+-1", 16, NewNil()},
+	}
+	for _, test := range tests {
+		got := base_tonumber([]*Value{NewString(test.s), NewNumber(test.base)}, vm)[0]
+		if !rawEquals(got, test.want) {
+			t.Errorf("tonumber(%q, %v) = %v, want %v", test.s, test.base, got, test.want)
+		}
+	}
+	for _, base := range []float64{1, 37} {
+		_, err := vm.PCall(NewGoFunction(base_tonumber), values("1", base))
+		if err == nil || err.Error() != "bad argument #2 to 'tonumber' (base out of range)" {
+			t.Errorf("tonumber(\"1\", %v): got %v", base, err)
+		}
+	}
+}
+
+func TestNext(t *testing.T) {
+	vm := NewVM()
+	tb := NewTable()
+	for _, k := range []string{"d", "a", "c", "b"} {
+		tb.Set(Value{Type: STRING, Val: k}, NewString(k))
+	}
+	tb.SetInt(1, NewNumber(1))
+	var order []string
+	k := NewNil()
+	for {
+		r := base_next([]*Value{{Type: TABLE, Val: tb}, k}, vm)
+		if r[0].Type == NIL {
+			break
+		}
+		order = append(order, vm.tostring(r[0]))
+		k = r[0]
+	}
+	if len(order) != 5 {
+		t.Fatal("traversal visited ", order)
+	}
+	_, err := vm.PCall(NewGoFunction(base_next), []*Value{{Type: TABLE, Val: tb}, NewString("missing")})
+	if err == nil {
+		t.Error("next accepted a key not in the table")
+	}
+}
+
+func TestSelect(t *testing.T) {
+	vm := NewVM()
+	sel := vm.G.Get(str("select"))
+	for _, test := range []struct {
+		args []*Value
+		want []*Value
+	}{
+		{values("#"), values(0)},
+		{values("#", "a", nil, "c"), values(3)},
+		{values(1, "a", "b", "c"), values("a", "b", "c")},
+		{values(2, "a", "b", "c"), values("b", "c")},
+		{values(5, "a", "b", "c"), values()},
+		{values(-1, "a", "b", "c"), values("c")},
+		{values(-3, "a", "b", "c"), values("a", "b", "c")},
+		{values("2", "a", "b"), values("b")},
+	} {
+		r, err := vm.PCall(sel, test.args)
+		if err != nil || !sameValues(r, test.want) {
+			t.Errorf("select%v = %v, %v, want %v", test.args, r, err, test.want)
+		}
+	}
+	for _, args := range [][]*Value{values(0, "a"), values(-2, "a"), values("x")} {
+		if _, err := vm.PCall(sel, args); err == nil {
+			t.Errorf("select%v raised no error", args)
+		}
+	}
+}
+
+func TestIpairs(t *testing.T) {
+	vm := NewVM()
+	ipairs := vm.G.Get(str("ipairs"))
+	list := seq(NewString("a"), NewString("b"), NewNil(), NewString("d"))
+	r := vm.Call(ipairs, []*Value{list})
+	iter, state, control := r[0], r[1], r[2]
+	var got []string
+	for {
+		r := vm.Call(iter, []*Value{state, control})
+		if r[0].Type == NIL {
+			break
+		}
+		got = append(got, r[0].String()+"="+r[1].String())
+		control = r[0]
+	}
+	if strings.Join(got, ",") != "1=a,2=b" {
+		t.Errorf("ipairs visited %v, want it to stop at the first nil", got)
+	}
+	if _, err := vm.PCall(ipairs, values("x")); err == nil {
+		t.Error("ipairs accepted a string")
+	}
+}
+
+func TestToString(t *testing.T) {
+	vm := NewVM()
+	tostring := vm.G.Get(str("tostring"))
+	for _, test := range []struct {
+		val  *Value
+		want string
+	}{
+		{NewNil(), "nil"},
+		{NewBool(false), "false"},
+		{NewNumber(1e15), "1e+15"},
+		{NewNumber(0.1), "0.1"},
+		{NewNumber(-3), "-3"},
+		{NewString("s"), "s"},
+	} {
+		if r := vm.Call(tostring, []*Value{test.val}); r[0].String() != test.want {
+			t.Errorf("tostring(%v) = %v, want %q", test.val, r[0], test.want)
+		}
+	}
+
+	obj := &Value{Type: TABLE, Val: NewTable()}
+	if r := vm.Call(tostring, []*Value{obj}); !strings.HasPrefix(r[0].String(), "table: 0x") {
+		t.Errorf("tostring({}) = %v", r[0])
+	}
+	mt := NewTable()
+	mt.SetFunc("__tostring", func(params []*Value, v *VM) []*Value {
+		return values("custom")
+	})
+	vm.SetMetatable(obj, mt)
+	if r := vm.Call(tostring, []*Value{obj}); r[0].String() != "custom" {
+		t.Errorf("tostring with __tostring = %v, want custom", r[0])
+	}
+	mt.SetFunc("__tostring", func(params []*Value, v *VM) []*Value {
+		return values(1)
+	})
+	if _, err := vm.PCall(tostring, []*Value{obj}); err == nil || err.Error() != "'__tostring' must return a string" {
+		t.Errorf("__tostring returning a number: got %v", err)
+	}
+	if _, err := vm.PCall(tostring, nil); err == nil {
+		t.Error("tostring() raised no error")
+	}
+}
+
+func TestAssert(t *testing.T) {
+	vm := NewVM()
+	assert := vm.G.Get(str("assert"))
+	r, err := vm.PCall(assert, values(1, "unused", 3))
+	if err != nil || !sameValues(r, values(1, "unused", 3)) {
+		t.Errorf("assert(1, \"unused\", 3) = %v, %v, want its arguments", r, err)
+	}
+	for _, test := range []struct {
+		args []*Value
+		want string
+	}{
+		{values(false), "assertion failed!"},
+		{values(nil, "custom message"), "custom message"},
+		{values(false, 42), "42"},
+		{values(), "bad argument #1 to 'assert' (value expected)"},
+	} {
+		if _, err := vm.PCall(assert, test.args); err == nil || err.Error() != test.want {
+			t.Errorf("assert%v: got %v, want %q", test.args, err, test.want)
+		}
+	}
+}
@@ -0,0 +1,432 @@
+package LuaVM
+
+import (
+	"fmt"
+	"iter"
+	"reflect"
+	"runtime"
+	"strings"
+)
+
+// Reflection-based bindings let Go functions and structs be exposed to Lua
+// without writing a GOFUNC for each. Arguments are converted from Lua to the
+// Go parameter types, and results back, by toGoValue and fromGo.
+
+var (
+	errorType  = reflect.TypeOf((*error)(nil)).Elem()
+	valueType  = reflect.TypeOf((*Value)(nil))
+	tableType  = reflect.TypeOf((*Table)(nil))
+	vmType     = reflect.TypeOf((*VM)(nil))
+	gofuncType = reflect.TypeOf(GOFUNC(nil))
+)
+
+// Register sets the global name to fn, which may be a GOFUNC or any other
+// Go function. Other functions are wrapped by WrapFunc.
+func (v *VM) Register(name string, fn interface{}) {
+	v.G.Set(Value{Type: STRING, Val: name}, v.WrapFunc(name, fn))
+}
+
+// WrapFunc returns fn as a Lua function value. Each call converts the Lua
+// arguments to fn's parameter types, raising a "bad argument" error if one
+// does not convert, and converts fn's results back. A trailing error result
+// is not returned to Lua; if it is non-nil it is raised as a Lua error
+// instead. A leading *VM parameter receives the calling VM.
+func (v *VM) WrapFunc(name string, fn interface{}) *Value {
+	switch f := fn.(type) {
+	case GOFUNC:
+		return NewGoFunction(f)
+	case func([]*Value, *VM) []*Value:
+		return NewGoFunction(GOFUNC(f))
+	}
+	rv := reflect.ValueOf(fn)
+	if rv.Kind() != reflect.Func {
+		panic(fmt.Sprintf("LuaVM: cannot register %T as a function", fn))
+	}
+	return NewGoFunction(wrapReflect(name, rv))
+}
+
+// NewIterator returns a Lua function that walks seq for a generic for, as
+// in `for k, v in items() do ... end` where the GOFUNC items returns it.
+// Where seq has got to is kept on the Go side, so the function ignores the
+// state and control values the loop passes it: each call resumes seq for
+// one more pair, converted by FromGo, and returns nil once seq is done. As
+// in any generic for, a key that converts to nil ends the loop. A loop left
+// early keeps seq suspended until the function is garbage collected.
+func NewIterator[K, V any](seq iter.Seq2[K, V]) *Value {
+	next, stop := iter.Pull2(seq)
+	it := &struct{ next func() (K, V, bool) }{next}
+	runtime.AddCleanup(it, func(stop func()) { stop() }, stop)
+	return NewGoFunction(func(params []*Value, v *VM) []*Value {
+		k, val, ok := it.next()
+		if !ok {
+			return []*Value{NewNil()}
+		}
+		return []*Value{FromGo(k), FromGo(val)}
+	})
+}
+
+func wrapReflect(name string, fn reflect.Value) GOFUNC {
+	ft := fn.Type()
+	return func(params []*Value, v *VM) []*Value {
+		in := make([]reflect.Value, 0, ft.NumIn())
+		first := 0
+		if ft.NumIn() > 0 && ft.In(0) == vmType {
+			in = append(in, reflect.ValueOf(v))
+			first = 1
+		}
+		fixed := ft.NumIn()
+		if ft.IsVariadic() {
+			fixed--
+		}
+		n := 1
+		for l1 := first; l1 < fixed; l1, n = l1+1, n+1 {
+			in = append(in, v.toGoArg(params, n, name, ft.In(l1)))
+		}
+		if ft.IsVariadic() {
+			elem := ft.In(fixed).Elem()
+			for ; n <= len(params); n++ {
+				in = append(in, v.toGoArg(params, n, name, elem))
+			}
+		}
+		out := fn.Call(in)
+		if ft.NumOut() > 0 && ft.Out(ft.NumOut()-1) == errorType {
+			if err := out[len(out)-1]; !err.IsNil() {
+				v.Error("%s", err.Interface().(error).Error())
+			}
+			out = out[:len(out)-1]
+		}
+		ret := make([]*Value, len(out))
+		for k, o := range out {
+			ret[k] = fromGo(v, o)
+		}
+		return ret
+	}
+}
+
+func (v *VM) toGoArg(params []*Value, n int, name string, t reflect.Type) reflect.Value {
+	rv, err := v.toGoValue(arg(params, n), t)
+	if err != nil {
+		v.argError(n, name, err.Error())
+	}
+	return rv
+}
+
+// toGoValue converts val to a Go value of type t.
+func (v *VM) toGoValue(val *Value, t reflect.Type) (reflect.Value, error) {
+	switch t {
+	case valueType:
+		return reflect.ValueOf(val.Copy()), nil
+	case tableType:
+		if val.Type == TABLE {
+			return reflect.ValueOf(val.Val.(*Table)), nil
+		}
+		if val.Type == NIL {
+			return reflect.Zero(t), nil
+		}
+	}
+	if val.Type == USERDATA {
+		if ud := reflect.ValueOf(val.Val.(*UserData).Value); ud.IsValid() && ud.Type().AssignableTo(t) {
+			return ud, nil
+		}
+	}
+	expected := func() (reflect.Value, error) {
+		return reflect.Value{}, fmt.Errorf("%s expected, got %s", goTypeName(t), val.TypeName())
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return reflect.ValueOf(truthy(val)).Convert(t), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		var n Number
+		switch val.Type {
+		case NUMBER:
+			n = val.Num
+		case STRING:
+			var ok bool
+			if n, ok = str2number(val.Val.(string)); !ok {
+				return expected()
+			}
+		default:
+			return expected()
+		}
+		return reflect.ValueOf(float64(n)).Convert(t), nil
+	case reflect.String:
+		if val.Type != STRING && val.Type != NUMBER {
+			return expected()
+		}
+		return reflect.ValueOf(val.String()).Convert(t), nil
+	case reflect.Interface:
+		if val.Type == NIL {
+			return reflect.Zero(t), nil
+		}
+		rv := reflect.ValueOf(v.toGoAny(val))
+		if !rv.Type().AssignableTo(t) {
+			return expected()
+		}
+		return rv, nil
+	case reflect.Slice:
+		if val.Type == NIL {
+			return reflect.Zero(t), nil
+		}
+		if t.Elem().Kind() == reflect.Uint8 && val.Type == STRING {
+			return reflect.ValueOf([]byte(val.Val.(string))).Convert(t), nil
+		}
+		if val.Type != TABLE {
+			return expected()
+		}
+		tb := val.Val.(*Table)
+		n := tb.border()
+		s := reflect.MakeSlice(t, n, n)
+		for l1 := 0; l1 < n; l1++ {
+			e, err := v.toGoValue(tb.GetInt(l1+1), t.Elem())
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("index %d: %v", l1+1, err)
+			}
+			s.Index(l1).Set(e)
+		}
+		return s, nil
+	case reflect.Map:
+		if val.Type == NIL {
+			return reflect.Zero(t), nil
+		}
+		if val.Type != TABLE {
+			return expected()
+		}
+		m := reflect.MakeMap(t)
+		tb := val.Val.(*Table)
+		k, e, _ := tb.Next(Value{Type: NIL})
+		for k.Type != NIL {
+			key := k
+			gk, err := v.toGoValue(&key, t.Key())
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("key %s: %v", key.String(), err)
+			}
+			ge, err := v.toGoValue(e, t.Elem())
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("field %s: %v", key.String(), err)
+			}
+			m.SetMapIndex(gk, ge)
+			k, e, _ = tb.Next(k)
+		}
+		return m, nil
+	case reflect.Struct:
+		if val.Type != TABLE {
+			return expected()
+		}
+		s := reflect.New(t).Elem()
+		tb := val.Val.(*Table)
+		for l1 := 0; l1 < t.NumField(); l1++ {
+			f := t.Field(l1)
+			name, ok := fieldName(f)
+			if !ok {
+				continue
+			}
+			fv := tb.Get(Value{Type: STRING, Val: name})
+			if fv.Type == NIL {
+				continue
+			}
+			e, err := v.toGoValue(fv, f.Type)
+			if err != nil {
+				return reflect.Value{}, fmt.Errorf("field %s: %v", name, err)
+			}
+			s.Field(l1).Set(e)
+		}
+		return s, nil
+	case reflect.Ptr:
+		if val.Type == NIL {
+			return reflect.Zero(t), nil
+		}
+		if t.Elem().Kind() == reflect.Struct && val.Type == TABLE {
+			s, err := v.toGoValue(val, t.Elem())
+			if err != nil {
+				return reflect.Value{}, err
+			}
+			p := reflect.New(t.Elem())
+			p.Elem().Set(s)
+			return p, nil
+		}
+		return expected()
+	case reflect.Func:
+		if val.Type == NIL {
+			return reflect.Zero(t), nil
+		}
+		if val.Type != CLOSURE && val.Type != GOFUNCTION {
+			return expected()
+		}
+		return v.makeGoFunc(val.Copy(), t), nil
+	}
+	return expected()
+}
+
+// makeGoFunc returns a Go function of type t that calls the Lua function fn.
+// A Lua error, or a result that does not convert, is returned through a
+// trailing error result if t has one and panics otherwise.
+func (v *VM) makeGoFunc(fn *Value, t reflect.Type) reflect.Value {
+	return reflect.MakeFunc(t, func(args []reflect.Value) []reflect.Value {
+		params := make([]*Value, len(args))
+		for k, a := range args {
+			params[k] = fromGo(v, a)
+		}
+		hasErr := t.NumOut() > 0 && t.Out(t.NumOut()-1) == errorType
+		out := make([]reflect.Value, t.NumOut())
+		fail := func(err error) []reflect.Value {
+			if !hasErr {
+				panic(err)
+			}
+			for l1 := range out {
+				out[l1] = reflect.Zero(t.Out(l1))
+			}
+			out[len(out)-1] = reflect.ValueOf(&err).Elem()
+			return out
+		}
+		results, err := v.PCall(fn, params)
+		if err != nil {
+			return fail(err)
+		}
+		for l1 := range out {
+			if hasErr && l1 == len(out)-1 {
+				out[l1] = reflect.Zero(errorType)
+				break
+			}
+			r, err := v.toGoValue(arg(results, l1+1), t.Out(l1))
+			if err != nil {
+				return fail(fmt.Errorf("result %d: %v", l1+1, err))
+			}
+			out[l1] = r
+		}
+		return out
+	})
+}
+
+// toGoAny converts val to the Go value it most naturally corresponds to,
+// for parameters of interface type.
+func (v *VM) toGoAny(val *Value) interface{} {
+	switch val.Type {
+	case NIL:
+		return nil
+	case BOOLEAN:
+		return truthy(val)
+	case NUMBER:
+		return float64(val.Num)
+	case STRING:
+		return val.Val.(string)
+	case TABLE:
+		return val.Val.(*Table)
+	case USERDATA:
+		return val.Val.(*UserData).Value
+	case LIGHTUSERDATA:
+		return val.Val
+	}
+	return val.Copy()
+}
+
+// NewUserDataFromStruct wraps a struct, or a pointer to one, as a userdata
+// whose exported fields and methods are reachable from Lua. Fields are read
+// and assigned by name, or by the name in a `lua:"name"` tag, fields tagged
+// `lua:"-"` are hidden, and methods are called with the colon syntax,
+// obj:Method(...). A struct passed by
+// value is copied, so assignments from Lua do not reach the original.
+func (v *VM) NewUserDataFromStruct(s interface{}) *Value {
+	rv := reflect.ValueOf(s)
+	if rv.Kind() == reflect.Struct {
+		p := reflect.New(rv.Type())
+		p.Elem().Set(rv)
+		rv = p
+	}
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		panic(fmt.Sprintf("LuaVM: %T is not a struct", s))
+	}
+	return NewUserData(rv.Interface(), v.structMetatable(rv.Type()))
+}
+
+// structMetatable returns the metatable shared by userdata bound to
+// pointers of type t.
+func (v *VM) structMetatable(t reflect.Type) *Table {
+	mt, created := v.NewMetatable("go:" + typeName(t.Elem()))
+	if !created {
+		return mt
+	}
+	mt.SetFunc("__index", func(params []*Value, v *VM) []*Value {
+		rv := reflect.ValueOf(params[0].Val.(*UserData).Value)
+		name := v.checkString(params, 2, "__index")
+		if m, ok := rv.Type().MethodByName(name); ok {
+			return []*Value{v.WrapFunc(name, m.Func.Interface())}
+		}
+		if f, ok := structField(rv.Elem(), name); ok {
+			return []*Value{fromGo(v, f)}
+		}
+		return []*Value{NewNil()}
+	})
+	mt.SetFunc("__newindex", func(params []*Value, v *VM) []*Value {
+		rv := reflect.ValueOf(params[0].Val.(*UserData).Value)
+		name := v.checkString(params, 2, "__newindex")
+		f, ok := structField(rv.Elem(), name)
+		if !ok {
+			v.Error("%s has no field '%s'", t.Elem(), name)
+		}
+		val, err := v.toGoValue(arg(params, 3), f.Type())
+		if err != nil {
+			v.Error("cannot assign to field '%s' (%v)", name, err)
+		}
+		f.Set(val)
+		return nil
+	})
+	mt.SetFunc("__tostring", func(params []*Value, v *VM) []*Value {
+		return []*Value{NewString(fmt.Sprintf("%s: %p", t.Elem(), params[0].Val.(*UserData).Value))}
+	})
+	return mt
+}
+
+// typeName names t uniquely, by its package path rather than the package
+// name alone, which two packages may share. Unnamed types are told apart by
+// their structure.
+func typeName(t reflect.Type) string {
+	if t.Name() == "" {
+		return t.String()
+	}
+	return t.PkgPath() + "." + t.Name()
+}
+
+// structField returns the exported field of s called name in Lua.
+func structField(s reflect.Value, name string) (reflect.Value, bool) {
+	t := s.Type()
+	for l1 := 0; l1 < t.NumField(); l1++ {
+		if n, ok := fieldName(t.Field(l1)); ok && n == name {
+			return s.Field(l1), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// fieldName returns the name Lua knows the struct field f by: the name in
+// its `lua:"name"` tag, or else its Go name. It returns false for fields Lua
+// cannot see, which are those that are unexported or tagged `lua:"-"`.
+func fieldName(f reflect.StructField) (string, bool) {
+	tag := f.Tag.Get("lua")
+	if !f.IsExported() || tag == "-" {
+		return "", false
+	}
+	if name, _, _ := strings.Cut(tag, ","); name != "" {
+		return name, true
+	}
+	return f.Name, true
+}
+
+func goTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+		reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.String:
+		return "string"
+	case reflect.Slice, reflect.Map, reflect.Struct:
+		return "table"
+	case reflect.Func:
+		return "function"
+	}
+	return t.String()
+}
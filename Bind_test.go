@@ -0,0 +1,176 @@
+package LuaVM
+
+import (
+	"errors"
+	"maps"
+	"math/rand"
+	randv2 "math/rand/v2"
+	"slices"
+	"strings"
+	"testing"
+)
+
+type point struct {
+	X, Y  float64
+	Label string `lua:"label"`
+	Token string `lua:"-"`
+	hits  int
+}
+
+func (p *point) Move(dx, dy float64) *point {
+	p.X += dx
+	p.Y += dy
+	p.hits++
+	return p
+}
+
+func TestRegister(t *testing.T) {
+	vm := NewVM()
+	vm.Register("add", func(a, b int) int { return a + b })
+	vm.Register("join", func(sep string, parts ...string) string { return strings.Join(parts, sep) })
+	vm.Register("sum", func(xs []float64) (s float64) {
+		for _, x := range xs {
+			s += x
+		}
+		return
+	})
+	vm.Register("fail", func() (int, error) { return 0, errors.New("boom") })
+	vm.Register("apply", func(f func(int) int, x int) int { return f(x) })
+
+	call := func(name string, params ...*Value) []*Value {
+		t.Helper()
+		ret, err := vm.PCall(vm.G.Get(Value{Type: STRING, Val: name}), params)
+		if err != nil {
+			t.Fatal(name, ": ", err)
+		}
+		return ret
+	}
+	if r := call("add", NewNumber(2), NewString("3")); r[0].Num != 5 {
+		t.Error("add(2, '3') = ", r[0])
+	}
+	if r := call("join", NewString(","), NewString("a"), NewString("b")); r[0].Val.(string) != "a,b" {
+		t.Error("join = ", r[0])
+	}
+	xs := NewTable()
+	xs.SetInt(1, NewNumber(1))
+	xs.SetInt(2, NewNumber(2.5))
+	if r := call("sum", &Value{Type: TABLE, Val: xs}); r[0].Num != 3.5 {
+		t.Error("sum = ", r[0])
+	}
+	double := NewGoFunction(func(params []*Value, v *VM) []*Value {
+		return []*Value{NewNumber(float64(params[0].Num) * 2)}
+	})
+	if r := call("apply", double, NewNumber(21)); r[0].Num != 42 {
+		t.Error("apply = ", r[0])
+	}
+
+	_, err := vm.PCall(vm.G.Get(Value{Type: STRING, Val: "fail"}), nil)
+	if err == nil || err.(*LuaError).Value.String() != "boom" {
+		t.Error("fail() raised ", err)
+	}
+	_, err = vm.PCall(vm.G.Get(Value{Type: STRING, Val: "add"}), []*Value{NewNumber(1), NewString("x")})
+	if err == nil || !strings.Contains(err.Error(), "bad argument #2 to 'add'") {
+		t.Error("add(1, 'x') raised ", err)
+	}
+}
+
+func TestUserDataFromStruct(t *testing.T) {
+	vm := NewVM()
+	p := &point{X: 1, Y: 2, Label: "a"}
+	ud := vm.NewUserDataFromStruct(p)
+	key := func(s string) *Value { return NewString(s) }
+
+	if x := vm.getTable(ud, key("X")); x.Num != 1 {
+		t.Error("p.X = ", x)
+	}
+	if l := vm.getTable(ud, key("label")); l.Val.(string) != "a" {
+		t.Error("p.label = ", l)
+	}
+	if h := vm.getTable(ud, key("hits")); h.Type != NIL {
+		t.Error("unexported field visible as ", h)
+	}
+	for _, name := range []string{"Token", "-"} {
+		if tok := vm.getTable(ud, key(name)); tok.Type != NIL {
+			t.Errorf("field tagged lua:\"-\" visible as p[%q] = %v", name, tok)
+		}
+	}
+	vm.setTable(ud, key("Y"), *NewNumber(5))
+	if p.Y != 5 {
+		t.Error("p.Y = 5 left ", p.Y)
+	}
+
+	move := vm.getTable(ud, key("Move"))
+	ret, err := vm.PCall(&move, []*Value{ud, NewNumber(1), NewNumber(1)})
+	if err != nil {
+		t.Fatal("p:Move raised ", err)
+	}
+	if p.X != 2 || p.Y != 6 || p.hits != 1 {
+		t.Error("p:Move(1, 1) left ", *p)
+	}
+	if got, err := CheckUserData[*point](ret[0]); err != nil || got != p {
+		t.Error("p:Move returned ", ret[0])
+	}
+
+	_, err = vm.PCall(NewGoFunction(func(params []*Value, v *VM) []*Value {
+		v.setTable(ud, key("Z"), *NewNumber(0))
+		return nil
+	}), nil)
+	if err == nil || !strings.Contains(err.Error(), "no field 'Z'") {
+		t.Error("p.Z = 0 raised ", err)
+	}
+	_, err = vm.PCall(NewGoFunction(func(params []*Value, v *VM) []*Value {
+		v.setTable(ud, key("Token"), *NewString("stolen"))
+		return nil
+	}), nil)
+	if err == nil || p.Token != "" {
+		t.Error("p.Token = 'stolen' raised ", err)
+	}
+
+	vm.Register("token", func(p point) string { return p.Token })
+	fields := NewTable()
+	fields.SetString("Token", "a")
+	fields.SetString("-", "b")
+	if r, err := vm.PCall(vm.G.Get(*key("token")), []*Value{{Type: TABLE, Val: fields}}); err != nil || r[0].Val.(string) != "" {
+		t.Error("a table converted to a point set its hidden field: ", r, err)
+	}
+	_, err = vm.PCall(NewGoFunction(func(params []*Value, v *VM) []*Value {
+		v.setTable(ud, key("X"), *NewString("x"))
+		return nil
+	}), nil)
+	if err == nil {
+		t.Error("p.X = 'x' was accepted")
+	}
+}
+
+func TestNewIterator(t *testing.T) {
+	vm := NewVM(WithInstructionLimit(10000))
+	words := []string{"x", "y", "z"}
+	s, err := genericFor(vm, *NewIterator(slices.All(words)), Value{}, Value{})
+	if err != nil || s != "0x1y2z" {
+		t.Errorf("got %q, %v, want \"0x1y2z\"", s, err)
+	}
+
+	// The state lives in the iterator, which keeps returning nil once done.
+	it := NewIterator(maps.All(map[string]int{"one": 1}))
+	if r := vm.Call(it, nil); r[0].String() != "one" || r[1].Num != 1 {
+		t.Errorf("first call: got %v", r)
+	}
+	for l1 := 0; l1 < 2; l1++ {
+		if r := vm.Call(it, nil); len(r) != 1 || r[0].Type != NIL {
+			t.Errorf("call after the end: got %v", r)
+		}
+	}
+}
+
+func TestStructMetatablesByPackagePath(t *testing.T) {
+	vm := NewVM()
+	// Both types are rand.Rand, but in different packages.
+	v1 := vm.NewUserDataFromStruct(rand.New(rand.NewSource(1)))
+	v2 := vm.NewUserDataFromStruct(randv2.New(randv2.NewPCG(1, 2)))
+	if vm.getMetatable(v1) == vm.getMetatable(v2) {
+		t.Error("math/rand.Rand and math/rand/v2.Rand share a metatable")
+	}
+	if vm.getMetatable(v1) != vm.getMetatable(vm.NewUserDataFromStruct(rand.New(rand.NewSource(2)))) {
+		t.Error("two *rand.Rand do not share a metatable")
+	}
+}
@@ -0,0 +1,148 @@
+package LuaVM
+
+import "strings"
+
+// rawEquals compares a and b without calling metamethods. Tables, closures
+// Go functions and threads are equal only to themselves.
+func rawEquals(a *Value, b *Value) bool {
+	if a.Type != b.Type {
+		return false
+	}
+	switch a.Type {
+	case NIL:
+		return true
+	case NUMBER:
+		return a.Num == b.Num
+	case BOOLEAN:
+		return truthy(a) == truthy(b)
+	case LIGHTUSERDATA, GOFUNCTION:
+		ida, oka := identity(a)
+		idb, okb := identity(b)
+		return oka && okb && ida == idb
+	}
+	return a.Val == b.Val
+}
+
+// getMetatable returns the metatable of val, or nil if it has none.
+func (v *VM) getMetatable(val *Value) *Table {
+	switch val.Type {
+	case TABLE:
+		return val.Val.(*Table).Metatable
+	case USERDATA:
+		return val.Val.(*UserData).Metatable
+	case STRING:
+		return v.stringMeta
+	}
+	return nil
+}
+
+// getMetamethod returns the metamethod called event for val, or nil if it
+// has none.
+func (v *VM) getMetamethod(val *Value, event string) *Value {
+	mt := v.getMetatable(val)
+	if mt == nil {
+		return nil
+	}
+	m := mt.Get(Value{Type: STRING, Val: event})
+	if m.Type == NIL {
+		return nil
+	}
+	return m
+}
+
+// WithCollation sets the function that orders strings for <, <=, > and >=,
+// the part strcoll plays in reference Lua. cmp returns a negative number,
+// zero or a positive number as a sorts before, with or after b. Without it
+// strings are compared byte by byte.
+func WithCollation(cmp func(a, b string) int) Option {
+	return func(v *VM) {
+		v.collate = cmp
+	}
+}
+
+func (v *VM) compareStrings(a string, b string) int {
+	if v.collate != nil {
+		return v.collate(a, b)
+	}
+	return strings.Compare(a, b)
+}
+
+// sharedMetamethod returns the metamethod called event that a and b share,
+// or nil if they do not share one. Comparisons only use a metamethod both
+// operands agree on.
+func (v *VM) sharedMetamethod(a *Value, b *Value, event string) *Value {
+	if a.Type != b.Type {
+		return nil
+	}
+	m1 := v.getMetamethod(a, event)
+	if m1 == nil {
+		return nil
+	}
+	m2 := v.getMetamethod(b, event)
+	if m2 == nil || !rawEquals(m1, m2) {
+		return nil
+	}
+	return m1
+}
+
+// equals implements the == operator. Values that are not raw equal are only
+// equal if they are two tables or two userdata whose shared __eq
+// metamethod says so.
+func (v *VM) equals(a *Value, b *Value) bool {
+	if rawEquals(a, b) {
+		return true
+	}
+	if a.Type != TABLE && a.Type != USERDATA {
+		return false
+	}
+	if m := v.sharedMetamethod(a, b, "__eq"); m != nil {
+		r := v.Call(m, []*Value{a, b})
+		return len(r) > 0 && truthy(r[0])
+	}
+	return false
+}
+
+// orderError raises the error for comparing a and b, which have no order.
+func (v *VM) orderError(a *Value, b *Value) {
+	if a.TypeName() == b.TypeName() {
+		v.Error("attempt to compare two %s values", a.TypeName())
+	}
+	v.Error("attempt to compare %s with %s", a.TypeName(), b.TypeName())
+}
+
+// lessThan implements the < operator, including the __lt metamethod.
+func (v *VM) lessThan(a *Value, b *Value) bool {
+	if a.Type == NUMBER && b.Type == NUMBER {
+		return a.Num < b.Num
+	}
+	if a.Type == STRING && b.Type == STRING {
+		return v.compareStrings(a.Val.(string), b.Val.(string)) < 0
+	}
+	if m := v.sharedMetamethod(a, b, "__lt"); m != nil {
+		r := v.Call(m, []*Value{a, b})
+		return len(r) > 0 && truthy(r[0])
+	}
+	v.orderError(a, b)
+	return false
+}
+
+// lessEqual implements the <= operator. Without an __le metamethod it falls
+// back to not (b < a) through __lt, as Lua 5.1 does.
+func (v *VM) lessEqual(a *Value, b *Value) bool {
+	if a.Type == NUMBER && b.Type == NUMBER {
+		return a.Num <= b.Num
+	}
+	if a.Type == STRING && b.Type == STRING {
+		return v.compareStrings(a.Val.(string), b.Val.(string)) <= 0
+	}
+	if m := v.sharedMetamethod(a, b, "__le"); m != nil {
+		r := v.Call(m, []*Value{a, b})
+		return len(r) > 0 && truthy(r[0])
+	}
+	if m := v.sharedMetamethod(b, a, "__lt"); m != nil {
+		r := v.Call(m, []*Value{b, a})
+		return len(r) == 0 || !truthy(r[0])
+	}
+	v.orderError(a, b)
+	return false
+}
@@ -0,0 +1,105 @@
+package LuaVM
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The fixtures in testdata/conformance are Lua programs compiled with luac
+// 5.1, each paired with the output reference Lua 5.1 gives for it: what the
+// program prints, followed by an "error: " line if it ends with an
+// uncaught error. A new fixture needs name.lua, name.luac from
+// "luac -o name.luac name.lua", and name.expected from running it under
+// lua 5.1.
+
+// knownFailures are the fixtures LuaVM does not yet run as reference Lua
+// does, with the reason. They are skipped while they fail, and fail the
+// test once they pass so that the list is kept up to date.
+var knownFailures = map[string]string{}
+
+// runConformance runs the chunk at path on a fresh VM and returns its output
+// in the form of the .expected files. err is set if the chunk could not be
+// loaded or the VM panicked.
+func runConformance(path string) (out string, err error) {
+	var buf bytes.Buffer
+	defer func() {
+		if r := recover(); r != nil {
+			out = buf.String()
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	c, err := ReadLuaC(f)
+	if err != nil {
+		return "", err
+	}
+	vm := NewVM(WithStdout(&buf))
+	if err := vm.RunClosure(c); err != nil {
+		fmt.Fprintln(&buf, "error:", err)
+	}
+	return buf.String(), nil
+}
+
+func conformanceFixtures(t *testing.T) []string {
+	paths, err := filepath.Glob("testdata/conformance/*.luac")
+	if err != nil || len(paths) == 0 {
+		t.Fatal("no conformance fixtures: ", err)
+	}
+	return paths
+}
+
+func TestConformance(t *testing.T) {
+	for _, path := range conformanceFixtures(t) {
+		name := strings.TrimSuffix(filepath.Base(path), ".luac")
+		t.Run(name, func(t *testing.T) {
+			want, err := os.ReadFile(strings.TrimSuffix(path, ".luac") + ".expected")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := runConformance(path)
+			passed := err == nil && got == string(want)
+			reason, known := knownFailures[name]
+			switch {
+			case passed && known:
+				t.Errorf("passes, but is listed in knownFailures: %s", reason)
+			case known:
+				t.Skip(reason)
+			case err != nil:
+				t.Errorf("%v\noutput so far:\n%s", err, got)
+			case !passed:
+				t.Errorf("got:\n%s\nwant:\n%s", got, want)
+			}
+		})
+	}
+}
+
+// TestConformanceCoverage checks that the fixtures between them execute
+// every opcode.
+func TestConformanceCoverage(t *testing.T) {
+	seen := make(map[OPCODE]bool)
+	var walk func(p *FunctionPrototype)
+	walk = func(p *FunctionPrototype) {
+		for _, i := range p.Instructions {
+			seen[i.Opcode] = true
+		}
+		for _, f := range p.Functions {
+			walk(f)
+		}
+	}
+	for _, path := range conformanceFixtures(t) {
+		walk(loadFixture(t, path).Function)
+	}
+	for op := OP_MOVE; op <= OP_VARARG; op++ {
+		if !seen[op] {
+			t.Error("no conformance fixture uses opcode ", op)
+		}
+	}
+}
@@ -0,0 +1,269 @@
+package LuaVM
+
+import (
+	"fmt"
+	"reflect"
+	"unsafe"
+)
+
+// ToGo converts val to plain Go data: nil, bool, float64, string, []any for
+// a non-empty table whose keys are exactly 1..n, and map[string]any for any
+// other table, with number keys formatted as Lua prints them. Userdata
+// converts to the Go value it holds. Functions, threads, tables with keys
+// that are neither strings nor numbers, and tables that contain themselves
+// are errors.
+func ToGo(val *Value) (interface{}, error) {
+	return toGo(val, make(map[*Table]bool))
+}
+
+func toGo(val *Value, visiting map[*Table]bool) (interface{}, error) {
+	switch val.Type {
+	case NIL:
+		return nil, nil
+	case BOOLEAN:
+		return truthy(val), nil
+	case NUMBER:
+		return float64(val.Num), nil
+	case STRING:
+		return val.Val.(string), nil
+	case USERDATA:
+		return val.Val.(*UserData).Value, nil
+	case LIGHTUSERDATA:
+		return val.Val, nil
+	case TABLE:
+		t := val.Val.(*Table)
+		if visiting[t] {
+			return nil, fmt.Errorf("cannot convert a table that contains itself")
+		}
+		visiting[t] = true
+		defer delete(visiting, t)
+		if n, ok := sequenceLen(t); ok && n > 0 {
+			s := make([]interface{}, n)
+			for l1 := range s {
+				e, err := toGo(t.GetInt(l1+1), visiting)
+				if err != nil {
+					return nil, err
+				}
+				s[l1] = e
+			}
+			return s, nil
+		}
+		m := make(map[string]interface{})
+		k, e, _ := t.Next(Value{Type: NIL})
+		for k.Type != NIL {
+			key, err := keyString(k)
+			if err != nil {
+				return nil, err
+			}
+			if m[key], err = toGo(e, visiting); err != nil {
+				return nil, err
+			}
+			k, e, _ = t.Next(k)
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("cannot convert a %s value", val.TypeName())
+}
+
+// sequenceLen returns n if the keys of t are exactly 1..n.
+func sequenceLen(t *Table) (int, bool) {
+	count := 0
+	k, _, _ := t.Next(Value{Type: NIL})
+	for k.Type != NIL {
+		count++
+		k, _, _ = t.Next(k)
+	}
+	n := t.border()
+	return n, n == count
+}
+
+func keyString(k Value) (string, error) {
+	switch k.Type {
+	case STRING:
+		return k.Val.(string), nil
+	case NUMBER:
+		return numberToString(k.Num), nil
+	}
+	return "", fmt.Errorf("cannot convert a table with a %s key", k.TypeName())
+}
+
+// FromGo converts Go data to a Lua value, the reverse of ToGo. Numbers of
+// any kind become numbers, slices and arrays become sequences, maps become
+// tables, and structs, or pointers to them, become tables of their exported
+// fields named as NewUserDataFromStruct names them. Functions are wrapped as
+// by WrapFunc. *Value and *Table are used as they are, and any other value is
+// held in a userdata without a metatable. Go data that contains itself
+// converts to a table that contains itself.
+func FromGo(x interface{}) *Value {
+	return fromGo(nil, reflect.ValueOf(x))
+}
+
+// fromGo converts rv to a Lua value for FromGo, if v is nil, and for the
+// reflection bindings of v otherwise. The two differ only in how structs
+// convert, which fromStruct decides.
+func fromGo(v *VM, rv reflect.Value) *Value {
+	c := converter{v: v}
+	return c.fromGo(rv)
+}
+
+// A converter converts one Go value to Lua. It remembers the table made for
+// each map, slice and struct pointer it has seen, so that Go data sharing
+// them shares tables, and Go data containing itself becomes a table
+// containing itself rather than recursing for ever.
+type converter struct {
+	v    *VM
+	seen map[visit]*Value
+}
+
+// A visit identifies Go data by its type, where it starts and, for a slice,
+// its length.
+type visit struct {
+	typ reflect.Type
+	ptr unsafe.Pointer
+	len int
+}
+
+func visitOf(rv reflect.Value) visit {
+	key := visit{typ: rv.Type(), ptr: rv.UnsafePointer()}
+	if rv.Kind() == reflect.Slice {
+		key.len = rv.Len()
+	}
+	return key
+}
+
+// lookup returns what rv has already converted to, or else registers val as
+// what it converts to, before its contents are converted.
+func (c *converter) lookup(rv reflect.Value, val *Value) (*Value, bool) {
+	key := visitOf(rv)
+	if old, ok := c.seen[key]; ok {
+		return old.Copy(), true
+	}
+	if c.seen == nil {
+		c.seen = make(map[visit]*Value)
+	}
+	c.seen[key] = val
+	return val, false
+}
+
+func (c *converter) fromGo(rv reflect.Value) *Value {
+	if !rv.IsValid() {
+		return NewNil()
+	}
+	switch rv.Type() {
+	case valueType:
+		if rv.IsNil() {
+			return NewNil()
+		}
+		return rv.Interface().(*Value).Copy()
+	case tableType:
+		if rv.IsNil() {
+			return NewNil()
+		}
+		return &Value{Type: TABLE, Val: rv.Interface().(*Table)}
+	}
+	switch rv.Kind() {
+	case reflect.Bool:
+		return NewBool(rv.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return NewNumber(float64(rv.Int()))
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return NewNumber(float64(rv.Uint()))
+	case reflect.Float32, reflect.Float64:
+		return NewNumber(rv.Float())
+	case reflect.String:
+		return NewString(rv.String())
+	case reflect.Interface:
+		if rv.IsNil() {
+			return NewNil()
+		}
+		if err, ok := rv.Interface().(error); ok {
+			return NewString(err.Error())
+		}
+		return c.fromGo(rv.Elem())
+	case reflect.Slice, reflect.Array:
+		if rv.Kind() == reflect.Slice && rv.IsNil() {
+			return NewNil()
+		}
+		if rv.Kind() == reflect.Slice && rv.Type().Elem().Kind() == reflect.Uint8 {
+			return NewString(string(rv.Bytes()))
+		}
+		t := NewTableSize(rv.Len(), 0)
+		val := &Value{Type: TABLE, Val: t}
+		if rv.Kind() == reflect.Slice {
+			if old, ok := c.lookup(rv, val); ok {
+				return old
+			}
+		}
+		for l1 := 0; l1 < rv.Len(); l1++ {
+			t.SetInt(l1+1, c.fromGo(rv.Index(l1)))
+		}
+		return val
+	case reflect.Map:
+		if rv.IsNil() {
+			return NewNil()
+		}
+		t := NewTableSize(0, rv.Len())
+		val := &Value{Type: TABLE, Val: t}
+		if old, ok := c.lookup(rv, val); ok {
+			return old
+		}
+		iter := rv.MapRange()
+		for iter.Next() {
+			if k := c.fromGo(iter.Key()); k.Type != NIL {
+				t.Set(*k, c.fromGo(iter.Value()))
+			}
+		}
+		return val
+	case reflect.Func:
+		if rv.IsNil() {
+			return NewNil()
+		}
+		if rv.Type().ConvertibleTo(gofuncType) {
+			return NewGoFunction(rv.Convert(gofuncType).Interface().(GOFUNC))
+		}
+		return NewGoFunction(wrapReflect("?", rv))
+	case reflect.Ptr:
+		if rv.IsNil() {
+			return NewNil()
+		}
+		if rv.Elem().Kind() == reflect.Struct {
+			return c.fromStruct(rv)
+		}
+		// A pointer that leads only back to itself holds nothing, so it
+		// converts to nil.
+		if old, ok := c.lookup(rv, NewNil()); ok {
+			return old
+		}
+		val := c.fromGo(rv.Elem())
+		c.seen[visitOf(rv)] = val
+		return val
+	case reflect.Struct:
+		return c.fromStruct(rv)
+	}
+	return NewUserData(rv.Interface(), nil)
+}
+
+// fromStruct converts a struct, or a pointer to one. The bindings of a VM
+// bind it as a userdata with NewUserDataFromStruct, so that Lua reaches the
+// Go value itself; FromGo has no VM to bind it to and copies its exported
+// fields into a table.
+func (c *converter) fromStruct(rv reflect.Value) *Value {
+	if c.v != nil {
+		return c.v.NewUserDataFromStruct(rv.Interface())
+	}
+	t := NewTableSize(0, reflect.Indirect(rv).NumField())
+	val := &Value{Type: TABLE, Val: t}
+	if rv.Kind() == reflect.Ptr {
+		if old, ok := c.lookup(rv, val); ok {
+			return old
+		}
+	}
+	rv = reflect.Indirect(rv)
+	typ := rv.Type()
+	for l1 := 0; l1 < typ.NumField(); l1++ {
+		if name, ok := fieldName(typ.Field(l1)); ok {
+			t.Set(Value{Type: STRING, Val: name}, c.fromGo(rv.Field(l1)))
+		}
+	}
+	return val
+}
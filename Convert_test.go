@@ -0,0 +1,151 @@
+package LuaVM
+
+import (
+	"errors"
+	"math"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestToGo(t *testing.T) {
+	seq := NewTable()
+	seq.SetInt(1, NewString("a"))
+	seq.SetInt(2, NewBool(true))
+	obj := NewTable()
+	obj.SetNumber("n", 1.5)
+	obj.SetTable("list", seq)
+	obj.SetInt(3, NewString("three"))
+
+	got, err := ToGo(&Value{Type: TABLE, Val: obj})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]interface{}{
+		"n":    1.5,
+		"list": []interface{}{"a", true},
+		"3":    "three",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ToGo = %#v, want %#v", got, want)
+	}
+
+	back := FromGo(want)
+	if again, _ := ToGo(back); !reflect.DeepEqual(again, want) {
+		t.Errorf("ToGo(FromGo(x)) = %#v", again)
+	}
+
+	// Sharing a table is fine; containing it is not.
+	obj.SetTable("again", seq)
+	if _, err := ToGo(&Value{Type: TABLE, Val: obj}); err != nil {
+		t.Error("shared table: ", err)
+	}
+	seq.SetInt(3, &Value{Type: TABLE, Val: obj})
+	if _, err := ToGo(&Value{Type: TABLE, Val: obj}); err == nil {
+		t.Error("ToGo accepted a cycle")
+	}
+}
+
+func TestFromGoStruct(t *testing.T) {
+	val := FromGo(&point{X: 1, Label: "p", Token: "secret"})
+	if val.Type != TABLE {
+		t.Fatal("FromGo(&point{}) is a ", val.TypeName())
+	}
+	p := val.Val.(*Table)
+	if p.Get(Value{Type: STRING, Val: "label"}).Val.(string) != "p" ||
+		p.Get(Value{Type: STRING, Val: "X"}).Num != 1 ||
+		p.Get(Value{Type: STRING, Val: "hits"}).Type != NIL ||
+		p.Get(Value{Type: STRING, Val: "Token"}).Type != NIL || p.Get(Value{Type: STRING, Val: "-"}).Type != NIL {
+		t.Errorf("FromGo(&point{}) = %v", p.Entries)
+	}
+
+	// The bindings of a VM share the converter but bind structs instead.
+	vm := NewVM()
+	pts := fromGo(vm, reflect.ValueOf([]point{{X: 1}, {X: 2}})).Val.(*Table)
+	if e := pts.GetInt(2); e.Type != USERDATA || e.Val.(*UserData).Value.(*point).X != 2 {
+		t.Errorf("a []point result converts to %v", pts.GetInt(2))
+	}
+	errs := FromGo([]error{errors.New("oops")}).Val.(*Table)
+	if got := errs.GetInt(1); got.Type != STRING || got.Val.(string) != "oops" {
+		t.Errorf("FromGo([]error{...})[1] = %v, want the message", got)
+	}
+}
+
+type ring struct {
+	Name string
+	Next *ring
+}
+
+func TestFromGoCycles(t *testing.T) {
+	m := map[string]interface{}{}
+	m["self"] = m
+	tb := FromGo(m).Val.(*Table)
+	if got := tb.Get(Value{Type: STRING, Val: "self"}); got.Type != TABLE || got.Val.(*Table) != tb {
+		t.Errorf("a map holding itself converts to %v", got)
+	}
+
+	a := &ring{Name: "a"}
+	a.Next = &ring{Name: "b", Next: a}
+	ta := FromGo(a).Val.(*Table)
+	tb = ta.Get(Value{Type: STRING, Val: "Next"}).Val.(*Table)
+	if back := tb.Get(Value{Type: STRING, Val: "Next"}); back.Type != TABLE || back.Val.(*Table) != ta {
+		t.Errorf("a ring of structs converts to %v", back)
+	}
+
+	type loop *loop
+	var p loop
+	p = &p
+	if got := FromGo(p); got.Type != NIL {
+		t.Errorf("a pointer to itself converts to %v", got)
+	}
+
+	// Sharing without a cycle converts each use in full.
+	n := 7
+	s := FromGo([]*int{&n, &n}).Val.(*Table)
+	if s.GetInt(1).Num != 7 || s.GetInt(2).Num != 7 {
+		t.Errorf("a shared pointer converts to %v and %v", s.GetInt(1), s.GetInt(2))
+	}
+}
+
+func TestJSON(t *testing.T) {
+	if NewVM().G.Get(Value{Type: STRING, Val: "json"}).Type != NIL {
+		t.Error("json is installed without being asked for")
+	}
+	vm := NewVM(WithLibs(AllLibs | LibJSON))
+	json := vm.G.Get(Value{Type: STRING, Val: "json"}).Val.(*Table)
+	encode := json.Get(Value{Type: STRING, Val: "encode"})
+	decode := json.Get(Value{Type: STRING, Val: "decode"})
+
+	opts := NewTable()
+	opts.Set(Value{Type: STRING, Val: "sort_keys"}, NewBool(true))
+	opts.Set(Value{Type: STRING, Val: "empty_table_as_array"}, NewBool(true))
+	doc := `{"a":[1,2.5,"x\n\"y\""],"b":{"c":false},"d":[]}`
+	ret, err := vm.PCall(decode, []*Value{NewString(doc)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ret, err = vm.PCall(encode, []*Value{ret[0], {Type: TABLE, Val: opts}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := ret[0].Val.(string); got != doc {
+		t.Errorf("round trip gave %s", got)
+	}
+
+	ret, err = vm.PCall(encode, []*Value{{Type: TABLE, Val: NewTable()}})
+	if err != nil || ret[0].Val.(string) != "{}" {
+		t.Error("encode({}) = ", ret, err)
+	}
+	for _, bad := range []*Value{NewNumber(math.Inf(1)), NewGoFunction(json_encode)} {
+		if _, err := vm.PCall(encode, []*Value{bad}); err == nil {
+			t.Error("encode accepted ", bad.TypeName())
+		}
+	}
+	ret, err = vm.PCall(encode, []*Value{NewString("caf\xc3\xa9 \xff\xc3")})
+	if err != nil || ret[0].Val.(string) != `"café \ufffd\ufffd"` {
+		t.Error("encode of invalid UTF-8 = ", ret, err)
+	}
+	if _, err := vm.PCall(decode, []*Value{NewString("[1,")}); err == nil || !strings.Contains(err.Error(), "JSON") {
+		t.Error("decode('[1,') raised ", err)
+	}
+}
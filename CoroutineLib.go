@@ -0,0 +1,223 @@
+package LuaVM
+
+import (
+	"runtime"
+	"weak"
+)
+
+// Coroutine is a Lua thread. Each coroutine runs its body on its own
+// goroutine, but only one of the VM's goroutines runs at a time: resume
+// and yield hand control back and forth over channels, swapping the VM's
+// frame stack as they go.
+//
+// The goroutine refers only to the thread inside the Coroutine, so that a
+// suspended coroutine nothing else refers to can be garbage collected, and
+// a cleanup then stops its goroutine. A coroutine whose own stack refers to
+// it is kept until VM.Close.
+type Coroutine struct {
+	*thread
+}
+
+type thread struct {
+	fn     *Value // body, until the coroutine is first resumed
+	status string
+	parent *Coroutine
+
+	s          *Stackframe
+	frameStack []*Stackframe
+	stack      []Value
+	top        int
+	open       []*Upvalue
+
+	// The resumer's frames and stack, saved while the coroutine runs.
+	resumerS          *Stackframe
+	resumerFrameStack []*Stackframe
+	resumerStack      []Value
+	resumerTop        int
+	resumerOpen       []*Upvalue
+
+	resume chan []*Value
+	yield  chan coroutineResult
+}
+
+type coroutineResult struct {
+	values []*Value
+	done   bool
+	err    interface{}
+}
+
+func openCoroutine(v *VM) *Table {
+	t := NewTable()
+	t.SetFunc("create", co_create)
+	t.SetFunc("resume", co_resume)
+	t.SetFunc("yield", co_yield)
+	t.SetFunc("status", co_status)
+	t.SetFunc("running", co_running)
+	t.SetFunc("wrap", co_wrap)
+	return t
+}
+
+func checkCoroutine(params []*Value, v *VM, fname string) *Coroutine {
+	a := arg(params, 1)
+	if a.Type != THREAD {
+		v.typeError(params, 1, fname, "coroutine")
+	}
+	return a.Val.(*Coroutine)
+}
+
+func co_create(params []*Value, v *VM) []*Value {
+	fn := v.checkFunction(params, 1, "create")
+	co := &Coroutine{&thread{
+		fn:     fn,
+		status: "suspended",
+		resume: make(chan []*Value),
+		yield:  make(chan coroutineResult),
+	}}
+	runtime.AddCleanup(co, (*thread).close, co.thread)
+	if len(v.coroutines) >= v.coroutineSweep {
+		for p := range v.coroutines {
+			if p.Value() == nil {
+				delete(v.coroutines, p)
+			}
+		}
+		v.coroutineSweep = max(minCoroutineSweep, 2*len(v.coroutines))
+	}
+	v.coroutines[weak.Make(co)] = true
+	return []*Value{{Type: THREAD, Val: co}}
+}
+
+// Resume runs co until it yields or finishes, returning the values it
+// yielded or returned.
+func (v *VM) Resume(co *Coroutine, params []*Value) ([]*Value, error) {
+	if co.status == "dead" {
+		return nil, &LuaError{Value: NewString("cannot resume dead coroutine")}
+	}
+	if co.status != "suspended" {
+		return nil, &LuaError{Value: NewString("cannot resume non-suspended coroutine")}
+	}
+	co.resumerS, co.resumerFrameStack = v.S, v.FrameStack
+	co.resumerStack, co.resumerTop, co.resumerOpen = v.stack, v.top, v.openUpvalues
+	v.S, v.FrameStack = co.s, co.frameStack
+	v.stack, v.top, v.openUpvalues = co.stack, co.top, co.open
+	co.parent = v.current
+	if co.parent != nil {
+		co.parent.status = "normal"
+	}
+	v.current = co
+	co.status = "running"
+	if co.fn != nil {
+		fn := co.fn
+		co.fn = nil
+		go v.runCoroutine(co.thread, fn, params)
+	} else {
+		co.resume <- params
+	}
+	r := <-co.yield
+
+	co.s, co.frameStack = v.S, v.FrameStack
+	co.stack, co.top, co.open = v.stack, v.top, v.openUpvalues
+	v.S, v.FrameStack = co.resumerS, co.resumerFrameStack
+	v.stack, v.top, v.openUpvalues = co.resumerStack, co.resumerTop, co.resumerOpen
+	co.resumerS, co.resumerFrameStack = nil, nil
+	co.resumerStack, co.resumerOpen = nil, nil
+	v.current = co.parent
+	if co.parent != nil {
+		co.parent.status = "running"
+	}
+	co.parent = nil
+	co.status = "suspended"
+	if r.done || r.err != nil {
+		co.status = "dead"
+		co.s, co.frameStack, co.stack, co.open = nil, nil, nil, nil
+		delete(v.coroutines, weak.Make(co))
+	}
+	switch e := r.err.(type) {
+	case nil:
+		return r.values, nil
+	case *LuaError:
+		return nil, e
+	case string:
+		return nil, &LuaError{Value: NewString(e)}
+	default:
+		panic(e)
+	}
+}
+
+// errCoroutineClosed unwinds the goroutine of a coroutine stopped by
+// VM.Close.
+type errCoroutineClosed struct{}
+
+func (t *thread) close() {
+	if t.status == "suspended" && t.fn == nil {
+		t.status = "dead"
+		close(t.resume)
+	}
+}
+
+func (v *VM) runCoroutine(co *thread, fn *Value, params []*Value) {
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(errCoroutineClosed); ok {
+				return
+			}
+			co.yield <- coroutineResult{err: r}
+		}
+	}()
+	values := v.Call(fn, params)
+	co.yield <- coroutineResult{values: values, done: true}
+}
+
+// Yield suspends the running coroutine, handing params to the resumer, and
+// returns the values passed to the next resume.
+func (v *VM) Yield(params []*Value) []*Value {
+	if v.current == nil {
+		v.Error("attempt to yield from outside a coroutine")
+	}
+	co := v.current.thread
+	values := make([]*Value, len(params))
+	for k, p := range params {
+		values[k] = p.Copy()
+	}
+	co.yield <- coroutineResult{values: values}
+	params, ok := <-co.resume
+	if !ok {
+		panic(errCoroutineClosed{})
+	}
+	return params
+}
+
+func co_resume(params []*Value, v *VM) []*Value {
+	co := checkCoroutine(params, v, "resume")
+	values, err := v.Resume(co, params[1:])
+	if err != nil {
+		return []*Value{NewBool(false), err.(*LuaError).Value}
+	}
+	return append([]*Value{NewBool(true)}, values...)
+}
+
+func co_yield(params []*Value, v *VM) []*Value {
+	return v.Yield(params)
+}
+
+func co_status(params []*Value, v *VM) []*Value {
+	return []*Value{NewString(checkCoroutine(params, v, "status").status)}
+}
+
+func co_running(params []*Value, v *VM) []*Value {
+	if v.current == nil {
+		return []*Value{NewNil()}
+	}
+	return []*Value{{Type: THREAD, Val: v.current}}
+}
+
+func co_wrap(params []*Value, v *VM) []*Value {
+	co := checkCoroutine(co_create(params, v), v, "wrap")
+	var wrapped GOFUNC = func(params []*Value, v *VM) []*Value {
+		values, err := v.Resume(co, params)
+		if err != nil {
+			v.Raise(err.(*LuaError).Value)
+		}
+		return values
+	}
+	return []*Value{NewGoFunction(wrapped)}
+}
@@ -0,0 +1,102 @@
+package LuaVM
+
+import (
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func coroutineFunc(vm *VM, name string) *Value {
+	return vm.G.Get(str("coroutine")).Val.(*Table).Get(str(name))
+}
+
+func TestCoroutineResumeYield(t *testing.T) {
+	vm := NewVM()
+	defer vm.Close()
+	// The body yields its argument doubled, then returns what it is resumed
+	// with.
+	body := NewGoFunction(func(params []*Value, v *VM) []*Value {
+		r := v.Yield([]*Value{NewNumber(float64(params[0].Num) * 2)})
+		return r
+	})
+	co := vm.Call(coroutineFunc(vm, "create"), []*Value{body})[0]
+	thread := co.Val.(*Coroutine)
+	status := func() string { return vm.Call(coroutineFunc(vm, "status"), []*Value{co})[0].String() }
+
+	if s := status(); s != "suspended" {
+		t.Errorf("status before resume: %s", s)
+	}
+	r, err := vm.Resume(thread, []*Value{NewNumber(21)})
+	if err != nil || len(r) != 1 || r[0].Num != 42 {
+		t.Fatalf("first resume: got %v, %v, want 42", r, err)
+	}
+	if s := status(); s != "suspended" {
+		t.Errorf("status after yield: %s", s)
+	}
+	r, err = vm.Resume(thread, []*Value{NewString("a"), NewString("b")})
+	if err != nil || len(r) != 2 || r[1].String() != "b" {
+		t.Fatalf("second resume: got %v, %v, want a b", r, err)
+	}
+	if s := status(); s != "dead" {
+		t.Errorf("status after return: %s", s)
+	}
+	if _, err := vm.Resume(thread, nil); err == nil || err.Error() != "cannot resume dead coroutine" {
+		t.Errorf("resuming a dead coroutine: got %v", err)
+	}
+	r = vm.Call(coroutineFunc(vm, "resume"), []*Value{co})
+	if truthy(r[0]) || r[1].String() != "cannot resume dead coroutine" {
+		t.Errorf("coroutine.resume of a dead coroutine: got %v", r)
+	}
+
+	if _, err := vm.PCall(coroutineFunc(vm, "yield"), nil); err == nil || err.Error() != "attempt to yield from outside a coroutine" {
+		t.Errorf("yield outside a coroutine: got %v", err)
+	}
+}
+
+func TestCoroutineWrapErrors(t *testing.T) {
+	vm := NewVM()
+	defer vm.Close()
+	fail := NewGoFunction(func(params []*Value, v *VM) []*Value {
+		v.Error("boom")
+		return nil
+	})
+	wrapped := vm.Call(coroutineFunc(vm, "wrap"), []*Value{fail})[0]
+	if _, err := vm.PCall(wrapped, nil); err == nil || err.Error() != "boom" {
+		t.Errorf("error in a wrapped coroutine: got %v", err)
+	}
+	if _, err := vm.PCall(wrapped, nil); err == nil || err.Error() != "cannot resume dead coroutine" {
+		t.Errorf("calling a dead wrapped coroutine: got %v", err)
+	}
+}
+
+func TestAbandonedCoroutinesAreCollected(t *testing.T) {
+	vm := NewVM()
+	defer vm.Close()
+	// Count the goroutines of these coroutines alone: closing a coroutine
+	// unwinds its body, so the deferred decrement runs as its goroutine ends.
+	var running atomic.Int64
+	body := NewGoFunction(func(params []*Value, v *VM) []*Value {
+		running.Add(1)
+		defer running.Add(-1)
+		return v.Yield(nil)
+	})
+	create := coroutineFunc(vm, "create")
+	for l1 := 0; l1 < 200; l1++ {
+		co := vm.Call(create, []*Value{body})[0]
+		if _, err := vm.Resume(co.Val.(*Coroutine), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := running.Load(); n != 200 {
+		t.Fatalf("%d of 200 coroutines suspended", n)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for running.Load() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("%d goroutines left of 200", running.Load())
+		}
+		runtime.GC()
+		time.Sleep(10 * time.Millisecond)
+	}
+}
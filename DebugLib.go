@@ -0,0 +1,61 @@
+package LuaVM
+
+import (
+	"fmt"
+	"strings"
+)
+
+func openDebug(v *VM) *Table {
+	t := NewTable()
+	t.SetFunc("getmetatable", debug_getmetatable)
+	t.SetFunc("setmetatable", debug_setmetatable)
+	t.SetFunc("traceback", debug_traceback)
+	return t
+}
+
+func debug_getmetatable(params []*Value, v *VM) []*Value {
+	mt := v.getMetatable(v.checkAny(params, 1, "getmetatable"))
+	if mt == nil {
+		return []*Value{NewNil()}
+	}
+	return []*Value{{Type: TABLE, Val: mt}}
+}
+
+func debug_setmetatable(params []*Value, v *VM) []*Value {
+	mt := arg(params, 2)
+	switch mt.Type {
+	case NIL:
+		v.SetMetatable(v.checkAny(params, 1, "setmetatable"), nil)
+	case TABLE:
+		v.SetMetatable(v.checkAny(params, 1, "setmetatable"), mt.Val.(*Table))
+	default:
+		v.typeError(params, 2, "setmetatable", "nil or table")
+	}
+	return []*Value{NewBool(true)}
+}
+
+func debug_traceback(params []*Value, v *VM) []*Value {
+	msg := arg(params, 1)
+	if msg.Type != NIL && msg.Type != STRING && msg.Type != NUMBER {
+		return []*Value{msg}
+	}
+	return []*Value{NewString(v.traceback(v.optString(params, 1, "traceback", "")))}
+}
+
+func (v *VM) traceback(msg string) string {
+	var b strings.Builder
+	b.WriteString(msg)
+	b.WriteString("\nstack traceback:")
+	for l1 := len(v.FrameStack); l1 >= 0; l1-- {
+		s := v.S
+		if l1 < len(v.FrameStack) {
+			s = v.FrameStack[l1]
+		}
+		if s == nil {
+			b.WriteString("\n\t[C]: ?")
+			continue
+		}
+		fmt.Fprintf(&b, "\n\t[Lua function]: pc %d", s.PC)
+	}
+	return b.String()
+}
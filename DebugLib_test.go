@@ -0,0 +1,54 @@
+package LuaVM
+
+import (
+	"strings"
+	"testing"
+)
+
+func debugFunc(vm *VM, name string) *Value {
+	return vm.G.Get(str("debug")).Val.(*Table).Get(str(name))
+}
+
+func TestDebugMetatables(t *testing.T) {
+	vm := NewVM()
+	obj := &Value{Type: TABLE, Val: NewTable()}
+	locked := NewTable()
+	locked.SetString("__metatable", "locked")
+	vm.SetMetatable(obj, locked)
+
+	// Unlike getmetatable and setmetatable, the debug versions ignore
+	// __metatable.
+	if r := vm.Call(debugFunc(vm, "getmetatable"), []*Value{obj}); r[0].Val != locked {
+		t.Errorf("debug.getmetatable = %v, want the protected metatable", r[0])
+	}
+	mt := &Value{Type: TABLE, Val: NewTable()}
+	if _, err := vm.PCall(debugFunc(vm, "setmetatable"), []*Value{obj, mt}); err != nil {
+		t.Fatal(err)
+	}
+	if got := obj.Val.(*Table).Metatable; got != mt.Val {
+		t.Error("debug.setmetatable did not replace a protected metatable")
+	}
+	vm.Call(debugFunc(vm, "setmetatable"), []*Value{obj, NewNil()})
+	if r := vm.Call(debugFunc(vm, "getmetatable"), []*Value{obj}); r[0].Type != NIL {
+		t.Errorf("debug.getmetatable = %v after clearing it", r[0])
+	}
+
+	if _, err := vm.PCall(debugFunc(vm, "setmetatable"), []*Value{obj, NewNumber(2)}); err == nil {
+		t.Error("debug.setmetatable accepted a number as a metatable")
+	}
+	if _, err := vm.PCall(debugFunc(vm, "setmetatable"), []*Value{NewNumber(1), mt}); err == nil || err.Error() != "cannot set the metatable of a number value" {
+		t.Errorf("debug.setmetatable on a number: got %v", err)
+	}
+}
+
+func TestDebugTraceback(t *testing.T) {
+	vm := NewVM()
+	r := vm.Call(debugFunc(vm, "traceback"), values("oops"))
+	if s := r[0].String(); !strings.HasPrefix(s, "oops\nstack traceback:") {
+		t.Errorf("debug.traceback(\"oops\") = %q", s)
+	}
+	tb := &Value{Type: TABLE, Val: NewTable()}
+	if r := vm.Call(debugFunc(vm, "traceback"), []*Value{tb}); r[0] != tb {
+		t.Errorf("debug.traceback returned %v for a table message, want the table", r[0])
+	}
+}
@@ -0,0 +1,306 @@
+package LuaVM
+
+// Before a function first runs, lower binds each of its instructions to the
+// handler that executes it, so that the dispatch loop makes one indirect
+// call per instruction instead of going through a switch. RK operands that
+// name constants are resolved to pointers into the constant table, and the
+// hottest opcodes get handlers specialised to their operand kinds: ADD with
+// two registers is opAddRR, with a constant C it is opAddRK, and so on.
+// The specialised handlers only take the common path themselves, and fall
+// back to the general Op_ handler for anything else, such as operands that
+// are not numbers or tables with metatables.
+
+var handlers [OP_VARARG + 1]func(*Instr, *Stackframe, *VM)
+
+func init() {
+	handlers = [...]func(*Instr, *Stackframe, *VM){
+		OP_MOVE:      Op_Move,
+		OP_LOADK:     opLoadK,
+		OP_LOADBOOL:  Op_LoadBool,
+		OP_LOADNIL:   Op_LoadNil,
+		OP_GETUPVAL:  Op_GetUpVal,
+		OP_GETGLOBAL: opGetGlobal,
+		OP_GETTABLE:  Op_GetTable,
+		OP_SETGLOBAL: Op_SetGlobal,
+		OP_SETUPVAL:  Op_SetUpVal,
+		OP_SETTABLE:  Op_SetTable,
+		OP_NEWTABLE:  Op_NewTable,
+		OP_SELF:      Op_Self,
+		OP_ADD:       Op_Add,
+		OP_SUB:       Op_Sub,
+		OP_MUL:       Op_Mul,
+		OP_DIV:       Op_Div,
+		OP_MOD:       Op_Mod,
+		OP_POW:       Op_Pow,
+		OP_UNM:       Op_Unm,
+		OP_NOT:       Op_Not,
+		OP_LEN:       Op_Len,
+		OP_CONCAT:    Op_Concat,
+		OP_JMP:       Op_Jmp,
+		OP_EQ:        opEq,
+		OP_LT:        opLt,
+		OP_LE:        opLe,
+		OP_TEST:      Op_Test,
+		OP_TESTSET:   Op_TestSet,
+		OP_CALL:      Op_Call,
+		OP_TAILCALL:  Op_TailCall,
+		OP_RETURN:    Op_Return,
+		OP_FORLOOP:   Op_ForLoop,
+		OP_FORPREP:   Op_ForPrep,
+		OP_TFORLOOP:  Op_TForLoop,
+		OP_SETLIST:   Op_SetList,
+		OP_CLOSE:     Op_Close,
+		OP_CLOSURE:   Op_Closure,
+		OP_VARARG:    Op_Vararg,
+	}
+}
+
+// arithHandlers holds the specialised handlers of the arithmetic opcodes
+// by operand kinds: register and register, register and constant, and
+// constant and register.
+var arithHandlers = map[OPCODE][3]func(*Instr, *Stackframe, *VM){
+	OP_ADD: {opAddRR, opAddRK, opAddKR},
+	OP_SUB: {opSubRR, opSubRK, opSubKR},
+	OP_MUL: {opMulRR, opMulRK, opMulKR},
+	OP_DIV: {opDivRR, opDivRK, opDivKR},
+}
+
+// lower binds the instructions of p and of the functions nested in it.
+func (p *FunctionPrototype) lower() {
+	if p.lowered {
+		return
+	}
+	for l1 := range p.Instructions {
+		p.lowerInstr(&p.Instructions[l1])
+	}
+	for _, f := range p.Functions {
+		f.lower()
+	}
+	p.lowered = true
+}
+
+func (p *FunctionPrototype) lowerInstr(i *Instr) {
+	if i.Opcode < 0 || int(i.Opcode) >= len(handlers) {
+		// The operand of an OP_SETLIST, which is never executed.
+		i.handler = opInvalid
+		return
+	}
+	i.handler = handlers[i.Opcode]
+	i.kb, i.kc = nil, nil
+	switch i.Opcode {
+	case OP_LOADK, OP_GETGLOBAL:
+		i.kb = p.constant(int(i.B))
+	case OP_GETTABLE:
+		i.kc = p.rk(int(i.C))
+		if i.kc != nil {
+			i.handler = opGetTableK
+		}
+	case OP_SETTABLE:
+		i.kb = p.rk(int(i.B))
+		i.kc = p.rk(int(i.C))
+		if i.kb != nil {
+			i.handler = opSetTableK
+		}
+	case OP_ADD, OP_SUB, OP_MUL, OP_DIV:
+		i.kb = p.rk(int(i.B))
+		i.kc = p.rk(int(i.C))
+		switch {
+		case i.kb == nil && i.kc == nil:
+			i.handler = arithHandlers[i.Opcode][0]
+		case i.kb == nil:
+			i.handler = arithHandlers[i.Opcode][1]
+		case i.kc == nil:
+			i.handler = arithHandlers[i.Opcode][2]
+		}
+	case OP_EQ, OP_LT, OP_LE:
+		i.kb = p.rk(int(i.B))
+		i.kc = p.rk(int(i.C))
+	}
+}
+
+// rk returns the constant an RK operand names, or nil if it names a
+// register.
+func (p *FunctionPrototype) rk(x int) *Value {
+	if x&256 == 0 {
+		return nil
+	}
+	return p.constant(x & 255)
+}
+
+func (p *FunctionPrototype) constant(k int) *Value {
+	if k < 0 || k >= len(p.Constants) {
+		return nil
+	}
+	return &p.Constants[k]
+}
+
+// rkB and rkC return the B and C operands of a lowered instruction.
+func (s *Stackframe) rkB(i *Instr) *Value {
+	if i.kb != nil {
+		return i.kb
+	}
+	return &s.Regs[i.B]
+}
+
+func (s *Stackframe) rkC(i *Instr) *Value {
+	if i.kc != nil {
+		return i.kc
+	}
+	return &s.Regs[i.C]
+}
+
+func opInvalid(i *Instr, s *Stackframe, v *VM) {
+	v.Error("invalid instruction %#x", uint32(i.Raw))
+}
+
+func opLoadK(i *Instr, s *Stackframe, v *VM) {
+	if i.kb == nil {
+		Op_LoadK(i, s, v)
+		return
+	}
+	s.Regs[i.A] = *i.kb
+}
+
+func opGetGlobal(i *Instr, s *Stackframe, v *VM) {
+	if i.kb != nil {
+		if val := v.G.get(*i.kb); val.Type != NIL || v.G.Metatable == nil {
+			s.Regs[i.A] = val
+			return
+		}
+	}
+	Op_GetGlobal(i, s, v)
+}
+
+func opGetTableK(i *Instr, s *Stackframe, v *VM) {
+	if obj := &s.Regs[i.B]; obj.Type == TABLE {
+		t := obj.Val.(*Table)
+		if val := t.get(*i.kc); val.Type != NIL || t.Metatable == nil {
+			s.Regs[i.A] = val
+			return
+		}
+	}
+	Op_GetTable(i, s, v)
+}
+
+func opSetTableK(i *Instr, s *Stackframe, v *VM) {
+	if obj := &s.Regs[i.A]; obj.Type == TABLE {
+		t := obj.Val.(*Table)
+		if t.Metatable == nil {
+			t.set(*i.kb, *s.rkC(i))
+			return
+		}
+	}
+	Op_SetTable(i, s, v)
+}
+
+func opEq(i *Instr, s *Stackframe, v *VM) {
+	eq(i, s, v, s.rkB(i), s.rkC(i))
+}
+
+func opLt(i *Instr, s *Stackframe, v *VM) {
+	lt(i, s, v, s.rkB(i), s.rkC(i))
+}
+
+func opLe(i *Instr, s *Stackframe, v *VM) {
+	le(i, s, v, s.rkB(i), s.rkC(i))
+}
+
+func opAddRR(i *Instr, s *Stackframe, v *VM) {
+	b, c := &s.Regs[i.B], &s.Regs[i.C]
+	if b.Type == NUMBER && c.Type == NUMBER {
+		s.Regs[i.A] = Value{Type: NUMBER, Num: b.Num + c.Num}
+		return
+	}
+	Op_Add(i, s, v)
+}
+
+func opAddRK(i *Instr, s *Stackframe, v *VM) {
+	if b := &s.Regs[i.B]; b.Type == NUMBER && i.kc.Type == NUMBER {
+		s.Regs[i.A] = Value{Type: NUMBER, Num: b.Num + i.kc.Num}
+		return
+	}
+	Op_Add(i, s, v)
+}
+
+func opAddKR(i *Instr, s *Stackframe, v *VM) {
+	if c := &s.Regs[i.C]; i.kb.Type == NUMBER && c.Type == NUMBER {
+		s.Regs[i.A] = Value{Type: NUMBER, Num: i.kb.Num + c.Num}
+		return
+	}
+	Op_Add(i, s, v)
+}
+
+func opSubRR(i *Instr, s *Stackframe, v *VM) {
+	b, c := &s.Regs[i.B], &s.Regs[i.C]
+	if b.Type == NUMBER && c.Type == NUMBER {
+		s.Regs[i.A] = Value{Type: NUMBER, Num: b.Num - c.Num}
+		return
+	}
+	Op_Sub(i, s, v)
+}
+
+func opSubRK(i *Instr, s *Stackframe, v *VM) {
+	if b := &s.Regs[i.B]; b.Type == NUMBER && i.kc.Type == NUMBER {
+		s.Regs[i.A] = Value{Type: NUMBER, Num: b.Num - i.kc.Num}
+		return
+	}
+	Op_Sub(i, s, v)
+}
+
+func opSubKR(i *Instr, s *Stackframe, v *VM) {
+	if c := &s.Regs[i.C]; i.kb.Type == NUMBER && c.Type == NUMBER {
+		s.Regs[i.A] = Value{Type: NUMBER, Num: i.kb.Num - c.Num}
+		return
+	}
+	Op_Sub(i, s, v)
+}
+
+func opMulRR(i *Instr, s *Stackframe, v *VM) {
+	b, c := &s.Regs[i.B], &s.Regs[i.C]
+	if b.Type == NUMBER && c.Type == NUMBER {
+		s.Regs[i.A] = Value{Type: NUMBER, Num: b.Num * c.Num}
+		return
+	}
+	Op_Mul(i, s, v)
+}
+
+func opMulRK(i *Instr, s *Stackframe, v *VM) {
+	if b := &s.Regs[i.B]; b.Type == NUMBER && i.kc.Type == NUMBER {
+		s.Regs[i.A] = Value{Type: NUMBER, Num: b.Num * i.kc.Num}
+		return
+	}
+	Op_Mul(i, s, v)
+}
+
+func opMulKR(i *Instr, s *Stackframe, v *VM) {
+	if c := &s.Regs[i.C]; i.kb.Type == NUMBER && c.Type == NUMBER {
+		s.Regs[i.A] = Value{Type: NUMBER, Num: i.kb.Num * c.Num}
+		return
+	}
+	Op_Mul(i, s, v)
+}
+
+func opDivRR(i *Instr, s *Stackframe, v *VM) {
+	b, c := &s.Regs[i.B], &s.Regs[i.C]
+	if b.Type == NUMBER && c.Type == NUMBER {
+		s.Regs[i.A] = Value{Type: NUMBER, Num: b.Num / c.Num}
+		return
+	}
+	Op_Div(i, s, v)
+}
+
+func opDivRK(i *Instr, s *Stackframe, v *VM) {
+	if b := &s.Regs[i.B]; b.Type == NUMBER && i.kc.Type == NUMBER {
+		s.Regs[i.A] = Value{Type: NUMBER, Num: b.Num / i.kc.Num}
+		return
+	}
+	Op_Div(i, s, v)
+}
+
+func opDivKR(i *Instr, s *Stackframe, v *VM) {
+	if c := &s.Regs[i.C]; i.kb.Type == NUMBER && c.Type == NUMBER {
+		s.Regs[i.A] = Value{Type: NUMBER, Num: i.kb.Num / c.Num}
+		return
+	}
+	Op_Div(i, s, v)
+}
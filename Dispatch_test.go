@@ -0,0 +1,202 @@
+package LuaVM
+
+import "testing"
+
+// fieldLoop returns a closure for
+//
+//	local t = {}
+//	t.x = 0
+//	for i = 1, n do t.x = t.x + i end
+//	return t.x
+func fieldLoop(n float64) *Value {
+	p := &FunctionPrototype{
+		Instructions: []Instr{
+			{Opcode: OP_NEWTABLE, A: 0},
+			{Opcode: OP_SETTABLE, A: 0, B: 256 + 0, C: 256 + 1},
+			{Opcode: OP_LOADK, A: 1, B: 2},
+			{Opcode: OP_LOADK, A: 2, B: 3},
+			{Opcode: OP_LOADK, A: 3, B: 2},
+			{Opcode: OP_FORPREP, A: 1, B: 3},
+			{Opcode: OP_GETTABLE, A: 5, B: 0, C: 256 + 0},
+			{Opcode: OP_ADD, A: 5, B: 5, C: 4},
+			{Opcode: OP_SETTABLE, A: 0, B: 256 + 0, C: 5},
+			{Opcode: OP_FORLOOP, A: 1, B: -4},
+			{Opcode: OP_GETTABLE, A: 5, B: 0, C: 256 + 0},
+			{Opcode: OP_RETURN, A: 5, B: 2},
+			{Opcode: OP_RETURN, A: 0, B: 1},
+		},
+		Constants: []Value{
+			{Type: STRING, Val: "x"},
+			{Type: NUMBER, Num: 0},
+			{Type: NUMBER, Num: 1},
+			{Type: NUMBER, Num: Number(n)},
+		},
+		MaxStackSize: 6,
+	}
+	return &Value{Type: CLOSURE, Val: &Closure{Function: p}}
+}
+
+// callSwitch runs fn on the unlowered dispatch loop and returns its first
+// result.
+func callSwitch(v *VM, fn *Value) Value {
+	top := v.top
+	v.growStack(top + 1)
+	v.stack[top] = *fn
+	depth := len(v.FrameStack)
+	v.precall(top, 0, 1)
+	v.executeSwitch(depth)
+	ret := v.stack[top]
+	v.top = top
+	return ret
+}
+
+// executeSwitch is execute without the handlers bound by lowering, which
+// decodes every instruction as it runs it. It is only the baseline for the
+// dispatch tests and benchmarks, so it lives here rather than in the VM.
+func (v *VM) executeSwitch(depth int) {
+	for {
+		i := &v.S.Closure.Function.Instructions[v.S.PC]
+		v.S.PC++
+		switch i.Opcode {
+		case OP_MOVE:
+			Op_Move(i, v.S, v)
+		case OP_LOADK:
+			Op_LoadK(i, v.S, v)
+		case OP_LOADBOOL:
+			Op_LoadBool(i, v.S, v)
+		case OP_LOADNIL:
+			Op_LoadNil(i, v.S, v)
+		case OP_GETUPVAL:
+			Op_GetUpVal(i, v.S, v)
+		case OP_GETGLOBAL:
+			Op_GetGlobal(i, v.S, v)
+		case OP_GETTABLE:
+			Op_GetTable(i, v.S, v)
+		case OP_SETGLOBAL:
+			Op_SetGlobal(i, v.S, v)
+		case OP_SETUPVAL:
+			Op_SetUpVal(i, v.S, v)
+		case OP_SETTABLE:
+			Op_SetTable(i, v.S, v)
+		case OP_NEWTABLE:
+			Op_NewTable(i, v.S, v)
+		case OP_SELF:
+			Op_Self(i, v.S, v)
+		case OP_ADD:
+			Op_Add(i, v.S, v)
+		case OP_SUB:
+			Op_Sub(i, v.S, v)
+		case OP_MUL:
+			Op_Mul(i, v.S, v)
+		case OP_DIV:
+			Op_Div(i, v.S, v)
+		case OP_MOD:
+			Op_Mod(i, v.S, v)
+		case OP_POW:
+			Op_Pow(i, v.S, v)
+		case OP_UNM:
+			Op_Unm(i, v.S, v)
+		case OP_NOT:
+			Op_Not(i, v.S, v)
+		case OP_LEN:
+			Op_Len(i, v.S, v)
+		case OP_CONCAT:
+			Op_Concat(i, v.S, v)
+		case OP_JMP:
+			Op_Jmp(i, v.S, v)
+		case OP_EQ:
+			Op_Eq(i, v.S, v)
+		case OP_LT:
+			Op_Lt(i, v.S, v)
+		case OP_LE:
+			Op_Le(i, v.S, v)
+		case OP_TEST:
+			Op_Test(i, v.S, v)
+		case OP_TESTSET:
+			Op_TestSet(i, v.S, v)
+		case OP_CALL:
+			Op_Call(i, v.S, v)
+		case OP_TAILCALL:
+			Op_TailCall(i, v.S, v)
+		case OP_RETURN:
+			Op_Return(i, v.S, v)
+		case OP_FORLOOP:
+			Op_ForLoop(i, v.S, v)
+		case OP_FORPREP:
+			Op_ForPrep(i, v.S, v)
+		case OP_TFORLOOP:
+			Op_TForLoop(i, v.S, v)
+		case OP_SETLIST:
+			Op_SetList(i, v.S, v)
+		case OP_CLOSE:
+			Op_Close(i, v.S, v)
+		case OP_CLOSURE:
+			Op_Closure(i, v.S, v)
+		case OP_VARARG:
+			Op_Vararg(i, v.S, v)
+		}
+		if v.S == nil || len(v.FrameStack) == depth {
+			break
+		}
+	}
+}
+
+func TestLoweredDispatch(t *testing.T) {
+	vm := NewVM()
+	for _, test := range []struct {
+		name string
+		fn   *Value
+		want Number
+	}{
+		{"sum", sumLoop(100), 10100},
+		{"field", fieldLoop(100), 5050},
+	} {
+		if got := vm.Call(test.fn, nil)[0].Num; got != test.want {
+			t.Errorf("%s: lowered dispatch returned %v, want %v", test.name, got, test.want)
+		}
+		if got := callSwitch(vm, test.fn).Num; got != test.want {
+			t.Errorf("%s: switch dispatch returned %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// A field missing from a table with a metatable takes the general path.
+	p := &FunctionPrototype{
+		Instructions: []Instr{{Opcode: OP_GETTABLE, A: 0, B: 1, C: 256 + 0}},
+		Constants:    []Value{{Type: STRING, Val: "x"}},
+	}
+	p.lower()
+	base := NewTable()
+	base.SetNumber("x", 42)
+	obj := NewTable()
+	obj.Metatable = NewTable()
+	obj.Metatable.SetTable("__index", base)
+	s := &Stackframe{Regs: []Value{{}, {Type: TABLE, Val: obj}}, Closure: &Closure{Function: p}}
+	i := &p.Instructions[0]
+	i.handler(i, s, vm)
+	if s.Regs[0].Num != 42 {
+		t.Error("obj.x = ", s.Regs[0].String(), " through __index")
+	}
+}
+
+func benchmarkDispatch(b *testing.B, fn *Value) {
+	b.Run("switch", func(b *testing.B) {
+		vm := NewVM()
+		for l1 := 0; l1 < b.N; l1++ {
+			callSwitch(vm, fn)
+		}
+	})
+	b.Run("lowered", func(b *testing.B) {
+		vm := NewVM()
+		for l1 := 0; l1 < b.N; l1++ {
+			vm.Call(fn, nil)
+		}
+	})
+}
+
+func BenchmarkDispatchArithmetic(b *testing.B) {
+	benchmarkDispatch(b, sumLoop(1000))
+}
+
+func BenchmarkDispatchFields(b *testing.B) {
+	benchmarkDispatch(b, fieldLoop(1000))
+}
@@ -0,0 +1,28 @@
+package LuaVM
+
+import "fmt"
+
+// LuaError is a Lua error raised while running a script. Value holds the
+// error object, which is usually, but not necessarily, a string.
+type LuaError struct {
+	Value *Value
+}
+
+func (e *LuaError) Error() string {
+	return e.Value.String()
+}
+
+// Error raises a Lua error with a formatted message. It does not return.
+func (v *VM) Error(format string, a ...interface{}) {
+	throw(format, a...)
+}
+
+// throw raises a Lua error where no VM is at hand.
+func throw(format string, a ...interface{}) {
+	panic(&LuaError{Value: NewString(fmt.Sprintf(format, a...))})
+}
+
+// Raise raises val as a Lua error object. It does not return.
+func (v *VM) Raise(val *Value) {
+	panic(&LuaError{Value: val.Copy()})
+}
@@ -0,0 +1,238 @@
+package LuaVM
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// The fuzz targets check that no input makes the loader or the VM panic,
+// hang or allocate without bound: bad input has to come back as an error.
+// Their seeds are the fixtures that run cleanly, so that they also run as
+// ordinary tests:
+//
+//	go test -fuzz FuzzReadLuaC
+//	go test -fuzz FuzzExecute
+//
+// The exec count can stand still for up to -fuzzminimizetime, a minute by
+// default, while the fuzzer minimises a new interesting input.
+
+// fuzzLimit is the instruction budget each FuzzExecute input runs under,
+// and fuzzMaxString the longest string it may build.
+const (
+	fuzzLimit     = 100000
+	fuzzMaxString = 1 << 16
+)
+
+var fuzzSeeds = []string{
+	"test.luac",
+	"testdata/conformance/arith.luac",
+	"testdata/conformance/fornum.luac",
+	"testdata/conformance/loops.luac",
+	"testdata/bench/fib.luac",
+	"testdata/bench/nbody.luac",
+	"testdata/bench/spectralnorm.luac",
+	"testdata/bench/binarytrees.luac",
+	"testdata/bench/tables.luac",
+	"testdata/bench/closures.luac",
+	"testdata/bench/methods.luac",
+}
+
+func readSeeds(f *testing.F) [][]byte {
+	var seeds [][]byte
+	for _, path := range fuzzSeeds {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			f.Fatal(err)
+		}
+		seeds = append(seeds, data)
+	}
+	return seeds
+}
+
+func FuzzReadLuaC(f *testing.F) {
+	for _, data := range readSeeds(f) {
+		f.Add(data)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c, err := ReadLuaC(bytes.NewReader(data))
+		if err == nil && c == nil {
+			t.Fatal("no closure and no error")
+		}
+	})
+}
+
+// FuzzExecute runs a seed chunk after patching it. The patch is a list of
+// 10-byte edits: a function index, a kind, an index into that function's
+// instructions or constants, and a 32-bit word that is either the new
+// instruction or the material for the new constant. Edited chunks that no
+// longer verify are skipped, since ReadLuaC would have rejected them; the
+// rest must run to completion or to an error.
+func FuzzExecute(f *testing.F) {
+	seeds := readSeeds(f)
+	for l1 := range seeds {
+		f.Add(uint8(l1), []byte{})
+	}
+	// Return from arith at once, and turn the first constant of loops into
+	// the string "1".
+	f.Add(uint8(1), fuzzEdit(0, 0, 0, 0x0080001e))
+	f.Add(uint8(3), fuzzEdit(0, 1, 0, 1<<2|3))
+
+	f.Fuzz(func(t *testing.T, seed uint8, patch []byte) {
+		c, err := ReadLuaC(bytes.NewReader(seeds[int(seed)%len(seeds)]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var protos []*FunctionPrototype
+		var walk func(p *FunctionPrototype)
+		walk = func(p *FunctionPrototype) {
+			protos = append(protos, p)
+			for _, fn := range p.Functions {
+				walk(fn)
+			}
+		}
+		walk(c.Function)
+
+		for ; len(patch) >= 10; patch = patch[10:] {
+			p := protos[int(patch[0])%len(protos)]
+			index := int(binary.LittleEndian.Uint32(patch[2:]) & 0x7fffffff)
+			word := binary.LittleEndian.Uint32(patch[6:])
+			if patch[1]&1 == 0 {
+				p.Instructions[index%len(p.Instructions)] = decodeInstruction(Instruction(word))
+			} else if len(p.Constants) > 0 {
+				p.Constants[index%len(p.Constants)] = fuzzConstant(word)
+			}
+		}
+		if err := c.Function.verify(); err != nil {
+			t.Skip(err)
+		}
+		for _, p := range protos {
+			p.lowered = false
+		}
+		c.Function.lower()
+
+		vm := NewVM(WithLibs(LibBase|LibMath|LibTable|LibString|LibCoroutine), WithStdout(io.Discard),
+			WithInstructionLimit(fuzzLimit), WithMaxStringSize(fuzzMaxString))
+		vm.G.SetNumber("N", 2)
+		vm.RunClosure(c)
+		vm.Close()
+	})
+}
+
+// fuzzEdit encodes one FuzzExecute edit.
+func fuzzEdit(fn, kind uint8, index, word uint32) []byte {
+	b := []byte{fn, kind, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(b[2:], index)
+	binary.LittleEndian.PutUint32(b[6:], word)
+	return b
+}
+
+// fuzzConstant makes a constant of any type a chunk may hold from word.
+func fuzzConstant(word uint32) Value {
+	switch word & 3 {
+	case 0:
+		return Value{}
+	case 1:
+		return Value{Type: BOOLEAN, Val: word>>2&1 != 0}
+	case 2:
+		return Value{Type: NUMBER, Num: Number(math.Float32frombits(word))}
+	}
+	return Value{Type: STRING, Val: strconv.Itoa(int(word >> 2))}
+}
+
+// TestReadLuaCTruncated checks that every proper prefix of a chunk is
+// rejected as truncated.
+func TestReadLuaCTruncated(t *testing.T) {
+	data, err := os.ReadFile("test.luac")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for l1 := 12; l1 < len(data); l1++ {
+		if _, err := ReadLuaC(bytes.NewReader(data[:l1])); !errors.Is(err, TRUNCATED) {
+			t.Fatalf("prefix of %d bytes: got %v, want %v", l1, err, TRUNCATED)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	paths, _ := filepath.Glob("testdata/*/*.luac")
+	for _, path := range append(paths, "test.luac") {
+		if err := loadFixture(t, path).Function.verify(); err != nil {
+			t.Error(path, ": ", err)
+		}
+	}
+
+	// main: LOADK 0 0; <patched>; RETURN 0 1
+	for _, tc := range []struct {
+		name string
+		raw  uint32
+	}{
+		{"register out of range", 0x00000000 | 9<<6 | 0<<23},          // MOVE 9 0
+		{"constant out of range", 0x00000001 | 0<<6 | 5<<14},          // LOADK 0 5
+		{"upvalue out of range", 0x00000004 | 0<<6 | 0<<23},           // GETUPVAL 0 0
+		{"jump out of range", 0x00000016 | uint32(131071+5)<<14},      // JMP 5
+		{"test without jump", 0x0000001a | 0<<6 | 0<<14},              // TEST 0 0
+		{"open call without consumer", 0x0000001c | 0<<6 | 1<<23},     // CALL 0 1 0
+		{"closure out of range", 0x00000024 | 0<<6 | 0<<14},           // CLOSURE 0 0
+		{"vararg outside vararg function", 0x00000025 | 0<<6 | 2<<23}, // VARARG 0 2
+		{"invalid opcode", 0x0000003f},
+	} {
+		p := &FunctionPrototype{
+			Instructions: []Instr{
+				decodeInstruction(0x00000001),
+				decodeInstruction(Instruction(tc.raw)),
+				decodeInstruction(0x0080001e),
+			},
+			Constants:    []Value{{Type: NUMBER, Num: 1}},
+			MaxStackSize: 2,
+		}
+		if err := p.verify(); !errors.Is(err, BADCODE) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, BADCODE)
+		}
+	}
+}
+
+func TestInstructionLimit(t *testing.T) {
+	c := loadFixture(t, "testdata/bench/fib.luac")
+	vm := NewVM(WithInstructionLimit(1000))
+	vm.G.SetNumber("N", 20)
+	err := vm.RunClosure(c)
+	if err == nil || err.Error() != "instruction limit exceeded" {
+		t.Fatal("got ", err, ", want instruction limit exceeded")
+	}
+	if err := vm.RunClosure(c); err == nil {
+		t.Fatal("limit reset by a second run")
+	}
+
+	// Library functions that loop count their steps, so a single call from
+	// Go, which runs no instructions, still exhausts the limit.
+	long := strings.Repeat("a", 5000)
+	seq := NewTable()
+	for l1 := 1; l1 <= 2000; l1++ {
+		seq.SetInt(l1, NewNumber(float64(-l1)))
+	}
+	for _, test := range []struct {
+		lib, fname string
+		params     []*Value
+	}{
+		{"string", "find", values(long, "a-b")},
+		{"string", "gsub", values(long, "%w", "%0%0")},
+		{"table", "sort", []*Value{{Type: TABLE, Val: seq}}},
+		{"table", "concat", []*Value{{Type: TABLE, Val: seq}}},
+		{"table", "insert", []*Value{{Type: TABLE, Val: seq}, NewNumber(1), NewNumber(0)}},
+	} {
+		vm := NewVM(WithInstructionLimit(1000))
+		lib := vm.G.Get(str(test.lib)).Val.(*Table)
+		_, err := vm.PCall(lib.Get(str(test.fname)), test.params)
+		if err == nil || err.Error() != "instruction limit exceeded" {
+			t.Errorf("%s.%s: got %v, want instruction limit exceeded", test.lib, test.fname, err)
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package LuaVM
+
+import (
+	"runtime"
+	"strings"
+	"weak"
+)
+
+// Memory itself is left to Go's garbage collector. What the VM collects is
+// the entries of weak tables: Collect marks everything reachable from the
+// globals and the running frames, then clears every weak table entry whose
+// weak key or value is an object that was not marked.
+//
+// Objects registered by SetMetatable or NewUserData with a __gc metamethod
+// are found the same way: once a collection finds one unreachable, its __gc
+// is called on the VM's own goroutine at the end of Collect, and it is
+// forgotten, so each object is finalised at most once. Besides running
+// when collectgarbage asks, a collection runs once the number awaiting
+// finalisation has doubled since the last one, so that they cannot pile up
+// in a script that never asks. Registering an object only notes that one
+// is due: it runs at the next NEWTABLE or CLOSURE, where the reference
+// implementation checks its debt too, since running finalisers from inside
+// SetMetatable or NewUserData would call back into Lua under Go code that
+// does not expect it.
+//
+// Values held only in Go variables are invisible to the mark phase, so a
+// GOFUNC must not rely on a weak table keeping, or a finaliser not yet
+// running on, an object it has not stored somewhere reachable from Lua.
+
+type collector struct {
+	marked map[interface{}]bool
+	gray   []*Value
+	weak   []*Table
+}
+
+// Collect runs a full collection cycle, as collectgarbage("collect") does.
+func (v *VM) Collect() {
+	v.collect()
+}
+
+// collect runs a full collection cycle and returns how many objects it
+// marked, which collectgarbage charges against the instruction limit.
+func (v *VM) collect() int {
+	c := &collector{marked: make(map[interface{}]bool)}
+	c.markTable(v.G)
+	c.markTable(v.loaded)
+	c.markTable(v.Registry)
+	c.markFrames(v.S, v.FrameStack)
+	for co := v.current; co != nil; co = co.parent {
+		c.markFrames(co.resumerS, co.resumerFrameStack)
+	}
+	for p := range v.coroutines {
+		if co := p.Value(); co != nil {
+			c.mark(&Value{Type: THREAD, Val: co})
+		}
+	}
+	c.propagate()
+
+	// Weak values referring to objects about to be finalised are cleared
+	// before the finalisers run; the objects are then resurrected so
+	// that the finalisers can use them.
+	var pending []*Value
+	live := v.finalizers[:0]
+	for _, obj := range v.finalizers {
+		if c.marked[obj.Val] {
+			live = append(live, obj)
+		} else {
+			pending = append(pending, obj)
+			delete(v.finalizerSet, obj.Val)
+		}
+	}
+	v.finalizers = live
+	for _, t := range c.weak {
+		c.sweep(t, false, true)
+	}
+	for _, obj := range pending {
+		c.mark(obj)
+	}
+	c.propagate()
+	for _, t := range c.weak {
+		c.sweep(t, true, true)
+	}
+	v.finalize(pending)
+	return len(c.marked)
+}
+
+func (v *VM) registerFinalizer(obj *Value) {
+	if v.finalizerSet[obj.Val] {
+		return
+	}
+	v.finalizerSet[obj.Val] = true
+	v.finalizers = append(v.finalizers, obj.Copy())
+	if len(v.finalizers) >= v.finalizerCollect {
+		v.collectDue = true
+	}
+}
+
+// checkGC runs the collection registering finalisers has made due, if any.
+// Instructions that allocate call it once they are done with the frame.
+func (v *VM) checkGC() {
+	if !v.collectDue {
+		return
+	}
+	v.collectDue = false
+	v.Collect()
+	v.finalizerCollect = max(minFinalizerCollect, 2*len(v.finalizers))
+}
+
+// finalize calls the __gc metamethods of objs, most recently registered
+// first. Errors raised by a finaliser are discarded.
+func (v *VM) finalize(objs []*Value) {
+	for l1 := len(objs) - 1; l1 >= 0; l1-- {
+		if m := v.getMetamethod(objs[l1], "__gc"); m != nil {
+			v.PCall(m, []*Value{objs[l1]})
+		}
+	}
+}
+
+// Close runs the finalisers of every object still awaiting one and stops
+// the goroutines of suspended coroutines. The VM should not be used
+// afterwards.
+func (v *VM) Close() {
+	pending := v.finalizers
+	v.finalizers = nil
+	v.finalizerSet = make(map[interface{}]bool)
+	v.finalize(pending)
+	for p := range v.coroutines {
+		if co := p.Value(); co != nil {
+			co.close()
+		}
+	}
+	v.coroutines = make(map[weak.Pointer[Coroutine]]bool)
+}
+
+func (c *collector) mark(val *Value) {
+	if val == nil || !collectable(val) || c.marked[val.Val] {
+		return
+	}
+	c.marked[val.Val] = true
+	c.gray = append(c.gray, val)
+}
+
+func (c *collector) markTable(t *Table) {
+	if t != nil {
+		c.mark(&Value{Type: TABLE, Val: t})
+	}
+}
+
+func (c *collector) markFrames(s *Stackframe, frameStack []*Stackframe) {
+	c.markFrame(s)
+	for _, f := range frameStack {
+		c.markFrame(f)
+	}
+}
+
+func (c *collector) markFrame(s *Stackframe) {
+	if s == nil {
+		return
+	}
+	for l1 := range s.Regs {
+		c.mark(&s.Regs[l1])
+	}
+	for l1 := range s.Varargs {
+		c.mark(&s.Varargs[l1])
+	}
+	c.mark(&Value{Type: CLOSURE, Val: s.Closure})
+}
+
+func (c *collector) propagate() {
+	for len(c.gray) > 0 {
+		val := c.gray[len(c.gray)-1]
+		c.gray = c.gray[:len(c.gray)-1]
+		switch o := val.Val.(type) {
+		case *Table:
+			c.traverseTable(o)
+		case *Closure:
+			for _, u := range o.Upvalues {
+				c.mark(u.v)
+			}
+		case *UserData:
+			c.markTable(o.Metatable)
+		case *Coroutine:
+			c.mark(o.fn)
+			c.markFrames(o.s, o.frameStack)
+			c.markFrames(o.resumerS, o.resumerFrameStack)
+		}
+	}
+}
+
+func (c *collector) traverseTable(t *Table) {
+	c.markTable(t.Metatable)
+	weakKeys, weakValues := weakMode(t)
+	if weakKeys || weakValues {
+		c.weak = append(c.weak, t)
+	}
+	if !weakValues {
+		for l1 := range t.Array {
+			c.mark(&t.Array[l1])
+		}
+	}
+	for l1 := range t.Entries {
+		e := &t.Entries[l1]
+		if e.Val.Type == NIL {
+			continue
+		}
+		if !weakKeys {
+			c.mark(&e.Key)
+		}
+		if !weakValues {
+			c.mark(&e.Val)
+		}
+	}
+}
+
+// sweep clears the entries of weak table t that refer to unmarked objects
+// through a weak key, if keys is set, or a weak value, if values is set.
+func (c *collector) sweep(t *Table, keys bool, values bool) {
+	weakKeys, weakValues := weakMode(t)
+	weakKeys = weakKeys && keys
+	weakValues = weakValues && values
+	if weakValues {
+		for l1 := range t.Array {
+			if c.dead(&t.Array[l1]) {
+				t.Array[l1] = Value{}
+			}
+		}
+	}
+	for l1 := range t.Entries {
+		e := &t.Entries[l1]
+		if (weakKeys && c.dead(&e.Key)) || (weakValues && c.dead(&e.Val)) {
+			t.set(e.Key, Value{})
+		}
+	}
+}
+
+func (c *collector) dead(val *Value) bool {
+	return val != nil && collectable(val) && !c.marked[val.Val]
+}
+
+// collectable reports whether val is an object that can be removed from a
+// weak table. Strings, like numbers and booleans, are values and never are.
+func collectable(val *Value) bool {
+	switch val.Type {
+	case TABLE, CLOSURE, THREAD, USERDATA:
+		return val.Val != nil
+	}
+	return false
+}
+
+func weakMode(t *Table) (keys bool, values bool) {
+	if t.Metatable == nil {
+		return false, false
+	}
+	mode := t.Metatable.Get(Value{Type: STRING, Val: "__mode"})
+	if mode.Type != STRING {
+		return false, false
+	}
+	return strings.Contains(mode.Val.(string), "k"), strings.Contains(mode.Val.(string), "v")
+}
+
+func base_collectgarbage(params []*Value, v *VM) []*Value {
+	switch opt := v.optString(params, 1, "collectgarbage", "collect"); opt {
+	case "collect":
+		v.charge(v.collect())
+		return []*Value{NewNumber(0)}
+	case "count":
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		return []*Value{NewNumber(float64(m.HeapAlloc) / 1024)}
+	case "step":
+		v.charge(v.collect())
+		return []*Value{NewBool(true)}
+	case "stop", "restart", "setpause", "setstepmul":
+		return []*Value{NewNumber(0)}
+	default:
+		v.argError(1, "collectgarbage", "invalid option '"+opt+"'")
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package LuaVM
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestWeakTables(t *testing.T) {
+	for _, mode := range []string{"k", "v", "kv"} {
+		vm := NewVM()
+		cache := NewTable()
+		mt := NewTable()
+		mt.SetString("__mode", mode)
+		cache.Metatable = mt
+		vm.G.SetTable("cache", cache)
+
+		kept := NewTable()
+		vm.G.SetTable("kept", kept)
+		keptVal := &Value{Type: TABLE, Val: kept}
+		droppedKey := Value{Type: TABLE, Val: NewTable()}
+		cache.Set(*keptVal, keptVal)
+		cache.Set(droppedKey, NewBool(true))
+		cache.Set(Value{Type: STRING, Val: "value"}, &Value{Type: TABLE, Val: NewTable()})
+		cache.SetInt(1, &Value{Type: TABLE, Val: NewTable()})
+		cache.SetString("name", "strings are never collected")
+
+		vm.Call(vm.G.Get(Value{Type: STRING, Val: "collectgarbage"}), []*Value{NewString("collect")})
+
+		weakKeys, weakValues := strings.Contains(mode, "k"), strings.Contains(mode, "v")
+		if cache.Get(*keptVal).Type == NIL {
+			t.Errorf("__mode=%q: collected an entry that is still reachable", mode)
+		}
+		if cache.Get(Value{Type: STRING, Val: "name"}).Type == NIL {
+			t.Errorf("__mode=%q: collected a string value", mode)
+		}
+		if got := cache.Get(droppedKey).Type == NIL; got != weakKeys {
+			t.Errorf("__mode=%q: entry with an unreachable key cleared = %v", mode, got)
+		}
+		if got := cache.Get(Value{Type: STRING, Val: "value"}).Type == NIL; got != weakValues {
+			t.Errorf("__mode=%q: entry with an unreachable value cleared = %v", mode, got)
+		}
+		if got := cache.GetInt(1).Type == NIL; got != weakValues {
+			t.Errorf("__mode=%q: array entry with an unreachable value cleared = %v", mode, got)
+		}
+	}
+}
+
+func TestFinalizers(t *testing.T) {
+	vm := NewVM()
+	var finalized []string
+	mt := NewTable()
+	mt.SetFunc("__gc", func(params []*Value, v *VM) []*Value {
+		name := params[0].Val.(*Table).Get(Value{Type: STRING, Val: "name"})
+		finalized = append(finalized, name.Val.(string))
+		return nil
+	})
+	object := func(name string) *Value {
+		o := NewTable()
+		o.SetString("name", name)
+		val := &Value{Type: TABLE, Val: o}
+		vm.SetMetatable(val, mt)
+		return val
+	}
+	vm.G.Set(Value{Type: STRING, Val: "kept"}, object("kept"))
+	object("dropped")
+
+	vm.Collect()
+	if len(finalized) != 1 || finalized[0] != "dropped" {
+		t.Fatal("finalised ", finalized, " after the first collection")
+	}
+	vm.Collect()
+	if len(finalized) != 1 {
+		t.Fatal("finalised ", finalized, " after the second collection")
+	}
+	vm.Close()
+	if len(finalized) != 2 || finalized[1] != "kept" {
+		t.Fatal("finalised ", finalized, " after Close")
+	}
+}
+
+func TestFinalizersRunWithoutCollect(t *testing.T) {
+	vm := NewVM()
+	finalized := 0
+	mt := NewTable()
+	mt.SetFunc("__gc", func(params []*Value, v *VM) []*Value {
+		finalized++
+		return nil
+	})
+	kept := &Value{Type: TABLE, Val: NewTable()}
+	vm.G.Set(Value{Type: STRING, Val: "kept"}, kept)
+	vm.SetMetatable(kept, mt)
+	for l1 := 0; l1 < 10000; l1++ {
+		vm.SetMetatable(&Value{Type: TABLE, Val: NewTable()}, mt)
+		// Registering an object again does not add it twice.
+		vm.SetMetatable(kept, mt)
+	}
+	// Registering never runs finalisers under the Go code doing it.
+	if finalized != 0 {
+		t.Errorf("finalised %d objects while registering them", finalized)
+	}
+	// The next allocation in Lua does.
+	p := &FunctionPrototype{
+		Instructions: []Instr{
+			{Opcode: OP_NEWTABLE, A: 0},
+			{Opcode: OP_RETURN, A: 0, B: 1},
+		},
+		MaxStackSize: 1,
+	}
+	if _, err := vm.PCall(&Value{Type: CLOSURE, Val: &Closure{Function: p}}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if finalized != 10000 {
+		t.Errorf("finalised %d of 10000 dropped objects without a collection being asked for", finalized)
+	}
+	if len(vm.finalizers) != 1 {
+		t.Errorf("%d objects await finalisation", len(vm.finalizers))
+	}
+	vm.Close()
+	if finalized != 10001 {
+		t.Errorf("finalised %d objects after Close, want 10001", finalized)
+	}
+}
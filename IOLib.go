@@ -0,0 +1,82 @@
+package LuaVM
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+)
+
+func openIO(v *VM) *Table {
+	t := NewTable()
+	t.SetFunc("write", io_write)
+	t.SetFunc("read", io_read)
+	return t
+}
+
+func io_write(params []*Value, v *VM) []*Value {
+	for k := range params {
+		fmt.Fprint(v.Stdout, v.checkString(params, k+1, "write"))
+	}
+	return nil
+}
+
+func io_read(params []*Value, v *VM) []*Value {
+	if v.stdin == nil {
+		v.stdin = bufio.NewReader(v.Stdin)
+	}
+	if len(params) == 0 {
+		return []*Value{readLine(v.stdin)}
+	}
+	ret := make([]*Value, 0, len(params))
+	for k, p := range params {
+		var r *Value
+		if p.Type == NUMBER {
+			n := math.Trunc(float64(p.Num))
+			v.checkStringSize(n)
+			r = readCount(v.stdin, int(max(n, 0)))
+		} else {
+			switch f := v.checkString(params, k+1, "read"); {
+			case strings.HasPrefix(f, "*l"):
+				r = readLine(v.stdin)
+			case strings.HasPrefix(f, "*n"):
+				var n float64
+				if _, err := fmt.Fscan(v.stdin, &n); err != nil {
+					r = NewNil()
+				} else {
+					r = NewNumber(n)
+				}
+			case strings.HasPrefix(f, "*a"):
+				data, _ := io.ReadAll(v.stdin)
+				r = NewString(string(data))
+			default:
+				v.argError(k+1, "read", "invalid format")
+			}
+		}
+		ret = append(ret, r)
+		if r.Type == NIL {
+			break
+		}
+	}
+	return ret
+}
+
+func readLine(r *bufio.Reader) *Value {
+	line, err := r.ReadString('\n')
+	if err != nil && line == "" {
+		return NewNil()
+	}
+	return NewString(strings.TrimSuffix(line, "\n"))
+}
+
+// readCount reads up to n bytes. It reads them as they arrive rather than
+// into a buffer of n, so that a large n costs no more than the input.
+func readCount(r *bufio.Reader, n int) *Value {
+	var b strings.Builder
+	c, _ := io.CopyN(&b, r, int64(n))
+	if c == 0 && n > 0 {
+		return NewNil()
+	}
+	return NewString(b.String())
+}
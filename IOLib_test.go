@@ -0,0 +1,31 @@
+package LuaVM
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestIORead(t *testing.T) {
+	vm := NewVM(WithMaxStringSize(1000))
+	vm.Stdin = strings.NewReader("first line\n12.5 rest")
+	read := vm.G.Get(str("io")).Val.(*Table).Get(str("read"))
+	for _, test := range []struct {
+		format *Value
+		want   *Value
+	}{
+		{NewString("*l"), NewString("first line")},
+		{NewString("*n"), NewNumber(12.5)},
+		{NewNumber(3), NewString(" re")},
+		{NewNumber(900), NewString("st")},
+		{NewNumber(1), NewNil()},
+		{NewString("*l"), NewNil()},
+	} {
+		r, err := vm.PCall(read, []*Value{test.format})
+		if err != nil || !rawEquals(r[0], test.want) {
+			t.Errorf("io.read(%v) = %v, %v, want %v", test.format, r, err, test.want)
+		}
+	}
+	if _, err := vm.PCall(read, []*Value{NewNumber(1 << 40)}); err == nil || err.Error() != "resulting string too large" {
+		t.Errorf("io.read(2^40): got %v", err)
+	}
+}
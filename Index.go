@@ -0,0 +1,60 @@
+package LuaVM
+
+// maxTagLoop bounds __index and __newindex chains, as in the reference
+// implementation, so that a cycle of metatables raises an error instead of
+// hanging.
+const maxTagLoop = 100
+
+// getTable implements obj[key], following the __index metamethod.
+func (v *VM) getTable(obj *Value, key *Value) Value {
+	for loop := 0; loop < maxTagLoop; loop++ {
+		var h *Value
+		if obj.Type == TABLE {
+			res := obj.Val.(*Table).get(*key)
+			if res.Type != NIL {
+				return res
+			}
+			if h = v.getMetamethod(obj, "__index"); h == nil {
+				return res
+			}
+		} else if h = v.getMetamethod(obj, "__index"); h == nil {
+			v.Error("attempt to index a %s value", obj.TypeName())
+		}
+		if h.Type == CLOSURE || h.Type == GOFUNCTION {
+			r := v.Call(h, []*Value{obj, key})
+			if len(r) == 0 {
+				return Value{}
+			}
+			return deref(r[0])
+		}
+		obj = h
+	}
+	v.Error("loop in gettable")
+	return Value{}
+}
+
+// setTable implements obj[key] = val, following the __newindex metamethod.
+func (v *VM) setTable(obj *Value, key *Value, val Value) {
+	for loop := 0; loop < maxTagLoop; loop++ {
+		var h *Value
+		if obj.Type == TABLE {
+			t := obj.Val.(*Table)
+			if t.get(*key).Type != NIL {
+				t.set(*key, val)
+				return
+			}
+			if h = v.getMetamethod(obj, "__newindex"); h == nil {
+				t.set(*key, val)
+				return
+			}
+		} else if h = v.getMetamethod(obj, "__newindex"); h == nil {
+			v.Error("attempt to index a %s value", obj.TypeName())
+		}
+		if h.Type == CLOSURE || h.Type == GOFUNCTION {
+			v.Call(h, []*Value{obj, key, &val})
+			return
+		}
+		obj = h
+	}
+	v.Error("loop in settable")
+}
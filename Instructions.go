@@ -1,6 +1,9 @@
 package LuaVM
 
-import "math"
+import (
+	"math"
+	"strings"
+)
 
 type OPCODE int
 
@@ -45,39 +48,45 @@ const (
 	OP_VARARG
 )
 
+// Stackframe is a call to a Lua function. Its registers are a window on the
+// VM's value stack starting at Base, and the extra arguments of a vararg
+// function sit just below them.
 type Stackframe struct {
-	Regs       []*Value
-	Params     []*Value
-	Closure    *Closure
-	PC         int64
-	ReturnFunc func(*Stackframe, *VM, []*Value)
+	Regs    []Value
+	Varargs []Value
+	Base    int
+	Closure *Closure
+	PC      int64
+
+	// The stack slot that held the function, where its results go, and
+	// how many results the caller wants, or -1 for all of them.
+	fn       int
+	nresults int
 }
 
 type Closure struct {
-	Upvalues []*Value
+	Upvalues []*Upvalue
 	Function *FunctionPrototype
 }
 
 func Op_Move(i *Instr, s *Stackframe, v *VM) {
-	s.Regs[i.A] = s.Regs[i.B].Copy()
+	s.Regs[i.A] = s.Regs[i.B]
 }
 
 func Op_LoadNil(i *Instr, s *Stackframe, v *VM) {
 	for l1 := int32(i.A); l1 <= i.B; l1++ {
-		s.Regs[l1] = &Value{
-			Type: NIL,
-		}
+		s.Regs[l1] = Value{}
 	}
 }
 
 func Op_LoadK(i *Instr, s *Stackframe, v *VM) {
-	s.Regs[i.A] = s.Closure.Function.Constants[i.B].Copy()
+	s.Regs[i.A] = s.Closure.Function.Constants[i.B]
 }
 
 func Op_LoadBool(i *Instr, s *Stackframe, v *VM) {
-	s.Regs[i.A] = &Value{
+	s.Regs[i.A] = Value{
 		Type: BOOLEAN,
-		Val:  Integer(i.B),
+		Val:  i.B != 0,
 	}
 	if i.C != 0 {
 		s.PC++
@@ -88,22 +97,22 @@ func Op_GetGlobal(i *Instr, s *Stackframe, v *VM) {
 	if s.Closure.Function.Constants[i.B].Type != STRING {
 		panic("Constant type is not string")
 	}
-	s.Regs[i.A] = v.G.Get(s.Closure.Function.Constants[i.B]).Copy()
+	s.Regs[i.A] = v.getTable(&Value{Type: TABLE, Val: v.G}, &s.Closure.Function.Constants[i.B])
 }
 
 func Op_SetGlobal(i *Instr, s *Stackframe, v *VM) {
 	if s.Closure.Function.Constants[i.B].Type != STRING {
 		panic("Constant type is not string")
 	}
-	v.G.Set(s.Closure.Function.Constants[i.B], s.Regs[i.A].Copy())
+	v.setTable(&Value{Type: TABLE, Val: v.G}, &s.Closure.Function.Constants[i.B], s.Regs[i.A])
 }
 
 func Op_GetUpVal(i *Instr, s *Stackframe, v *VM) {
-	s.Regs[i.A] = s.Closure.Upvalues[i.B].Copy()
+	s.Regs[i.A] = *s.Closure.Upvalues[i.B].v
 }
 
 func Op_SetUpVal(i *Instr, s *Stackframe, v *VM) {
-	s.Closure.Upvalues[i.B] = s.Regs[i.A].Copy()
+	*s.Closure.Upvalues[i.B].v = s.Regs[i.A]
 }
 
 func Op_GetTable(i *Instr, s *Stackframe, v *VM) {
@@ -111,13 +120,9 @@ func Op_GetTable(i *Instr, s *Stackframe, v *VM) {
 	if i.C&256 == 256 {
 		key = &s.Closure.Function.Constants[i.C&255]
 	} else {
-		key = s.Regs[i.C]
-	}
-	if s.Regs[i.B].Type != TABLE {
-		panic("Value is not table")
+		key = &s.Regs[i.C]
 	}
-	val := s.Regs[i.B].Val.(*Table).Get(*key)
-	s.Regs[i.A] = val.Copy()
+	s.Regs[i.A] = v.getTable(&s.Regs[i.B], key)
 }
 
 func Op_SetTable(i *Instr, s *Stackframe, v *VM) {
@@ -125,18 +130,15 @@ func Op_SetTable(i *Instr, s *Stackframe, v *VM) {
 	if i.B&256 == 256 {
 		key = &s.Closure.Function.Constants[i.B&255]
 	} else {
-		key = s.Regs[i.B]
+		key = &s.Regs[i.B]
 	}
 	var val *Value
 	if i.C&256 == 256 {
 		val = &s.Closure.Function.Constants[i.C&255]
 	} else {
-		val = s.Regs[i.C]
+		val = &s.Regs[i.C]
 	}
-	if s.Regs[i.A].Type != TABLE {
-		panic("Value is not table")
-	}
-	s.Regs[i.A].Val.(*Table).Set(*key, val.Copy())
+	v.setTable(&s.Regs[i.A], key, *val)
 }
 
 func Op_Add(i *Instr, s *Stackframe, v *VM) {
@@ -144,21 +146,15 @@ func Op_Add(i *Instr, s *Stackframe, v *VM) {
 	if i.B&256 == 256 {
 		bval = &s.Closure.Function.Constants[i.B&255]
 	} else {
-		bval = s.Regs[i.B]
+		bval = &s.Regs[i.B]
 	}
 	var cval *Value
 	if i.C&256 == 256 {
 		cval = &s.Closure.Function.Constants[i.C&255]
 	} else {
-		cval = s.Regs[i.C]
-	}
-	if bval.Type != NUMBER || cval.Type != NUMBER {
-		panic("Trying to add non-numbers")
-	}
-	s.Regs[i.A] = &Value{
-		Type: NUMBER,
-		Val:  bval.Val.(Number) + cval.Val.(Number),
+		cval = &s.Regs[i.C]
 	}
+	s.Regs[i.A] = v.arith(OP_ADD, bval, cval)
 }
 
 func Op_Sub(i *Instr, s *Stackframe, v *VM) {
@@ -166,21 +162,15 @@ func Op_Sub(i *Instr, s *Stackframe, v *VM) {
 	if i.B&256 == 256 {
 		bval = &s.Closure.Function.Constants[i.B&255]
 	} else {
-		bval = s.Regs[i.B]
+		bval = &s.Regs[i.B]
 	}
 	var cval *Value
 	if i.C&256 == 256 {
 		cval = &s.Closure.Function.Constants[i.C&255]
 	} else {
-		cval = s.Regs[i.C]
-	}
-	if bval.Type != NUMBER || cval.Type != NUMBER {
-		panic("Trying to sub non-numbers")
-	}
-	s.Regs[i.A] = &Value{
-		Type: NUMBER,
-		Val:  bval.Val.(Number) - cval.Val.(Number),
+		cval = &s.Regs[i.C]
 	}
+	s.Regs[i.A] = v.arith(OP_SUB, bval, cval)
 }
 
 func Op_Mul(i *Instr, s *Stackframe, v *VM) {
@@ -188,21 +178,15 @@ func Op_Mul(i *Instr, s *Stackframe, v *VM) {
 	if i.B&256 == 256 {
 		bval = &s.Closure.Function.Constants[i.B&255]
 	} else {
-		bval = s.Regs[i.B]
+		bval = &s.Regs[i.B]
 	}
 	var cval *Value
 	if i.C&256 == 256 {
 		cval = &s.Closure.Function.Constants[i.C&255]
 	} else {
-		cval = s.Regs[i.C]
-	}
-	if bval.Type != NUMBER || cval.Type != NUMBER {
-		panic("Trying to mul non-numbers")
-	}
-	s.Regs[i.A] = &Value{
-		Type: NUMBER,
-		Val:  bval.Val.(Number) * cval.Val.(Number),
+		cval = &s.Regs[i.C]
 	}
+	s.Regs[i.A] = v.arith(OP_MUL, bval, cval)
 }
 
 func Op_Div(i *Instr, s *Stackframe, v *VM) {
@@ -210,21 +194,15 @@ func Op_Div(i *Instr, s *Stackframe, v *VM) {
 	if i.B&256 == 256 {
 		bval = &s.Closure.Function.Constants[i.B&255]
 	} else {
-		bval = s.Regs[i.B]
+		bval = &s.Regs[i.B]
 	}
 	var cval *Value
 	if i.C&256 == 256 {
 		cval = &s.Closure.Function.Constants[i.C&255]
 	} else {
-		cval = s.Regs[i.C]
-	}
-	if bval.Type != NUMBER || cval.Type != NUMBER {
-		panic("Trying to div non-numbers")
-	}
-	s.Regs[i.A] = &Value{
-		Type: NUMBER,
-		Val:  bval.Val.(Number) / cval.Val.(Number),
+		cval = &s.Regs[i.C]
 	}
+	s.Regs[i.A] = v.arith(OP_DIV, bval, cval)
 }
 
 func Op_Mod(i *Instr, s *Stackframe, v *VM) {
@@ -232,21 +210,15 @@ func Op_Mod(i *Instr, s *Stackframe, v *VM) {
 	if i.B&256 == 256 {
 		bval = &s.Closure.Function.Constants[i.B&255]
 	} else {
-		bval = s.Regs[i.B]
+		bval = &s.Regs[i.B]
 	}
 	var cval *Value
 	if i.C&256 == 256 {
 		cval = &s.Closure.Function.Constants[i.C&255]
 	} else {
-		cval = s.Regs[i.C]
-	}
-	if bval.Type != NUMBER || cval.Type != NUMBER {
-		panic("Trying to add non-numbers")
-	}
-	s.Regs[i.A] = &Value{
-		Type: NUMBER,
-		Val:  Number(math.Mod(bval.Val.(float64), cval.Val.(float64))),
+		cval = &s.Regs[i.C]
 	}
+	s.Regs[i.A] = v.arith(OP_MOD, bval, cval)
 }
 
 func Op_Pow(i *Instr, s *Stackframe, v *VM) {
@@ -254,77 +226,87 @@ func Op_Pow(i *Instr, s *Stackframe, v *VM) {
 	if i.B&256 == 256 {
 		bval = &s.Closure.Function.Constants[i.B&255]
 	} else {
-		bval = s.Regs[i.B]
+		bval = &s.Regs[i.B]
 	}
 	var cval *Value
 	if i.C&256 == 256 {
 		cval = &s.Closure.Function.Constants[i.C&255]
 	} else {
-		cval = s.Regs[i.C]
-	}
-	if bval.Type != NUMBER || cval.Type != NUMBER {
-		panic("Trying to add non-numbers")
-	}
-	s.Regs[i.A] = &Value{
-		Type: NUMBER,
-		Val:  Number(math.Pow(bval.Val.(float64), cval.Val.(float64))),
+		cval = &s.Regs[i.C]
 	}
+	s.Regs[i.A] = v.arith(OP_POW, bval, cval)
 }
 
 func Op_Unm(i *Instr, s *Stackframe, v *VM) {
-	if s.Regs[i.B].Type != NUMBER {
-		panic("Trying to unm non-number")
-	}
-	s.Regs[i.A] = &Value{
-		Type: NUMBER,
-		Val:  -(s.Regs[i.B].Val.(Number)),
-	}
+	s.Regs[i.A] = v.arith(OP_UNM, &s.Regs[i.B], &s.Regs[i.B])
+}
+
+// arith applies the arithmetic opcode op to b and c, converting numeric
+// strings to numbers as Lua does. OP_UNM takes its operand as both b and c.
+func (v *VM) arith(op OPCODE, b *Value, c *Value) Value {
+	x, okb := toNumber(b)
+	y, okc := toNumber(c)
+	if !okb || !okc {
+		bad := b
+		if okb {
+			bad = c
+		}
+		v.Error("attempt to perform arithmetic on a %s value", bad.TypeName())
+	}
+	var n Number
+	switch op {
+	case OP_ADD:
+		n = x + y
+	case OP_SUB:
+		n = x - y
+	case OP_MUL:
+		n = x * y
+	case OP_DIV:
+		n = x / y
+	case OP_MOD:
+		n = x - Number(math.Floor(float64(x/y)))*y
+	case OP_POW:
+		n = Number(math.Pow(float64(x), float64(y)))
+	case OP_UNM:
+		n = -x
+	}
+	return Value{Type: NUMBER, Num: n}
 }
 
 func Op_Not(i *Instr, s *Stackframe, v *VM) {
-	bval := s.Regs[i.B]
-	if bval.Type == NIL {
-		s.Regs[i.A] = &Value{
-			Type: BOOLEAN,
-			Val:  Integer(1),
-		}
-	}
-	if bval.Type == BOOLEAN {
-		val := 1
-		if bval.Val != 0 {
-			val = 0
-		}
-		s.Regs[i.A] = &Value{
-			Type: BOOLEAN,
-			Val:  Integer(val),
-		}
+	s.Regs[i.A] = Value{
+		Type: BOOLEAN,
+		Val:  !truthy(&s.Regs[i.B]),
 	}
-
 }
 
 func Op_Len(i *Instr, s *Stackframe, v *VM) {
 	bval := s.Regs[i.B]
-	var val *Value
-	if bval.Type == TABLE {
-		val = bval.Val.(*Table).Len()
-	}
-	if bval.Type == STRING {
-		val = &Value{Type: NUMBER, Val: Number(len(bval.Val.(string)))}
+	var val Value
+	switch bval.Type {
+	case TABLE:
+		val = Value{Type: NUMBER, Num: Number(bval.Val.(*Table).border())}
+	case STRING:
+		val = Value{Type: NUMBER, Num: Number(len(bval.Val.(string)))}
+	default:
+		v.Error("attempt to get length of a %s value", bval.TypeName())
 	}
 	s.Regs[i.A] = val
 }
 
 func Op_Concat(i *Instr, s *Stackframe, v *VM) {
-	str := ""
+	var b strings.Builder
 	for l1 := int32(i.B); l1 <= int32(i.C); l1++ {
-		if s.Regs[l1].Type != STRING {
-			panic("Attempting to concat non-strings")
+		str, ok := toStr(&s.Regs[l1])
+		if !ok {
+			v.Error("attempt to concatenate a %s value", s.Regs[l1].TypeName())
 		}
-		str = str + s.Regs[l1].Val.(string)
+		b.WriteString(str)
+		v.checkStringSize(float64(b.Len()))
 	}
-	s.Regs[i.A] = &Value{
+	s.Regs[i.A] = Value{
 		Type: STRING,
-		Val:  str,
+		Val:  b.String(),
 	}
 }
 
@@ -333,109 +315,62 @@ func Op_Jmp(i *Instr, s *Stackframe, v *VM) {
 }
 
 func Op_Call(i *Instr, s *Stackframe, v *VM) {
-	function := s.Regs[i.A]
-	var params []*Value
+	fn := s.Base + int(i.A)
+	nargs := int(i.B) - 1
 	if i.B == 0 {
-		params = s.Regs[i.A+1:]
-	} else {
-		params = s.Regs[i.A+1 : i.A+uint8(i.B)]
-	}
-	if i.C == 0 {
-		s.Regs = s.Regs[0:i.A]
-	}
-
-	if function.Type == CLOSURE {
-		v.FrameStack = append(v.FrameStack, v.S)
-		v.S = v.runClosure(function.Val.(*Closure), params, func(rs *Stackframe, rv *VM, rparams []*Value) {
-			for k, val := range rparams {
-				if i.C != 0 && k >= int(i.C-1) {
-					break
-				}
-				if len(s.Regs) <= k+int(i.A) {
-					s.Regs = append(s.Regs, val.Copy())
-				} else {
-					s.Regs[k+int(i.A)] = val.Copy()
-				}
-			}
-		})
-		return
-	}
-	if function.Type == GOFUNCTION {
-		rparams := function.Val.(GOFUNC)(params, v)
-		for k, val := range rparams {
-			if i.C != 0 && k >= int(i.C-1) {
-				break
-			}
-			if len(s.Regs) <= k+int(i.A) {
-				s.Regs = append(s.Regs, val.Copy())
-			} else {
-				s.Regs[k+int(i.A)] = val.Copy()
-			}
-		}
+		nargs = v.top - fn - 1
 	}
+	v.precall(fn, nargs, int(i.C)-1)
 }
 
 func Op_Return(i *Instr, s *Stackframe, v *VM) {
+	v.closeUpvalues(s.Base)
 	if len(v.FrameStack) == 0 {
 		v.S = nil
 		return
 	}
-	v.S = v.FrameStack[len(v.FrameStack)-1]
-	v.FrameStack = v.FrameStack[:len(v.FrameStack)-1]
-	var params []*Value
+	first := s.Base + int(i.A)
+	n := int(i.B) - 1
 	if i.B == 0 {
-		params = s.Regs[i.A:]
-	} else {
-		params = s.Regs[i.A : i.A+uint8(i.B)-1]
-	}
-	if s.ReturnFunc != nil {
-		s.ReturnFunc(v.S, v, params)
+		n = v.top - first
 	}
+	v.poscall(s, first, n)
 }
 
+// Op_TailCall replaces the running frame with the call, so that a chain of
+// tail calls runs in constant space. A Go function is called as by
+// OP_CALL, and the OP_RETURN after it returns its results.
 func Op_TailCall(i *Instr, s *Stackframe, v *VM) {
-	function := s.Regs[i.A]
-	var params []*Value
+	fn := s.Base + int(i.A)
+	nargs := int(i.B) - 1
 	if i.B == 0 {
-		params = s.Regs[i.A+1:]
-		s.Regs = s.Regs[0:i.A]
-	} else {
-		params = s.Regs[i.A+1 : i.A+uint8(i.B)]
-	}
-	if i.C == 0 {
-		s.Regs = s.Regs[0:i.A]
+		nargs = v.top - fn - 1
 	}
-
-	if function.Type == CLOSURE {
-		v.S = v.runClosure(function.Val.(*Closure), params, s.ReturnFunc)
+	if v.stack[fn].Type != CLOSURE || len(v.FrameStack) == 0 {
+		v.precall(fn, nargs, -1)
 		return
 	}
-	if function.Type == GOFUNCTION {
-		rparams := function.Val.(GOFUNC)(params, v)
-		for k, val := range rparams {
-			if i.C != 0 && k >= int(i.C-1) {
-				break
-			}
-			if len(s.Regs) <= k+int(i.A) {
-				s.Regs = append(s.Regs, val.Copy())
-			} else {
-				s.Regs[k+int(i.A)] = val.Copy()
-			}
-		}
-	}
+	v.closeUpvalues(s.Base)
+	copy(v.stack[s.fn:], v.stack[fn:fn+1+nargs])
+	fn, nresults := s.fn, s.nresults
+	v.S = v.FrameStack[len(v.FrameStack)-1]
+	v.FrameStack = v.FrameStack[:len(v.FrameStack)-1]
+	*s = Stackframe{}
+	v.spare = append(v.spare, s)
+	v.precall(fn, nargs, nresults)
 }
 
 func Op_Self(i *Instr, s *Stackframe, v *VM) {
-	s.Regs[i.A+1] = s.Regs[i.B].Copy()
+	obj := s.Regs[i.B]
 	var cval *Value
 	if i.C&256 == 256 {
 		cval = &s.Closure.Function.Constants[i.C&255]
 	} else {
-		cval = s.Regs[i.C]
+		cval = &s.Regs[i.C]
 	}
 
-	val := s.Regs[i.B].Val.(*Table).Get(*cval)
-	s.Regs[i.A] = val.Copy()
+	s.Regs[i.A] = v.getTable(&obj, cval)
+	s.Regs[i.A+1] = obj
 }
 
 func Op_Eq(i *Instr, s *Stackframe, v *VM) {
@@ -443,43 +378,26 @@ func Op_Eq(i *Instr, s *Stackframe, v *VM) {
 	if i.B&256 == 256 {
 		bval = &s.Closure.Function.Constants[i.B&255]
 	} else {
-		bval = s.Regs[i.B]
+		bval = &s.Regs[i.B]
 	}
 	var cval *Value
 	if i.C&256 == 256 {
 		cval = &s.Closure.Function.Constants[i.C&255]
 	} else {
-		cval = s.Regs[i.C]
+		cval = &s.Regs[i.C]
 	}
+	eq(i, s, v, bval, cval)
+}
 
-	if bval.Type != cval.Type {
-		if i.A != 0 {
-			s.PC = s.PC + 1
-		}
-		return
+func eq(i *Instr, s *Stackframe, v *VM, bval *Value, cval *Value) {
+	var equal bool
+	if bval.Type == NUMBER && cval.Type == NUMBER {
+		equal = bval.Num == cval.Num
+	} else {
+		equal = v.equals(bval, cval)
 	}
-	switch bval.Type {
-	case NUMBER:
-		if bval.Val.(Number) != cval.Val.(Number) {
-			if i.A != 0 {
-				s.PC = s.PC + 1
-			}
-			return
-		}
-	case STRING:
-		if bval.Val.(string) != cval.Val.(string) {
-			if i.A != 0 {
-				s.PC = s.PC + 1
-			}
-			return
-		}
-	case BOOLEAN:
-		if bval.Val.(Integer) != cval.Val.(Integer) {
-			if i.A != 0 {
-				s.PC = s.PC + 1
-			}
-			return
-		}
+	if equal != (i.A != 0) {
+		s.PC = s.PC + 1
 	}
 }
 
@@ -488,37 +406,26 @@ func Op_Lt(i *Instr, s *Stackframe, v *VM) {
 	if i.B&256 == 256 {
 		bval = &s.Closure.Function.Constants[i.B&255]
 	} else {
-		bval = s.Regs[i.B]
+		bval = &s.Regs[i.B]
 	}
 	var cval *Value
 	if i.C&256 == 256 {
 		cval = &s.Closure.Function.Constants[i.C&255]
 	} else {
-		cval = s.Regs[i.C]
+		cval = &s.Regs[i.C]
 	}
+	lt(i, s, v, bval, cval)
+}
 
-	if bval.Type != cval.Type {
-		panic("it just don't make sense")
-		return
+func lt(i *Instr, s *Stackframe, v *VM, bval *Value, cval *Value) {
+	var less bool
+	if bval.Type == NUMBER && cval.Type == NUMBER {
+		less = bval.Num < cval.Num
+	} else {
+		less = v.lessThan(bval, cval)
 	}
-	switch bval.Type {
-	case NUMBER:
-		if bval.Val.(Number) >= cval.Val.(Number) {
-			if i.A != 0 {
-				s.PC = s.PC + 1
-			}
-			return
-		}
-	case STRING:
-		if bval.Val.(string) != cval.Val.(string) {
-			panic("it just don't make sense")
-			return
-		}
-	case BOOLEAN:
-		if bval.Val.(Integer) != cval.Val.(Integer) {
-			panic("it just don't make sense")
-			return
-		}
+	if less != (i.A != 0) {
+		s.PC = s.PC + 1
 	}
 }
 
@@ -527,187 +434,152 @@ func Op_Le(i *Instr, s *Stackframe, v *VM) {
 	if i.B&256 == 256 {
 		bval = &s.Closure.Function.Constants[i.B&255]
 	} else {
-		bval = s.Regs[i.B]
+		bval = &s.Regs[i.B]
 	}
 	var cval *Value
 	if i.C&256 == 256 {
 		cval = &s.Closure.Function.Constants[i.C&255]
 	} else {
-		cval = s.Regs[i.C]
+		cval = &s.Regs[i.C]
 	}
+	le(i, s, v, bval, cval)
+}
 
-	if bval.Type != cval.Type {
-		panic("it just don't make sense")
-		return
+func le(i *Instr, s *Stackframe, v *VM, bval *Value, cval *Value) {
+	var lessEqual bool
+	if bval.Type == NUMBER && cval.Type == NUMBER {
+		lessEqual = bval.Num <= cval.Num
+	} else {
+		lessEqual = v.lessEqual(bval, cval)
 	}
-	switch bval.Type {
-	case NUMBER:
-		if bval.Val.(Number) > cval.Val.(Number) {
-			if i.A != 0 {
-				s.PC = s.PC + 1
-			}
-			return
-		}
-	case STRING:
-		panic("it just don't make sense")
-	case BOOLEAN:
-		panic("it just don't make sense")
+	if lessEqual != (i.A != 0) {
+		s.PC = s.PC + 1
 	}
 }
 
+// Op_Test runs the jump that follows it if R(A) is as true as C says, and
+// skips it otherwise.
 func Op_Test(i *Instr, s *Stackframe, v *VM) {
-	val := s.Regs[i.A]
-	switch val.Type {
-	case NIL:
-		if i.C != 0 {
-			s.PC = s.PC + 1
-		}
-	case BOOLEAN:
-		if Integer(i.C) != val.Val.(Integer) {
-			s.PC = s.PC + 1
-		}
-	case NUMBER:
-		boolval := Integer(1)
-		if val.Val.(Number) == 0 {
-			boolval = 0
-		}
-		if Integer(i.C) != boolval {
-			s.PC = s.PC + 1
-		}
-	default:
-		if i.C != 0 {
-			s.PC = s.PC + 1
-		}
+	if truthy(&s.Regs[i.A]) != (i.C != 0) {
+		s.PC = s.PC + 1
 	}
 }
 
+// Op_TestSet is Op_Test on R(B) that also copies R(B) to R(A) when it takes
+// the jump.
 func Op_TestSet(i *Instr, s *Stackframe, v *VM) {
-	val := s.Regs[i.B]
-	switch val.Type {
-	case NIL:
-		if i.C != 0 {
-			s.Regs[i.A] = val.Copy()
-		} else {
-			s.PC = s.PC + 1
-		}
-	case BOOLEAN:
-		if Integer(i.C) == val.Val.(Integer) {
-			s.Regs[i.A] = val.Copy()
-		} else {
-			s.PC = s.PC + 1
-		}
-	case NUMBER:
-		boolval := Integer(1)
-		if val.Val.(Number) == 0 {
-			boolval = 0
-		}
-		if Integer(i.C) == boolval {
-			s.Regs[i.A] = val.Copy()
-		} else {
-			s.PC = s.PC + 1
-		}
-	default:
-		if i.C == 0 {
-			s.Regs[i.A] = val.Copy()
-		} else {
-			s.PC = s.PC + 1
-		}
+	if truthy(&s.Regs[i.B]) != (i.C != 0) {
+		s.PC = s.PC + 1
+		return
 	}
+	s.Regs[i.A] = s.Regs[i.B]
 }
 
+// Op_ForPrep converts the initial value, limit and step of a numeric for
+// loop to numbers, which FORLOOP then relies on, and backs the counter off
+// by one step before jumping to the FORLOOP.
 func Op_ForPrep(i *Instr, s *Stackframe, v *VM) {
-	s.Regs[i.A].Val = s.Regs[i.A].Val.(Number) - s.Regs[i.A+2].Val.(Number)
+	init, ok := toNumber(&s.Regs[i.A])
+	if !ok {
+		v.Error("'for' initial value must be a number")
+	}
+	limit, ok := toNumber(&s.Regs[i.A+1])
+	if !ok {
+		v.Error("'for' limit must be a number")
+	}
+	step, ok := toNumber(&s.Regs[i.A+2])
+	if !ok {
+		v.Error("'for' step must be a number")
+	}
+	s.Regs[i.A] = Value{Type: NUMBER, Num: init - step}
+	s.Regs[i.A+1] = Value{Type: NUMBER, Num: limit}
+	s.Regs[i.A+2] = Value{Type: NUMBER, Num: step}
 	s.PC += int64(i.B)
 }
 
+// Op_ForLoop steps the counter and loops while it has not passed the limit.
+// As in reference Lua, a step that is not positive counts down, so a zero
+// step loops forever unless the limit is above the start, and a NaN
+// anywhere ends the loop.
 func Op_ForLoop(i *Instr, s *Stackframe, v *VM) {
-
-	s.Regs[i.A].Val = s.Regs[i.A].Val.(Number) + s.Regs[i.A+2].Val.(Number)
-
-	dirp := true
-	if s.Regs[i.A+2].Val.(Number) < 0 {
-		dirp = false
-	}
-
-	passed := false
-	if dirp {
-		if s.Regs[i.A].Val.(Number) > s.Regs[i.A+1].Val.(Number) {
-			passed = true
-		}
+	step := s.Regs[i.A+2].Num
+	idx := s.Regs[i.A].Num + step
+	limit := s.Regs[i.A+1].Num
+	var loop bool
+	if 0 < step {
+		loop = idx <= limit
 	} else {
-		if s.Regs[i.A].Val.(Number) < s.Regs[i.A+1].Val.(Number) {
-			passed = true
-		}
+		loop = limit <= idx
 	}
-	if !passed {
-		s.Regs[i.A+3] = s.Regs[i.A].Copy()
+	if loop {
+		s.Regs[i.A] = Value{Type: NUMBER, Num: idx}
+		s.Regs[i.A+3] = s.Regs[i.A]
 		s.PC += int64(i.B)
 	}
 }
 
+// Op_TForLoop calls the iterator R(A) with R(A+1) and R(A+2), leaving C
+// results from R(A+3) on. If the first is not nil, it becomes the new
+// control variable R(A+2) and the OP_JMP after goes back to the loop body;
+// otherwise the loop ends.
 func Op_TForLoop(i *Instr, s *Stackframe, v *VM) {
-	function := s.Regs[i.A]
-	var params []*Value
-	params = s.Regs[i.A+1 : i.A+3]
-
-	if function.Type == CLOSURE {
-		v.FrameStack = append(v.FrameStack, v.S)
-		v.S = v.runClosure(function.Val.(*Closure), params, func(rs *Stackframe, rv *VM, rparams []*Value) {
-			for k, val := range rparams {
-				if i.C != 0 && k >= int(i.C-1) {
-					break
-				}
-				if len(s.Regs) <= k+int(i.A+3) {
-					s.Regs = append(s.Regs, val.Copy())
-				} else {
-					s.Regs[k+int(i.A+3)] = val.Copy()
-				}
-			}
-			if s.Regs[i.A+3].Type != NIL {
-				s.Regs[i.A+2] = s.Regs[i.A+3].Copy()
-			} else {
-				s.PC++
-			}
-		})
-		return
+	cb := s.Base + int(i.A) + 3
+	v.growStack(cb + 3)
+	copy(v.stack[cb:cb+3], v.stack[cb-3:cb])
+	v.call(cb, 2, int(i.C))
+	if s.Regs[i.A+3].Type != NIL {
+		s.Regs[i.A+2] = s.Regs[i.A+3]
+	} else {
+		s.PC++
 	}
-	/*if function.Type == GOFUNCTION {
-		function.Val.(GOFUNC)(c, v)
-	}*/
 }
 
+// maxSizeHint caps the sizes OP_NEWTABLE preallocates. They are only hints,
+// and a single instruction could otherwise ask for billions of slots.
+const maxSizeHint = 1 << 14
+
 func Op_NewTable(i *Instr, s *Stackframe, v *VM) {
-	t := &Table{}
-	x := i.B & 7
-	e := i.B >> 3
-	arraySize := uint64(x)
-	if e != 0 {
-		arraySize = uint64(math.Pow(float64((x+8)*2), float64(e-1)))
-	}
-	t.ArraySize = arraySize
-	t.Array = make([]*Value, arraySize)
-	t.Hash = make(map[Value]*Value)
-	s.Regs[i.A] = &Value{
+	narray, nhash := min(fb2int(int(i.B)), maxSizeHint), min(fb2int(int(i.C)), maxSizeHint)
+	v.charge(narray + nhash)
+	t := NewTableSize(narray, nhash)
+	s.Regs[i.A] = Value{
 		Type: TABLE,
 		Val:  t,
 	}
+	v.checkGC()
+}
+
+// fb2int decodes the "floating point byte" (eeeeexxx) that OP_NEWTABLE uses
+// for its size hints.
+func fb2int(x int) int {
+	e := (x >> 3) & 31
+	if e == 0 {
+		return x
+	}
+	return ((x & 7) + 8) << uint(e-1)
 }
 
 func Op_SetList(i *Instr, s *Stackframe, v *VM) {
+	if s.Regs[i.A].Type != TABLE {
+		v.Error("attempt to set list items of a %s value", s.Regs[i.A].TypeName())
+	}
 	t := s.Regs[i.A].Val.(*Table)
+	items := s.Regs[i.A+1:]
 	top := int(i.B)
 	block := Integer(i.C)
 	if top == 0 {
-		top = len(s.Regs) - int(i.A+1)
+		items = v.stack[s.Base+int(i.A)+1 : v.top]
+		top = len(items)
+		v.frameTop()
 	}
 	if block == 0 {
 		block = Integer(s.Closure.Function.Instructions[s.PC].Raw)
 		s.PC++
 	}
 	for l1 := Integer(1); l1 <= Integer(top); l1++ {
-		t.Set(
-			Value{Type: NUMBER, Val: Number(l1 + ((block - 1) * 50))},
-			s.Regs[i.A+uint8(l1)].Copy())
+		t.set(
+			Value{Type: NUMBER, Num: Number(l1 + ((block - 1) * 50))},
+			items[l1-1])
 	}
 }
 
@@ -716,48 +588,69 @@ func Op_Closure(i *Instr, s *Stackframe, v *VM) {
 		Function: s.Closure.Function.Functions[i.B],
 	}
 	destReg := i.A
-	closure.Upvalues = make([]*Value, closure.Function.Upvalues)
+	closure.Upvalues = make([]*Upvalue, closure.Function.Upvalues)
 	for l1 := uint8(0); l1 < closure.Function.Upvalues; l1++ {
 		subi := s.Closure.Function.Instructions[s.PC]
 		if subi.Opcode == OP_GETUPVAL {
 			closure.Upvalues[l1] = s.Closure.Upvalues[subi.B]
 		} else if subi.Opcode == OP_MOVE {
-			closure.Upvalues[l1] = s.Regs[subi.B]
+			closure.Upvalues[l1] = v.findUpvalue(s.Base + int(subi.B))
 		} else {
 			panic("Invalid upval reg code")
 		}
 		s.PC++
 	}
-	s.Regs[destReg] = &Value{Type: CLOSURE, Val: closure}
+	s.Regs[destReg] = Value{Type: CLOSURE, Val: closure}
+	v.checkGC()
 }
 
 func Op_Close(i *Instr, s *Stackframe, v *VM) {
+	v.closeUpvalues(s.Base + int(i.A))
 }
 
 func Op_Vararg(i *Instr, s *Stackframe, v *VM) {
+	first := s.Base + int(i.A)
+	n := int(i.B) - 1
 	if i.B == 0 {
-		for l1 := int32(0); l1 < int32(len(s.Params)); l1++ {
-			if l1+int32(i.A) >= int32(len(v.S.Regs)) {
-				v.S.Regs = append(v.S.Regs, s.Params[l1])
-			} else {
-				v.S.Regs[l1+int32(i.A)] = s.Params[l1]
-			}
-		}
-	} else {
-		for l1 := int32(0); l1 < i.B-1; l1++ {
-			if l1+int32(i.A) >= int32(len(v.S.Regs)) {
-				v.S.Regs = append(v.S.Regs, s.Params[l1])
-			} else {
-				v.S.Regs[l1+int32(i.A)] = s.Params[l1]
-			}
+		n = len(s.Varargs)
+		v.charge(n)
+		v.growStack(first + n)
+		v.top = first + n
+	}
+	for l1 := 0; l1 < n; l1++ {
+		if l1 < len(s.Varargs) {
+			v.stack[first+l1] = s.Varargs[l1]
+		} else {
+			v.stack[first+l1] = Value{}
 		}
 	}
-
 }
 
 func (v *Value) Copy() *Value {
-	return &Value{
-		Type: v.Type,
-		Val:  v.Val,
+	if v == nil {
+		return &Value{Type: NIL}
+	}
+	c := *v
+	return &c
+}
+
+// goParams copies params into a fresh slice for a GOFUNC, which is free to
+// keep or return the values it is passed.
+func goParams(params []Value) []*Value {
+	vals := make([]Value, len(params))
+	copy(vals, params)
+	ptrs := make([]*Value, len(vals))
+	for k := range vals {
+		ptrs[k] = &vals[k]
+	}
+	return ptrs
+}
+
+// deref returns the value p points to, treating a nil pointer as nil, for
+// storing values handed over by Go code.
+func deref(p *Value) Value {
+	if p == nil {
+		return Value{}
 	}
+	return *p
 }
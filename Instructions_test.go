@@ -0,0 +1,708 @@
+package LuaVM
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+// runOp executes the single instruction i on a frame holding regs, with
+// constants k, and returns the frame and the error the instruction raised.
+func runOp(i Instr, k []Value, regs ...Value) (*Stackframe, error) {
+	p := &FunctionPrototype{Instructions: []Instr{i}, Constants: k, MaxStackSize: uint8(len(regs))}
+	p.lower()
+	s := &Stackframe{Regs: regs, Closure: &Closure{Function: p}}
+	vm := NewVM()
+	_, err := vm.PCall(NewGoFunction(func(params []*Value, v *VM) []*Value {
+		in := &p.Instructions[0]
+		s.PC++
+		in.handler(in, s, v)
+		return nil
+	}), nil)
+	return s, err
+}
+
+func num(n float64) Value {
+	return Value{Type: NUMBER, Num: Number(n)}
+}
+
+func str(s string) Value {
+	return Value{Type: STRING, Val: s}
+}
+
+func TestArithmeticCoercion(t *testing.T) {
+	for _, test := range []struct {
+		op   OPCODE
+		b, c Value
+		want float64
+	}{
+		{OP_ADD, str("10"), num(1), 11},
+		{OP_ADD, num(1), str(" 10\t"), 11},
+		{OP_MUL, str("3"), str("4"), 12},
+		{OP_SUB, str("1e1"), num(1), 9},
+		{OP_DIV, str("0x10"), num(4), 4},
+		{OP_MOD, num(-5), str("3"), 1},
+		{OP_MOD, num(5.5), num(-2), -0.5},
+		{OP_POW, str("2"), str("10"), 1024},
+		{OP_UNM, str("-2"), Value{}, 2},
+	} {
+		s, err := runOp(Instr{Opcode: test.op, A: 0, B: 1, C: 2}, nil, Value{}, test.b, test.c)
+		if err != nil {
+			t.Errorf("%v %s %s: %v", test.op, test.b.String(), test.c.String(), err)
+			continue
+		}
+		if got := s.Regs[0]; got.Type != NUMBER || got.Num != Number(test.want) {
+			t.Errorf("%v %s %s = %s, want %v", test.op, test.b.String(), test.c.String(), got.String(), test.want)
+		}
+	}
+
+	for _, test := range []struct {
+		b, c Value
+		want string
+	}{
+		{str("abc"), num(1), "attempt to perform arithmetic on a string value"},
+		{num(1), str("1x"), "attempt to perform arithmetic on a string value"},
+		{Value{}, num(1), "attempt to perform arithmetic on a nil value"},
+		{num(1), Value{Type: TABLE, Val: NewTable()}, "attempt to perform arithmetic on a table value"},
+	} {
+		_, err := runOp(Instr{Opcode: OP_ADD, A: 0, B: 1, C: 2}, nil, Value{}, test.b, test.c)
+		if err == nil || err.Error() != test.want {
+			t.Errorf("%s + %s: got error %v, want %q", test.b.String(), test.c.String(), err, test.want)
+		}
+	}
+
+	// The specialised handlers fall back to coercion for constant operands.
+	s, err := runOp(Instr{Opcode: OP_ADD, A: 0, B: 1, C: 256 + 0}, []Value{str("2")}, Value{}, num(1))
+	if err != nil || s.Regs[0].Num != 3 {
+		t.Errorf("1 + \"2\" = %s, %v", s.Regs[0].String(), err)
+	}
+}
+
+func TestConcatCoercion(t *testing.T) {
+	for _, test := range []struct {
+		b, c Value
+		want string
+	}{
+		{str("n="), num(5), "n=5"},
+		{num(1), num(2), "12"},
+		{str("x"), num(0.1), "x0.1"},
+		{num(1e20), str(""), "1e+20"},
+		{num(1.0 / 3), str(""), "0.33333333333333"},
+		{num(-0.5), str("!"), "-0.5!"},
+	} {
+		s, err := runOp(Instr{Opcode: OP_CONCAT, A: 0, B: 1, C: 2}, nil, Value{}, test.b, test.c)
+		if err != nil || s.Regs[0].Type != STRING || s.Regs[0].Val.(string) != test.want {
+			t.Errorf("%s .. %s = %s, %v; want %q", test.b.String(), test.c.String(), s.Regs[0].String(), err, test.want)
+		}
+	}
+
+	_, err := runOp(Instr{Opcode: OP_CONCAT, A: 0, B: 1, C: 2}, nil, Value{}, str("x"), *NewBool(true))
+	if err == nil || err.Error() != "attempt to concatenate a boolean value" {
+		t.Errorf("\"x\" .. true: got error %v", err)
+	}
+}
+
+func TestForPrepCoercion(t *testing.T) {
+	s, err := runOp(Instr{Opcode: OP_FORPREP, A: 0, B: 0}, nil, str("1"), str(" 3 "), str("0x1"), Value{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for l1, want := range []Number{0, 3, 1} {
+		if got := s.Regs[l1]; got.Type != NUMBER || got.Num != want {
+			t.Errorf("register %d = %s, want %v", l1, got.String(), want)
+		}
+	}
+}
+
+func TestToStringNumbers(t *testing.T) {
+	vm := NewVM()
+	for _, test := range []struct {
+		n    float64
+		want string
+	}{
+		{100, "100"},
+		{-0.25, "-0.25"},
+		{1e15, "1e+15"},
+		{12345678901234567, "1.2345678901235e+16"},
+		{0.1, "0.1"},
+	} {
+		if got := vm.tostring(NewNumber(test.n)); got != test.want {
+			t.Errorf("tostring(%v) = %q, want %q", test.n, got, test.want)
+		}
+	}
+}
+
+// truthValues are a value of every kind that matters to truthiness, with
+// whether Lua counts it as true.
+var truthValues = []struct {
+	val   Value
+	truth bool
+}{
+	{Value{}, false},
+	{*NewBool(false), false},
+	{*NewBool(true), true},
+	{num(0), true},
+	{num(1), true},
+	{str(""), true},
+	{Value{Type: TABLE, Val: NewTable()}, true},
+}
+
+func TestBooleans(t *testing.T) {
+	if b := NewBool(true); b.String() != "true" || !truthy(b) {
+		t.Error("NewBool(true) = ", b.String())
+	}
+	if b := NewBool(false); b.String() != "false" || truthy(b) {
+		t.Error("NewBool(false) = ", b.String())
+	}
+	for _, b := range []int32{0, 1} {
+		s, _ := runOp(Instr{Opcode: OP_LOADBOOL, A: 0, B: b}, nil, Value{})
+		if !rawEquals(&s.Regs[0], NewBool(b == 1)) {
+			t.Errorf("LOADBOOL 0 %d loaded %s", b, s.Regs[0].String())
+		}
+	}
+}
+
+func TestNot(t *testing.T) {
+	for _, test := range truthValues {
+		s, err := runOp(Instr{Opcode: OP_NOT, A: 0, B: 1}, nil, *NewBool(test.truth), test.val)
+		if err != nil || !rawEquals(&s.Regs[0], NewBool(!test.truth)) {
+			t.Errorf("not %s = %s, %v", test.val.String(), s.Regs[0].String(), err)
+		}
+	}
+}
+
+func TestTest(t *testing.T) {
+	for _, test := range truthValues {
+		for _, c := range []uint16{0, 1} {
+			// The jump after TEST is taken when the value is as true as C.
+			jumps := test.truth == (c == 1)
+
+			s, _ := runOp(Instr{Opcode: OP_TEST, A: 0, C: c}, nil, test.val)
+			if got := s.PC == 1; got != jumps {
+				t.Errorf("TEST %s %d: jump taken = %v", test.val.String(), c, got)
+			}
+
+			s, _ = runOp(Instr{Opcode: OP_TESTSET, A: 0, B: 1, C: c}, nil, num(42), test.val)
+			if got := s.PC == 1; got != jumps {
+				t.Errorf("TESTSET %s %d: jump taken = %v", test.val.String(), c, got)
+			}
+			want := num(42)
+			if jumps {
+				want = test.val
+			}
+			if !rawEquals(&s.Regs[0], &want) {
+				t.Errorf("TESTSET %s %d: register = %s, want %s", test.val.String(), c, s.Regs[0].String(), want.String())
+			}
+		}
+	}
+}
+
+func TestOrderStrings(t *testing.T) {
+	for _, test := range []struct {
+		b, c   string
+		lt, le bool
+	}{
+		{"abc", "abd", true, true},
+		{"abd", "abc", false, false},
+		{"abc", "abc", false, true},
+		{"", "a", true, true},
+		{"Z", "a", true, true},
+		{"abc", "abcd", true, true},
+		{"10", "9", true, true},
+		{"a\x00b", "a\x00c", true, true},
+		{"\xff", "a", false, false},
+	} {
+		for _, op := range []OPCODE{OP_LT, OP_LE} {
+			want := test.lt
+			if op == OP_LE {
+				want = test.le
+			}
+			// With A=1 the jump after the comparison is taken when it
+			// holds.
+			s, err := runOp(Instr{Opcode: op, A: 1, B: 0, C: 1}, nil, str(test.b), str(test.c))
+			if got := s.PC == 1; err != nil || got != want {
+				t.Errorf("%v %q %q = %v, %v; want %v", op, test.b, test.c, got, err, want)
+			}
+		}
+	}
+}
+
+func TestOrderErrors(t *testing.T) {
+	for _, test := range []struct {
+		b, c Value
+		want string
+	}{
+		{num(1), Value{}, "attempt to compare number with nil"},
+		{str("1"), num(2), "attempt to compare string with number"},
+		{*NewBool(true), *NewBool(false), "attempt to compare two boolean values"},
+		{Value{Type: TABLE, Val: NewTable()}, Value{Type: TABLE, Val: NewTable()}, "attempt to compare two table values"},
+	} {
+		for _, op := range []OPCODE{OP_LT, OP_LE} {
+			_, err := runOp(Instr{Opcode: op, A: 1, B: 0, C: 1}, nil, test.b, test.c)
+			if err == nil || err.Error() != test.want {
+				t.Errorf("%v %s %s: got error %v, want %q", op, test.b.String(), test.c.String(), err, test.want)
+			}
+		}
+	}
+}
+
+func TestOrderMetamethods(t *testing.T) {
+	vm := NewVM()
+	// Objects compare by their "n" field.
+	field := func(val *Value) Number {
+		return val.Val.(*Table).Get(*NewString("n")).Num
+	}
+	lt := NewTable()
+	lt.SetFunc("__lt", func(params []*Value, v *VM) []*Value {
+		return []*Value{NewBool(field(params[0]) < field(params[1]))}
+	})
+	le := NewTable()
+	le.Set(*NewString("__lt"), lt.Get(*NewString("__lt")))
+	le.SetFunc("__le", func(params []*Value, v *VM) []*Value {
+		return []*Value{NewBool(field(params[0]) <= field(params[1]))}
+	})
+	object := func(n float64, mt *Table) *Value {
+		t := NewTable()
+		t.SetNumber("n", n)
+		t.Metatable = mt
+		return &Value{Type: TABLE, Val: t}
+	}
+
+	for _, mt := range []*Table{lt, le} {
+		one, two := object(1, mt), object(2, mt)
+		if !vm.lessThan(one, two) || vm.lessThan(two, one) {
+			t.Error("__lt does not order objects")
+		}
+		// Without __le, a <= b is not (b < a).
+		if !vm.lessEqual(one, two) || !vm.lessEqual(one, object(1, mt)) || vm.lessEqual(two, one) {
+			t.Error("<= does not order objects")
+		}
+	}
+
+	// Operands with different metamethods cannot be compared.
+	other := NewTable()
+	other.SetFunc("__lt", func(params []*Value, v *VM) []*Value { return []*Value{NewBool(true)} })
+	_, err := vm.PCall(NewGoFunction(func(params []*Value, v *VM) []*Value {
+		v.lessThan(object(1, lt), object(2, other))
+		return nil
+	}), nil)
+	if err == nil || err.Error() != "attempt to compare two table values" {
+		t.Error("different __lt metamethods: got error ", err)
+	}
+}
+
+func TestCollation(t *testing.T) {
+	// Order strings case-insensitively.
+	fold := func(a, b string) int {
+		return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+	}
+	vm := NewVM(WithCollation(fold))
+	if !vm.lessThan(NewString("a"), NewString("B")) || vm.lessThan(NewString("B"), NewString("a")) {
+		t.Error("collation not used by <")
+	}
+	if !vm.lessEqual(NewString("A"), NewString("a")) {
+		t.Error("collation not used by <=")
+	}
+	if NewVM().lessThan(NewString("a"), NewString("B")) {
+		t.Error("default order is not byte-wise")
+	}
+}
+
+func TestEqualityByReference(t *testing.T) {
+	vm := NewVM()
+	t1, t2 := &Value{Type: TABLE, Val: NewTable()}, &Value{Type: TABLE, Val: NewTable()}
+	f1 := &Value{Type: CLOSURE, Val: &Closure{Function: &FunctionPrototype{}}}
+	f2 := &Value{Type: CLOSURE, Val: &Closure{Function: f1.Val.(*Closure).Function}}
+	g1, g2 := NewGoFunction(base_print), NewGoFunction(base_type)
+	u1, u2 := NewUserData(1, nil), NewUserData(1, nil)
+	// Registered functions are all made by the same closure in wrapReflect.
+	vm.Register("f", func(x int) int { return x })
+	vm.Register("g", func(x int) int { return -x })
+	r1, r2 := vm.G.Get(str("f")), vm.G.Get(str("g"))
+	for _, test := range []struct {
+		b, c *Value
+		want bool
+	}{
+		{t1, t1, true},
+		{t1, t2, false},
+		{f1, f1, true},
+		{f1, f2, false},
+		{g1, g1, true},
+		{g1, g2, false},
+		{r1, r1, true},
+		{r1, r2, false},
+		{u1, u1, true},
+		{u1, u2, false},
+		{t1, u1, false},
+		{NewNumber(1), NewString("1"), false},
+		{NewBool(false), NewNil(), false},
+		{NewString("a"), NewString("a"), true},
+	} {
+		s, err := runOp(Instr{Opcode: OP_EQ, A: 1, B: 0, C: 1}, nil, *test.b, *test.c)
+		if got := s.PC == 1; err != nil || got != test.want {
+			t.Errorf("%s == %s is %v, %v; want %v", test.b.String(), test.c.String(), got, err, test.want)
+		}
+		raw := base_rawequal([]*Value{test.b, test.c}, vm)[0]
+		if truthy(raw) != test.want {
+			t.Errorf("rawequal(%s, %s) = %s", test.b.String(), test.c.String(), raw.String())
+		}
+	}
+}
+
+func TestEqMetamethod(t *testing.T) {
+	vm := NewVM()
+	calls := 0
+	alwaysEqual := NewGoFunction(func(params []*Value, v *VM) []*Value {
+		calls++
+		return []*Value{NewBool(true)}
+	})
+	mt1, mt2, mt3 := NewTable(), NewTable(), NewTable()
+	mt1.Set(*NewString("__eq"), alwaysEqual)
+	mt2.Set(*NewString("__eq"), alwaysEqual)
+	mt3.SetFunc("__eq", func(params []*Value, v *VM) []*Value { return []*Value{NewBool(true)} })
+	object := func(mt *Table) *Value {
+		t := NewTable()
+		t.Metatable = mt
+		return &Value{Type: TABLE, Val: t}
+	}
+	a := object(mt1)
+	for _, test := range []struct {
+		name string
+		b, c *Value
+		want bool
+	}{
+		{"same metatable", a, object(mt1), true},
+		{"same metamethod", a, object(mt2), true},
+		{"different metamethods", a, object(mt3), false},
+		{"one metatable", a, object(nil), false},
+		{"userdata", NewUserData(1, mt1), NewUserData(2, mt2), true},
+		{"table and userdata", a, NewUserData(1, mt1), false},
+	} {
+		if got := vm.equals(test.b, test.c); got != test.want {
+			t.Errorf("%s: equals = %v, want %v", test.name, got, test.want)
+		}
+	}
+
+	// __eq is not consulted for a value and itself, nor by rawequal.
+	calls = 0
+	if !vm.equals(a, a) || calls != 0 {
+		t.Error("__eq called to compare a table with itself")
+	}
+	if truthy(base_rawequal([]*Value{a, object(mt1)}, vm)[0]) || calls != 0 {
+		t.Error("rawequal used __eq")
+	}
+}
+
+// forCount runs
+//
+//	local n = 0
+//	for i = init, limit, step do n = n + 1 end
+//	return n
+//
+// under an instruction limit.
+func forCount(init, limit, step Value) (Number, error) {
+	p := &FunctionPrototype{
+		Instructions: []Instr{
+			{Opcode: OP_LOADK, A: 0, B: 0},
+			{Opcode: OP_LOADK, A: 1, B: 1},
+			{Opcode: OP_LOADK, A: 2, B: 2},
+			{Opcode: OP_LOADK, A: 4, B: 3},
+			{Opcode: OP_FORPREP, A: 0, B: 1},
+			{Opcode: OP_ADD, A: 4, B: 4, C: 256 + 4},
+			{Opcode: OP_FORLOOP, A: 0, B: -2},
+			{Opcode: OP_RETURN, A: 4, B: 2},
+		},
+		Constants:    []Value{init, limit, step, num(0), num(1)},
+		MaxStackSize: 5,
+	}
+	vm := NewVM(WithInstructionLimit(10000))
+	r, err := vm.PCall(&Value{Type: CLOSURE, Val: &Closure{Function: p}}, nil)
+	if err != nil {
+		return 0, err
+	}
+	return r[0].Num, nil
+}
+
+func TestNumericFor(t *testing.T) {
+	nan := num(math.NaN())
+	for _, test := range []struct {
+		init, limit, step Value
+		want              Number
+	}{
+		{num(1), num(3), num(1), 3},
+		{num(3), num(1), num(-1), 3},
+		{num(1), num(0), num(1), 0},
+		{num(1), num(2), num(0.5), 3},
+		{num(1), num(2), num(0), 0},
+		{str("1"), str(" 4 "), str("0x2"), 2},
+		{nan, num(10), num(1), 0},
+		{num(1), nan, num(1), 0},
+		{num(1), num(10), nan, 0},
+		// FORPREP backs the start off by the step first, and 1-inf+inf
+		// is NaN, so reference Lua runs this no times either.
+		{num(1), num(math.Inf(1)), num(math.Inf(1)), 0},
+	} {
+		got, err := forCount(test.init, test.limit, test.step)
+		if err != nil || got != test.want {
+			t.Errorf("for %s, %s, %s: %v iterations, %v; want %v", test.init.String(), test.limit.String(), test.step.String(), got, err, test.want)
+		}
+	}
+
+	// A zero step with the limit at or below the start never ends.
+	if _, err := forCount(num(1), num(1), num(0)); err == nil || err.Error() != "instruction limit exceeded" {
+		t.Error("for 1, 1, 0 ended: ", err)
+	}
+
+	for _, test := range []struct {
+		init, limit, step Value
+		want              string
+	}{
+		{Value{}, num(1), num(1), "'for' initial value must be a number"},
+		{num(1), str("x"), num(1), "'for' limit must be a number"},
+		{num(1), num(1), *NewBool(true), "'for' step must be a number"},
+		{str("a"), str("b"), str("c"), "'for' initial value must be a number"},
+	} {
+		if _, err := forCount(test.init, test.limit, test.step); err == nil || err.Error() != test.want {
+			t.Errorf("for %s, %s, %s: got error %v, want %q", test.init.String(), test.limit.String(), test.step.String(), err, test.want)
+		}
+	}
+}
+
+func TestForLoopDoesNotAlias(t *testing.T) {
+	// The loop variable is a copy: changing it does not move the counter.
+	s, _ := runOp(Instr{Opcode: OP_FORLOOP, A: 0, B: 0}, nil, num(0), num(5), num(1), Value{})
+	s.Regs[3].Num = 100
+	if s.Regs[0].Num != 1 {
+		t.Error("counter follows the loop variable: ", s.Regs[0].String())
+	}
+}
+
+// genericFor runs `for k, v in f, state, control do s = s .. k .. v end`
+// and returns s.
+func genericFor(vm *VM, f, state, control Value) (string, error) {
+	p := &FunctionPrototype{
+		Instructions: []Instr{
+			{Opcode: OP_LOADK, A: 0, B: 0},
+			{Opcode: OP_LOADK, A: 1, B: 1},
+			{Opcode: OP_LOADK, A: 2, B: 2},
+			{Opcode: OP_LOADK, A: 3, B: 3},
+			{Opcode: OP_JMP, B: 4},
+			{Opcode: OP_MOVE, A: 6, B: 0},
+			{Opcode: OP_MOVE, A: 7, B: 4},
+			{Opcode: OP_MOVE, A: 8, B: 5},
+			{Opcode: OP_CONCAT, A: 0, B: 6, C: 8},
+			{Opcode: OP_TFORLOOP, A: 1, C: 2},
+			{Opcode: OP_JMP, B: -6},
+			{Opcode: OP_RETURN, A: 0, B: 2},
+		},
+		Constants:    []Value{str(""), f, state, control},
+		MaxStackSize: 9,
+	}
+	r, err := vm.PCall(&Value{Type: CLOSURE, Val: &Closure{Function: p}}, nil)
+	if err != nil {
+		return "", err
+	}
+	return r[0].String(), nil
+}
+
+func TestGenericForGoFunction(t *testing.T) {
+	vm := NewVM(WithInstructionLimit(10000))
+	list := NewTable()
+	list.SetInt(1, NewString("a"))
+	list.SetInt(2, NewString("b"))
+	list.SetInt(4, NewString("d"))
+	ipairs := vm.Call(vm.G.Get(str("ipairs")), []*Value{{Type: TABLE, Val: list}})
+	if s, err := genericFor(vm, *ipairs[0], *ipairs[1], *ipairs[2]); err != nil || s != "1a2b" {
+		t.Errorf("ipairs: got %q, %v, want \"1a2b\"", s, err)
+	}
+
+	// Missing results are nil, not left over from the call before.
+	short := *NewGoFunction(func(params []*Value, v *VM) []*Value {
+		if params[1].Type == NIL {
+			return []*Value{NewString("k"), NewString("v")}
+		}
+		return []*Value{NewString("k")}
+	})
+	if _, err := genericFor(vm, short, Value{}, Value{}); err == nil || !strings.Contains(err.Error(), "concatenate a nil value") {
+		t.Errorf("short results: got %v, want a concatenation error", err)
+	}
+
+	if _, err := genericFor(vm, num(1), Value{}, Value{}); err == nil || err.Error() != "attempt to call a number value" {
+		t.Errorf("number iterator: got %v, want attempt to call a number value", err)
+	}
+}
+
+// recursive returns a function, to be stored as the global f, for
+// f(n) = n == 0 and 0 or n + f(n - 1), or with tail set, for
+// f(n) = n == 0 and 0 or f(n - 1) as a tail call.
+func recursive(tail bool) *Value {
+	p := &FunctionPrototype{
+		Instructions: []Instr{
+			{Opcode: OP_EQ, A: 0, B: 0, C: 256 + 1},
+			{Opcode: OP_JMP, B: 1},
+			{Opcode: OP_RETURN, A: 0, B: 2},
+			{Opcode: OP_GETGLOBAL, A: 1, B: 0},
+			{Opcode: OP_SUB, A: 2, B: 0, C: 256 + 2},
+			{Opcode: OP_CALL, A: 1, B: 2, C: 2},
+			{Opcode: OP_ADD, A: 1, B: 0, C: 1},
+			{Opcode: OP_RETURN, A: 1, B: 2},
+		},
+		Constants:    []Value{str("f"), num(0), num(1)},
+		Parameters:   1,
+		MaxStackSize: 3,
+	}
+	if tail {
+		p.Instructions[5] = Instr{Opcode: OP_TAILCALL, A: 1, B: 2}
+		p.Instructions[6] = Instr{Opcode: OP_RETURN, A: 1}
+	}
+	return &Value{Type: CLOSURE, Val: &Closure{Function: p}}
+}
+
+func TestDeepCalls(t *testing.T) {
+	// Deep recursion grows the stack many times over, and the frames
+	// below must see their registers after each move.
+	vm := NewVM()
+	vm.G.Set(str("f"), recursive(false))
+	r, err := vm.PCall(vm.G.Get(str("f")), []*Value{NewNumber(5000)})
+	if err != nil || r[0].Num != 12502500 {
+		t.Errorf("f(5000): got %v, %v, want 12502500", r, err)
+	}
+
+	vm = NewVM(WithMaxCalls(100))
+	vm.G.Set(str("f"), recursive(false))
+	if _, err := vm.PCall(vm.G.Get(str("f")), []*Value{NewNumber(100)}); err == nil || err.Error() != "stack overflow" {
+		t.Errorf("f(100) with 100 calls: got %v, want stack overflow", err)
+	}
+	if r, err := vm.PCall(vm.G.Get(str("f")), []*Value{NewNumber(10)}); err != nil || r[0].Num != 55 {
+		t.Errorf("f(10) after the overflow: got %v, %v, want 55", r, err)
+	}
+
+	vm.G.Set(str("f"), recursive(true))
+	if r, err := vm.PCall(vm.G.Get(str("f")), []*Value{NewNumber(100000)}); err != nil || r[0].Num != 0 {
+		t.Errorf("tail calls: got %v, %v, want 0", r, err)
+	}
+}
+
+func TestCallsDoNotAllocate(t *testing.T) {
+	// g(...) returns ..., and h calls g(g(i, i)) a hundred times, so that
+	// every call is to a vararg function and has open results.
+	g := &FunctionPrototype{
+		Instructions: []Instr{
+			{Opcode: OP_VARARG, A: 0, B: 0},
+			{Opcode: OP_RETURN, A: 0, B: 0},
+		},
+		IsVararg:     uint8(VARARG_ISVARARG),
+		MaxStackSize: 2,
+	}
+	h := &FunctionPrototype{
+		Instructions: []Instr{
+			{Opcode: OP_LOADK, A: 0, B: 1},
+			{Opcode: OP_LOADK, A: 1, B: 2},
+			{Opcode: OP_LOADK, A: 2, B: 1},
+			{Opcode: OP_FORPREP, A: 0, B: 6},
+			{Opcode: OP_GETGLOBAL, A: 4, B: 0},
+			{Opcode: OP_GETGLOBAL, A: 5, B: 0},
+			{Opcode: OP_MOVE, A: 6, B: 3},
+			{Opcode: OP_MOVE, A: 7, B: 3},
+			{Opcode: OP_CALL, A: 5, B: 3, C: 0},
+			{Opcode: OP_CALL, A: 4, B: 0, C: 1},
+			{Opcode: OP_FORLOOP, A: 0, B: -7},
+			{Opcode: OP_RETURN, A: 0, B: 1},
+		},
+		Constants:    []Value{str("g"), num(1), num(100)},
+		MaxStackSize: 8,
+	}
+	vm := NewVM()
+	vm.G.Set(str("g"), &Value{Type: CLOSURE, Val: &Closure{Function: g}})
+	fn := &Value{Type: CLOSURE, Val: &Closure{Function: h}}
+	if _, err := vm.PCall(fn, nil); err != nil {
+		t.Fatal(err)
+	}
+	if n := testing.AllocsPerRun(10, func() { vm.Call(fn, nil) }); n != 0 {
+		t.Errorf("%v allocations for 200 calls", n)
+	}
+}
+
+func TestStackMovesUnderMetamethod(t *testing.T) {
+	// An __index handler that recurses deeply moves the stack while
+	// OP_GETTABLE runs, and the result must land in the moved registers.
+	vm := NewVM()
+	vm.G.Set(str("f"), recursive(false))
+	mt := NewTable()
+	mt.Set(str("__index"), NewGoFunction(func(params []*Value, v *VM) []*Value {
+		return v.Call(v.G.Get(str("f")), []*Value{NewNumber(3000)})
+	}))
+	tb := NewTable()
+	tb.Metatable = mt
+	vm.G.Set(str("t"), &Value{Type: TABLE, Val: tb})
+	p := &FunctionPrototype{
+		Instructions: []Instr{
+			{Opcode: OP_GETGLOBAL, A: 0, B: 0},
+			{Opcode: OP_GETTABLE, A: 1, B: 0, C: 256 + 1},
+			{Opcode: OP_GETTABLE, A: 2, B: 0, C: 256 + 1},
+			{Opcode: OP_RETURN, A: 1, B: 3},
+		},
+		Constants:    []Value{str("t"), str("x")},
+		MaxStackSize: 3,
+	}
+	r, err := vm.PCall(&Value{Type: CLOSURE, Val: &Closure{Function: p}}, nil)
+	if err != nil || len(r) != 2 || r[0].Num != 4501500 || r[1].Num != 4501500 {
+		t.Errorf("got %v, %v, want 4501500 twice", r, err)
+	}
+}
+
+func TestUpvaluesShareVariables(t *testing.T) {
+	// local n = 0
+	// local function inc() n = n + 1; return n end
+	// run(inc)
+	// return n
+	//
+	// where run moves the stack before calling inc, then calls it again
+	// from a coroutine with a stack of its own.
+	inc := &FunctionPrototype{
+		Instructions: []Instr{
+			{Opcode: OP_GETUPVAL, A: 0, B: 0},
+			{Opcode: OP_ADD, A: 0, B: 0, C: 256 + 0},
+			{Opcode: OP_SETUPVAL, A: 0, B: 0},
+			{Opcode: OP_RETURN, A: 0, B: 2},
+		},
+		Constants:    []Value{num(1)},
+		Upvalues:     1,
+		MaxStackSize: 1,
+	}
+	p := &FunctionPrototype{
+		Instructions: []Instr{
+			{Opcode: OP_LOADK, A: 0, B: 0},
+			{Opcode: OP_CLOSURE, A: 1, B: 0},
+			{Opcode: OP_MOVE, A: 0, B: 0},
+			{Opcode: OP_GETGLOBAL, A: 2, B: 1},
+			{Opcode: OP_MOVE, A: 3, B: 1},
+			{Opcode: OP_CALL, A: 2, B: 2, C: 1},
+			{Opcode: OP_RETURN, A: 0, B: 2},
+		},
+		Constants:    []Value{num(0), str("run")},
+		Functions:    []*FunctionPrototype{inc},
+		MaxStackSize: 4,
+	}
+	vm := NewVM()
+	vm.G.Set(str("f"), recursive(false))
+	var fn *Value
+	vm.G.Set(str("run"), NewGoFunction(func(params []*Value, v *VM) []*Value {
+		fn = params[0]
+		v.Call(v.G.Get(str("f")), []*Value{NewNumber(3000)})
+		v.Call(fn, nil)
+		co := co_create([]*Value{fn}, v)[0].Val.(*Coroutine)
+		if _, err := v.Resume(co, nil); err != nil {
+			t.Error("inc in a coroutine: ", err)
+		}
+		return nil
+	}))
+	r, err := vm.PCall(&Value{Type: CLOSURE, Val: &Closure{Function: p}}, nil)
+	if err != nil || len(r) != 1 || r[0].Num != 2 {
+		t.Fatalf("got %v, %v, want 2", r, err)
+	}
+	// Once n is out of scope inc keeps it to itself.
+	if r := vm.Call(fn, nil); len(r) != 1 || r[0].Num != 3 {
+		t.Errorf("inc after return: got %v, want 3", r)
+	}
+}
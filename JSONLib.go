@@ -0,0 +1,173 @@
+package LuaVM
+
+import (
+	"encoding/json"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// The json library converts between Lua values and JSON text. Tables are
+// encoded as ToGo would convert them: as arrays when their keys are exactly
+// 1..n and as objects otherwise, in traversal order unless sort_keys is set.
+// Decoding goes through FromGo, so null becomes nil and leaves a hole in an
+// array.
+
+func openJSON(v *VM) *Table {
+	t := NewTable()
+	t.SetFunc("encode", json_encode)
+	t.SetFunc("decode", json_decode)
+	return t
+}
+
+type jsonEncoder struct {
+	b          strings.Builder
+	emptyArray bool
+	sortKeys   bool
+	visiting   map[*Table]bool
+	v          *VM
+}
+
+// json.encode(value [, options]) returns value as JSON text. options may set
+// empty_table_as_array to encode {} as [] rather than {}, and sort_keys to
+// write object keys in sorted order.
+func json_encode(params []*Value, v *VM) []*Value {
+	val := v.checkAny(params, 1, "encode")
+	e := &jsonEncoder{visiting: make(map[*Table]bool), v: v}
+	if opts := arg(params, 2); opts.Type == TABLE {
+		t := opts.Val.(*Table)
+		e.emptyArray = truthy(t.Get(Value{Type: STRING, Val: "empty_table_as_array"}))
+		e.sortKeys = truthy(t.Get(Value{Type: STRING, Val: "sort_keys"}))
+	} else if opts.Type != NIL {
+		v.typeError(params, 2, "encode", "table")
+	}
+	e.encode(val)
+	return []*Value{NewString(e.b.String())}
+}
+
+func (e *jsonEncoder) encode(val *Value) {
+	switch val.Type {
+	case NIL:
+		e.b.WriteString("null")
+	case BOOLEAN:
+		e.b.WriteString(strconv.FormatBool(truthy(val)))
+	case NUMBER:
+		f := float64(val.Num)
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			e.v.Error("cannot encode %s as JSON", numberToString(val.Num))
+		}
+		if f == math.Trunc(f) && math.Abs(f) < 1e15 {
+			e.b.WriteString(strconv.FormatInt(int64(f), 10))
+		} else {
+			e.b.WriteString(strconv.FormatFloat(f, 'g', -1, 64))
+		}
+	case STRING:
+		e.quote(val.Val.(string))
+	case TABLE:
+		e.encodeTable(val.Val.(*Table))
+	default:
+		e.v.Error("cannot encode a %s value as JSON", val.TypeName())
+	}
+}
+
+func (e *jsonEncoder) encodeTable(t *Table) {
+	if e.visiting[t] {
+		e.v.Error("cannot encode a table that contains itself as JSON")
+	}
+	e.visiting[t] = true
+	defer delete(e.visiting, t)
+
+	n, ok := sequenceLen(t)
+	if ok && (n > 0 || e.emptyArray) {
+		e.b.WriteByte('[')
+		for l1 := 1; l1 <= n; l1++ {
+			if l1 > 1 {
+				e.b.WriteByte(',')
+			}
+			e.encode(t.GetInt(l1))
+		}
+		e.b.WriteByte(']')
+		return
+	}
+
+	type field struct {
+		key string
+		val *Value
+	}
+	var fields []field
+	k, val, _ := t.Next(Value{Type: NIL})
+	for k.Type != NIL {
+		key, err := keyString(k)
+		if err != nil {
+			e.v.Error("cannot encode a table with a %s key as JSON", k.TypeName())
+		}
+		fields = append(fields, field{key, val})
+		k, val, _ = t.Next(k)
+	}
+	if e.sortKeys {
+		sort.Slice(fields, func(i, j int) bool { return fields[i].key < fields[j].key })
+	}
+	e.b.WriteByte('{')
+	for l1, f := range fields {
+		if l1 > 0 {
+			e.b.WriteByte(',')
+		}
+		e.quote(f.key)
+		e.b.WriteByte(':')
+		e.encode(f.val)
+	}
+	e.b.WriteByte('}')
+}
+
+// quote writes s as a JSON string. Lua strings are arbitrary bytes, but
+// JSON text must be UTF-8, so each byte that is not part of a valid UTF-8
+// sequence is written as \ufffd, the replacement character.
+func (e *jsonEncoder) quote(s string) {
+	e.b.WriteByte('"')
+	for l1 := 0; l1 < len(s); {
+		c := s[l1]
+		if c >= utf8.RuneSelf {
+			r, size := utf8.DecodeRuneInString(s[l1:])
+			if r == utf8.RuneError && size == 1 {
+				e.b.WriteString(`\ufffd`)
+			} else {
+				e.b.WriteString(s[l1 : l1+size])
+			}
+			l1 += size
+			continue
+		}
+		switch c {
+		case '"', '\\':
+			e.b.WriteByte('\\')
+			e.b.WriteByte(c)
+		case '\n':
+			e.b.WriteString(`\n`)
+		case '\r':
+			e.b.WriteString(`\r`)
+		case '\t':
+			e.b.WriteString(`\t`)
+		default:
+			if c < 0x20 || c == 0x7f {
+				e.b.WriteString(`\u00`)
+				e.b.WriteByte("0123456789abcdef"[c>>4])
+				e.b.WriteByte("0123456789abcdef"[c&15])
+			} else {
+				e.b.WriteByte(c)
+			}
+		}
+		l1++
+	}
+	e.b.WriteByte('"')
+}
+
+// json.decode(s) returns the value encoded by the JSON text s.
+func json_decode(params []*Value, v *VM) []*Value {
+	s := v.checkString(params, 1, "decode")
+	var x interface{}
+	if err := json.Unmarshal([]byte(s), &x); err != nil {
+		v.Error("cannot decode JSON: %v", err)
+	}
+	return []*Value{FromGo(x)}
+}
@@ -0,0 +1,101 @@
+package LuaVM
+
+import "io"
+
+// Lib is a set of standard libraries that NewVM installs into G.
+type Lib uint16
+
+const (
+	LibBase Lib = 1 << iota
+	LibString
+	LibTable
+	LibMath
+	LibOS
+	LibIO
+	LibCoroutine
+	LibDebug
+	LibPackage
+	LibJSON
+
+	// AllLibs are the libraries of standard Lua. json is not one of them,
+	// so it is only installed when asked for, as by
+	// WithLibs(AllLibs | LibJSON).
+	AllLibs Lib = LibBase | LibString | LibTable | LibMath | LibOS | LibIO |
+		LibCoroutine | LibDebug | LibPackage
+
+	// SandboxLibs are the libraries installed by Sandbox. io, debug and
+	// package are left out entirely; base and os are installed in their
+	// restricted forms.
+	SandboxLibs Lib = LibBase | LibString | LibTable | LibMath | LibOS | LibCoroutine
+)
+
+// Option configures a VM created by NewVM.
+type Option func(*VM)
+
+// WithLibs selects the standard libraries NewVM installs. The default is
+// AllLibs.
+func WithLibs(libs Lib) Option {
+	return func(v *VM) {
+		v.libs = libs
+	}
+}
+
+// Sandbox is the profile for running untrusted scripts. It installs
+// SandboxLibs, drops load, loadstring, loadfile and dofile from the base
+// library, and restricts os to clock, date, difftime and time, so scripts
+// can reach neither the filesystem nor the host process.
+func Sandbox() Option {
+	return func(v *VM) {
+		v.libs = SandboxLibs
+		v.sandbox = true
+	}
+}
+
+// WithStdout sets the writer used by print and io.write.
+func WithStdout(w io.Writer) Option {
+	return func(v *VM) {
+		v.Stdout = w
+	}
+}
+
+// WithStdin sets the reader used by io.read.
+func WithStdin(r io.Reader) Option {
+	return func(v *VM) {
+		v.Stdin = r
+	}
+}
+
+var libOpeners = []struct {
+	lib  Lib
+	name string
+	open func(v *VM) *Table
+}{
+	{LibBase, "_G", openBase},
+	{LibPackage, "package", openPackage},
+	{LibString, "string", openString},
+	{LibTable, "table", openTable},
+	{LibMath, "math", openMath},
+	{LibOS, "os", openOS},
+	{LibIO, "io", openIO},
+	{LibCoroutine, "coroutine", openCoroutine},
+	{LibDebug, "debug", openDebug},
+	{LibJSON, "json", openJSON},
+}
+
+func (v *VM) openLibs() {
+	for _, l := range libOpeners {
+		if v.libs&l.lib == 0 {
+			continue
+		}
+		t := l.open(v)
+		if l.name != "_G" {
+			v.G.SetTable(l.name, t)
+		}
+		v.loaded.SetTable(l.name, t)
+	}
+}
+
+// HasLib reports whether lib was installed when the VM was created.
+func (v *VM) HasLib(lib Lib) bool {
+	return v.libs&lib == lib
+}
@@ -2,8 +2,10 @@
 package LuaVM
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
 	"io"
 )
 
@@ -11,8 +13,14 @@ var (
 	BADSIGNATURE error = errors.New("Bad signature")
 	BADVERSION   error = errors.New("Bad version")
 	BADENCODING  error = errors.New("Bad encoding")
+	TRUNCATED    error = errors.New("Truncated chunk")
+	BADCODE      error = errors.New("Bad code")
 )
 
+// maxNesting bounds how deeply function prototypes may nest in a chunk, as
+// LUAI_MAXCCALLS does in the reference loader.
+const maxNesting = 200
+
 type Size_T uint64
 type Integer uint32
 type Instruction uint32
@@ -23,6 +31,11 @@ type Instr struct {
 	A      uint8
 	B      int32
 	C      uint16
+
+	// Set by FunctionPrototype.lower: the handler that executes the
+	// instruction, and B and C resolved to constants where they name one.
+	handler func(*Instr, *Stackframe, *VM)
+	kb, kc  *Value
 }
 
 type FunctionPrototype struct {
@@ -33,6 +46,8 @@ type FunctionPrototype struct {
 	Parameters   uint8
 	IsVararg     uint8
 	MaxStackSize uint8
+
+	lowered bool
 }
 
 type header struct {
@@ -47,25 +62,75 @@ type header struct {
 	Integral         uint8
 }
 
+// luaFile reads a chunk that is held in memory in full, so that every count
+// and length in it can be checked against the bytes that are left before
+// anything is allocated for it. The first read that runs short sets err,
+// after which reads do nothing.
 type luaFile struct {
 	Size_size_t uint8
-	Data        io.Reader
+	Data        *bytes.Reader
+
+	err   error
+	depth int
 }
 
+// ReadLuaC loads a chunk compiled by luac 5.1. The chunk is verified before
+// it is returned, so malformed or hostile bytecode is reported as an error
+// rather than left to crash the VM.
 func ReadLuaC(data io.Reader) (*Closure, error) {
-	l := &luaFile{Data: data}
-	err := l.checkHeader()
+	buf, err := io.ReadAll(data)
 	if err != nil {
 		return nil, err
 	}
-	p, _ := l.readFunctionBlock()
-	c := &Closure{Function: p}
+	l := &luaFile{Data: bytes.NewReader(buf)}
+	err = l.checkHeader()
+	if err != nil {
+		return nil, err
+	}
+	p, err := l.readFunctionBlock()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.verify(); err != nil {
+		return nil, err
+	}
+	p.lower()
+	c := &Closure{Function: p, Upvalues: make([]*Upvalue, p.Upvalues)}
+	for l1 := range c.Upvalues {
+		c.Upvalues[l1] = newUpvalue(Value{})
+	}
 	return c, nil
 }
 
+func (l *luaFile) read(data interface{}) {
+	if l.err != nil {
+		return
+	}
+	if err := binary.Read(l.Data, binary.LittleEndian, data); err != nil {
+		l.err = TRUNCATED
+	}
+}
+
+// readCount reads the length of a list whose entries take at least size
+// bytes each, and fails if there are not enough bytes left to hold it.
+func (l *luaFile) readCount(size int) Integer {
+	var n Integer
+	l.read(&n)
+	if l.err == nil && uint64(n)*uint64(size) > uint64(l.Data.Len()) {
+		l.err = TRUNCATED
+	}
+	if l.err != nil {
+		return 0
+	}
+	return n
+}
+
 func (l *luaFile) checkHeader() error {
 	var header header
-	binary.Read(l.Data, binary.LittleEndian, &header)
+	l.read(&header)
+	if l.err != nil {
+		return l.err
+	}
 	if header.Signature != 0x61754C1B {
 		return BADSIGNATURE
 	}
@@ -77,7 +142,8 @@ func (l *luaFile) checkHeader() error {
 		header.Size_int != 4 ||
 		header.Size_instruction != 4 ||
 		header.Size_number != 8 ||
-		header.Integral != 0 {
+		header.Integral != 0 ||
+		(header.Size_size_t != 4 && header.Size_size_t != 8) {
 		return BADENCODING
 	}
 	l.Size_size_t = header.Size_size_t
@@ -102,10 +168,15 @@ type functionBlock struct {
 }
 
 func (l *luaFile) readFunctionBlock() (*FunctionPrototype, error) {
+	l.depth++
+	defer func() { l.depth-- }()
+	if l.depth > maxNesting {
+		return nil, fmt.Errorf("%w: functions nested too deeply", BADCODE)
+	}
 	l.readString()
 
 	var block functionBlock
-	binary.Read(l.Data, binary.LittleEndian, &block)
+	l.read(&block)
 
 	Prototype := &FunctionPrototype{
 		Upvalues:     block.Upvalues,
@@ -122,43 +193,46 @@ func (l *luaFile) readFunctionBlock() (*FunctionPrototype, error) {
 	l.readLocalList()
 	l.readUpvalueList()
 
+	if l.err != nil {
+		return nil, l.err
+	}
 	return Prototype, nil
 }
 
 func (l *luaFile) readUpvalueList() {
-	var size Integer
-	binary.Read(l.Data, binary.LittleEndian, &size)
+	size := l.readCount(int(l.Size_size_t))
 	for l1 := Integer(0); l1 < size; l1++ {
 		l.readString()
 	}
 }
 
 func (l *luaFile) readLocalList() {
-	var size Integer
 	var local Integer
-	binary.Read(l.Data, binary.LittleEndian, &size)
+	size := l.readCount(int(l.Size_size_t) + 8)
 	for l1 := Integer(0); l1 < size; l1++ {
 		l.readString()
-		binary.Read(l.Data, binary.LittleEndian, &local)
-		binary.Read(l.Data, binary.LittleEndian, &local)
+		l.read(&local)
+		l.read(&local)
 	}
 }
 
 func (l *luaFile) readSourceLinePositionList() {
-	var size Integer
 	var line Integer
-	binary.Read(l.Data, binary.LittleEndian, &size)
+	size := l.readCount(4)
 	for l1 := Integer(0); l1 < size; l1++ {
-		binary.Read(l.Data, binary.LittleEndian, &line)
+		l.read(&line)
 	}
 }
 
 func (l *luaFile) readFunctionList() []*FunctionPrototype {
-	var size Integer
-	binary.Read(l.Data, binary.LittleEndian, &size)
+	size := l.readCount(1)
 	functions := make([]*FunctionPrototype, size)
 	for l1 := Integer(0); l1 < size; l1++ {
-		function, _ := l.readFunctionBlock()
+		function, err := l.readFunctionBlock()
+		if err != nil {
+			l.err = err
+			return nil
+		}
 		functions[l1] = function
 	}
 	return functions
@@ -166,8 +240,14 @@ func (l *luaFile) readFunctionList() []*FunctionPrototype {
 
 func (l *luaFile) readInstruction() Instr {
 	var instruction Instruction
-	binary.Read(l.Data, binary.LittleEndian, &instruction)
+	l.read(&instruction)
+	return decodeInstruction(instruction)
+}
 
+// decodeInstruction splits an instruction word into its opcode and
+// operands. Words with no valid opcode, such as the block number that may
+// follow an OP_SETLIST, are left with zero operands.
+func decodeInstruction(instruction Instruction) Instr {
 	ret := Instr{}
 	ret.Raw = instruction
 
@@ -192,8 +272,7 @@ func (l *luaFile) readInstruction() Instr {
 }
 
 func (l *luaFile) readInstructionList() []Instr {
-	var size Integer
-	binary.Read(l.Data, binary.LittleEndian, &size)
+	size := l.readCount(4)
 	instructions := make([]Instr, size)
 	for l1 := Integer(0); l1 < size; l1++ {
 		instructions[l1] = l.readInstruction()
@@ -202,25 +281,29 @@ func (l *luaFile) readInstructionList() []Instr {
 }
 
 func (l *luaFile) readConstantList() []Value {
-	var size Integer
 	var valuetype ValueType
-	var integer Integer
+	var boolean uint8
 	var number Number
-	binary.Read(l.Data, binary.LittleEndian, &size)
+	size := l.readCount(1)
 	constants := make([]Value, size)
 	for l1 := Integer(0); l1 < size; l1++ {
-		binary.Read(l.Data, binary.LittleEndian, &valuetype)
+		l.read(&valuetype)
 		constants[l1].Type = valuetype
 		switch {
 		case valuetype == NIL:
 		case valuetype == BOOLEAN:
-			binary.Read(l.Data, binary.LittleEndian, &integer)
-			constants[l1].Val = integer
+			l.read(&boolean)
+			constants[l1].Val = boolean != 0
 		case valuetype == NUMBER:
-			binary.Read(l.Data, binary.LittleEndian, &number)
-			constants[l1].Val = number
+			l.read(&number)
+			constants[l1].Num = number
 		case valuetype == STRING:
 			constants[l1].Val = l.readString()
+		default:
+			if l.err == nil {
+				l.err = fmt.Errorf("%w: constant of type %d", BADCODE, valuetype)
+			}
+			return nil
 		}
 	}
 	return constants
@@ -228,23 +311,26 @@ func (l *luaFile) readConstantList() []Value {
 
 func (l *luaFile) readString() string {
 	size := l.readSize_T()
+	if l.err == nil && uint64(size) > uint64(l.Data.Len()) {
+		l.err = TRUNCATED
+	}
+	if l.err != nil || size == 0 {
+		return ""
+	}
 	str := make([]byte, size)
 	l.Data.Read(str)
-	if size > 0 {
-		str = str[:size-1]
-	}
-	return string(str)
+	return string(str[:size-1])
 }
 
 func (l *luaFile) readSize_T() Size_T {
 	if l.Size_size_t == 4 {
 		var size uint32
-		binary.Read(l.Data, binary.LittleEndian, &size)
+		l.read(&size)
 		return Size_T(size)
 	}
 	if l.Size_size_t == 8 {
 		var size uint64
-		binary.Read(l.Data, binary.LittleEndian, &size)
+		l.read(&size)
 		return Size_T(size)
 	}
 	return 0
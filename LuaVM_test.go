@@ -3,6 +3,7 @@ package LuaVM
 
 import (
 	"fmt"
+	"math"
 	"os"
 	"testing"
 )
@@ -20,7 +21,41 @@ func TestReadLuaC(t *testing.T) {
 	}
 	vm := NewVM()
 	vm.G.SetFunc("print", lua_print)
-	vm.RunClosure(c)
+	err = vm.RunClosure(c)
+	if err != nil {
+		t.Error("Run Failed: ", err)
+	}
+}
+
+func TestSandbox(t *testing.T) {
+	vm := NewVM(Sandbox())
+	for _, name := range []string{"io", "debug", "package", "require", "load", "loadstring", "loadfile", "dofile"} {
+		if vm.G.Get(Value{Type: STRING, Val: name}).Type != NIL {
+			t.Error("Sandbox exposes ", name)
+		}
+	}
+	lib := vm.G.Get(Value{Type: STRING, Val: "os"}).Val.(*Table)
+	for _, name := range []string{"execute", "exit", "getenv", "remove", "rename", "tmpname"} {
+		if lib.Get(Value{Type: STRING, Val: name}).Type != NIL {
+			t.Error("Sandbox exposes os.", name)
+		}
+	}
+	if lib.Get(Value{Type: STRING, Val: "time"}).Type != GOFUNCTION {
+		t.Error("Sandbox is missing os.time")
+	}
+}
+
+func TestWithLibs(t *testing.T) {
+	vm := NewVM(WithLibs(LibBase | LibString))
+	if vm.G.Get(Value{Type: STRING, Val: "string"}).Type != TABLE {
+		t.Error("string library not installed")
+	}
+	if vm.G.Get(Value{Type: STRING, Val: "os"}).Type != NIL {
+		t.Error("os library installed")
+	}
+	if vm.G.Get(Value{Type: STRING, Val: "load"}).Type != GOFUNCTION {
+		t.Error("load missing outside the sandbox")
+	}
 }
 
 func lua_print(params []*Value, v *VM) []*Value {
@@ -30,3 +65,102 @@ func lua_print(params []*Value, v *VM) []*Value {
 	fmt.Println()
 	return nil
 }
+
+func TestRandomSeed(t *testing.T) {
+	sequence := func(vm *VM) []Number {
+		random := vm.G.Get(Value{Type: STRING, Val: "math"}).Val.(*Table).Get(Value{Type: STRING, Val: "random"})
+		var ret []Number
+		for l1 := 0; l1 < 10; l1++ {
+			ret = append(ret, vm.Call(random, []*Value{NewNumber(1000)})[0].Num)
+		}
+		return ret
+	}
+	a := sequence(NewVM(WithRandomSeed(42)))
+	b := sequence(NewVM(WithRandomSeed(42)))
+	for l1 := range a {
+		if a[l1] != b[l1] {
+			t.Fatal("same seed gave different sequences: ", a, b)
+		}
+		if a[l1] < 1 || a[l1] > 1000 {
+			t.Fatal("random(1000) out of range: ", a[l1])
+		}
+	}
+}
+
+// benchFixtures are the programs in testdata/bench, compiled with luac 5.1.
+// Each reads its problem size from the global N and leaves its answer in
+// the global result; want is the answer reference Lua gives for the small
+// size used by TestBenchFixtures, and size the one the benchmark runs.
+var benchFixtures = []struct {
+	name string
+	n    float64
+	want Number
+	size float64
+}{
+	{"fib", 10, 55, 20},
+	{"nbody", 10, -0.16907302171469984, 1000},
+	{"spectralnorm", 10, 1.2718440192507248, 50},
+	{"binarytrees", 10, 135854, 8},
+	{"strings", 10, 60, 1000},
+	{"tables", 10, 670, 1000},
+	{"closures", 10, 195, 1000},
+	{"methods", 10, 275, 1000},
+}
+
+func loadFixture(tb testing.TB, path string) *Closure {
+	f, err := os.Open(path)
+	if err != nil {
+		tb.Fatal("File Open Failed: ", err)
+	}
+	defer f.Close()
+	c, err := ReadLuaC(f)
+	if err != nil {
+		tb.Fatal("File Read Failed: ", err)
+	}
+	return c
+}
+
+func TestBenchFixtures(t *testing.T) {
+	for _, test := range benchFixtures {
+		c := loadFixture(t, "testdata/bench/"+test.name+".luac")
+		vm := NewVM()
+		vm.G.SetNumber("N", test.n)
+		if err := vm.RunClosure(c); err != nil {
+			t.Error(test.name, ": Run Failed: ", err)
+			continue
+		}
+		got := vm.G.Get(Value{Type: STRING, Val: "result"})
+		if got.Type != NUMBER || math.Abs(float64(got.Num-test.want)) > 1e-9 {
+			t.Errorf("%s: result = %s, want %v", test.name, got.String(), test.want)
+		}
+	}
+}
+
+func benchmarkFixture(b *testing.B, name string) {
+	for _, test := range benchFixtures {
+		if test.name != name {
+			continue
+		}
+		c := loadFixture(b, "testdata/bench/"+name+".luac")
+		vm := NewVM()
+		vm.G.SetNumber("N", test.size)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for l1 := 0; l1 < b.N; l1++ {
+			if err := vm.RunClosure(c); err != nil {
+				b.Fatal("Run Failed: ", err)
+			}
+		}
+		return
+	}
+	b.Fatal("no fixture ", name)
+}
+
+func BenchmarkFib(b *testing.B)          { benchmarkFixture(b, "fib") }
+func BenchmarkNBody(b *testing.B)        { benchmarkFixture(b, "nbody") }
+func BenchmarkSpectralNorm(b *testing.B) { benchmarkFixture(b, "spectralnorm") }
+func BenchmarkBinaryTrees(b *testing.B)  { benchmarkFixture(b, "binarytrees") }
+func BenchmarkStrings(b *testing.B)      { benchmarkFixture(b, "strings") }
+func BenchmarkTables(b *testing.B)       { benchmarkFixture(b, "tables") }
+func BenchmarkClosures(b *testing.B)     { benchmarkFixture(b, "closures") }
+func BenchmarkMethods(b *testing.B)      { benchmarkFixture(b, "methods") }
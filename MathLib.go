@@ -0,0 +1,150 @@
+package LuaVM
+
+import (
+	"math"
+	"math/rand"
+)
+
+func openMath(v *VM) *Table {
+	t := NewTable()
+	t.SetFunc("abs", mathFunc("abs", math.Abs))
+	t.SetFunc("acos", mathFunc("acos", math.Acos))
+	t.SetFunc("asin", mathFunc("asin", math.Asin))
+	t.SetFunc("atan", mathFunc("atan", math.Atan))
+	t.SetFunc("atan2", math_atan2)
+	t.SetFunc("ceil", mathFunc("ceil", math.Ceil))
+	t.SetFunc("cos", mathFunc("cos", math.Cos))
+	t.SetFunc("cosh", mathFunc("cosh", math.Cosh))
+	t.SetFunc("deg", mathFunc("deg", func(x float64) float64 { return x * 180 / math.Pi }))
+	t.SetFunc("exp", mathFunc("exp", math.Exp))
+	t.SetFunc("floor", mathFunc("floor", math.Floor))
+	t.SetFunc("fmod", math_fmod)
+	t.SetFunc("frexp", math_frexp)
+	t.SetFunc("ldexp", math_ldexp)
+	t.SetFunc("log", mathFunc("log", math.Log))
+	t.SetFunc("log10", mathFunc("log10", math.Log10))
+	t.SetFunc("max", math_max)
+	t.SetFunc("min", math_min)
+	t.SetFunc("modf", math_modf)
+	t.SetFunc("pow", math_pow)
+	t.SetFunc("rad", mathFunc("rad", func(x float64) float64 { return x * math.Pi / 180 }))
+	t.SetFunc("random", math_random)
+	t.SetFunc("randomseed", math_randomseed)
+	t.SetFunc("sin", mathFunc("sin", math.Sin))
+	t.SetFunc("sinh", mathFunc("sinh", math.Sinh))
+	t.SetFunc("sqrt", mathFunc("sqrt", math.Sqrt))
+	t.SetFunc("tan", mathFunc("tan", math.Tan))
+	t.SetFunc("tanh", mathFunc("tanh", math.Tanh))
+	t.SetNumber("huge", math.Inf(1))
+	t.SetNumber("pi", math.Pi)
+	return t
+}
+
+// mathFunc wraps a one-argument float function as a GOFUNC.
+func mathFunc(name string, f func(float64) float64) GOFUNC {
+	return func(params []*Value, v *VM) []*Value {
+		x := v.checkNumber(params, 1, name)
+		return []*Value{NewNumber(f(float64(x)))}
+	}
+}
+
+func math_atan2(params []*Value, v *VM) []*Value {
+	y := v.checkNumber(params, 1, "atan2")
+	x := v.checkNumber(params, 2, "atan2")
+	return []*Value{NewNumber(math.Atan2(float64(y), float64(x)))}
+}
+
+func math_fmod(params []*Value, v *VM) []*Value {
+	x := v.checkNumber(params, 1, "fmod")
+	y := v.checkNumber(params, 2, "fmod")
+	return []*Value{NewNumber(math.Mod(float64(x), float64(y)))}
+}
+
+func math_pow(params []*Value, v *VM) []*Value {
+	x := v.checkNumber(params, 1, "pow")
+	y := v.checkNumber(params, 2, "pow")
+	return []*Value{NewNumber(math.Pow(float64(x), float64(y)))}
+}
+
+func math_modf(params []*Value, v *VM) []*Value {
+	x := float64(v.checkNumber(params, 1, "modf"))
+	if math.IsInf(x, 0) {
+		return []*Value{NewNumber(x), NewNumber(0)}
+	}
+	i, f := math.Modf(x)
+	return []*Value{NewNumber(i), NewNumber(f)}
+}
+
+func math_frexp(params []*Value, v *VM) []*Value {
+	m, e := math.Frexp(float64(v.checkNumber(params, 1, "frexp")))
+	return []*Value{NewNumber(m), NewNumber(float64(e))}
+}
+
+func math_ldexp(params []*Value, v *VM) []*Value {
+	m := v.checkNumber(params, 1, "ldexp")
+	e := v.checkInt(params, 2, "ldexp")
+	return []*Value{NewNumber(math.Ldexp(float64(m), e))}
+}
+
+func math_min(params []*Value, v *VM) []*Value {
+	min := v.checkNumber(params, 1, "min")
+	for k := 2; k <= len(params); k++ {
+		if n := v.checkNumber(params, k, "min"); n < min {
+			min = n
+		}
+	}
+	return []*Value{{Type: NUMBER, Num: min}}
+}
+
+func math_max(params []*Value, v *VM) []*Value {
+	max := v.checkNumber(params, 1, "max")
+	for k := 2; k <= len(params); k++ {
+		if n := v.checkNumber(params, k, "max"); n > max {
+			max = n
+		}
+	}
+	return []*Value{{Type: NUMBER, Num: max}}
+}
+
+func math_random(params []*Value, v *VM) []*Value {
+	r := v.rand.Float64()
+	switch len(params) {
+	case 0:
+		return []*Value{NewNumber(r)}
+	case 1:
+		// The bounds are truncated to integers, as luaL_checkint does.
+		u := v.checkInt(params, 1, "random")
+		if u < 1 {
+			v.argError(1, "random", "interval is empty")
+		}
+		return []*Value{NewNumber(math.Floor(r*float64(u)) + 1)}
+	case 2:
+		l := v.checkInt(params, 1, "random")
+		u := v.checkInt(params, 2, "random")
+		if l > u {
+			v.argError(2, "random", "interval is empty")
+		}
+		return []*Value{NewNumber(math.Floor(r*float64(u-l+1)) + float64(l))}
+	}
+	v.Error("wrong number of arguments")
+	return nil
+}
+
+func math_randomseed(params []*Value, v *VM) []*Value {
+	v.SeedRandom(int64(v.checkNumber(params, 1, "randomseed")))
+	return nil
+}
+
+// SeedRandom reseeds the generator behind math.random. Each VM has its own
+// generator, so a VM seeded the same way replays the same sequence.
+func (v *VM) SeedRandom(seed int64) {
+	v.rand = rand.New(rand.NewSource(seed))
+}
+
+// WithRandomSeed seeds the VM's math.random generator. Without it the
+// generator starts from seed 0, as Lua's does from a fixed seed.
+func WithRandomSeed(seed int64) Option {
+	return func(v *VM) {
+		v.SeedRandom(seed)
+	}
+}
@@ -0,0 +1,123 @@
+package LuaVM
+
+import (
+	"math"
+	"testing"
+)
+
+func mathFn(vm *VM, name string) *Value {
+	return vm.G.Get(str("math")).Val.(*Table).Get(str(name))
+}
+
+// sameNumbers compares results as numbers, taking NaN to equal itself.
+func sameNumbers(got []*Value, want ...float64) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for l1, w := range want {
+		g := float64(got[l1].Num)
+		if got[l1].Type != NUMBER || !(g == w || math.IsNaN(g) && math.IsNaN(w)) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestMathFunctions(t *testing.T) {
+	vm := NewVM()
+	inf, nan := math.Inf(1), math.NaN()
+	for _, test := range []struct {
+		fname string
+		args  []float64
+		want  []float64
+	}{
+		{"fmod", []float64{5.5, 2}, []float64{1.5}},
+		{"fmod", []float64{-5.5, 2}, []float64{-1.5}},
+		{"fmod", []float64{5.5, -2}, []float64{1.5}},
+		{"fmod", []float64{1, 0}, []float64{nan}},
+		{"fmod", []float64{1, inf}, []float64{1}},
+		{"modf", []float64{3.5}, []float64{3, 0.5}},
+		{"modf", []float64{-3.5}, []float64{-3, -0.5}},
+		{"modf", []float64{inf}, []float64{inf, 0}},
+		{"modf", []float64{-inf}, []float64{-inf, 0}},
+		{"modf", []float64{nan}, []float64{nan, nan}},
+		{"frexp", []float64{8}, []float64{0.5, 4}},
+		{"frexp", []float64{-3}, []float64{-0.75, 2}},
+		{"frexp", []float64{0}, []float64{0, 0}},
+		{"ldexp", []float64{0.5, 4}, []float64{8}},
+		{"ldexp", []float64{1, 2.9}, []float64{4}},
+		{"ldexp", []float64{1, -1}, []float64{0.5}},
+		{"floor", []float64{-3.5}, []float64{-4}},
+		{"floor", []float64{3.5}, []float64{3}},
+		{"floor", []float64{inf}, []float64{inf}},
+		{"ceil", []float64{-3.5}, []float64{-3}},
+		{"ceil", []float64{3.2}, []float64{4}},
+		{"ceil", []float64{-inf}, []float64{-inf}},
+		{"floor", []float64{nan}, []float64{nan}},
+		{"max", []float64{1, inf, 3}, []float64{inf}},
+		{"min", []float64{1, -inf, 3}, []float64{-inf}},
+		{"sqrt", []float64{-1}, []float64{nan}},
+		{"pow", []float64{2, 0.5}, []float64{math.Sqrt2}},
+	} {
+		args := make([]*Value, len(test.args))
+		for l1, a := range test.args {
+			args[l1] = NewNumber(a)
+		}
+		r, err := vm.PCall(mathFn(vm, test.fname), args)
+		if err != nil || !sameNumbers(r, test.want...) {
+			t.Errorf("math.%s%v = %v, %v, want %v", test.fname, test.args, r, err, test.want)
+		}
+	}
+
+	huge := vm.G.Get(str("math")).Val.(*Table).Get(str("huge"))
+	if !math.IsInf(float64(huge.Num), 1) {
+		t.Errorf("math.huge = %v", huge)
+	}
+}
+
+func TestMathRandom(t *testing.T) {
+	vm := NewVM()
+	random := mathFn(vm, "random")
+	for l1 := 0; l1 < 1000; l1++ {
+		if r := vm.Call(random, nil)[0].Num; r < 0 || r >= 1 {
+			t.Fatalf("math.random() = %v", r)
+		}
+		// Bounds are truncated, so these are math.random(1) and
+		// math.random(1, 3).
+		if r := vm.Call(random, values(1.9))[0].Num; r != 1 {
+			t.Fatalf("math.random(1.9) = %v", r)
+		}
+		if r := vm.Call(random, values(1.5, 3.9))[0].Num; r < 1 || r > 3 || r != Number(math.Trunc(float64(r))) {
+			t.Fatalf("math.random(1.5, 3.9) = %v", r)
+		}
+		if r := vm.Call(random, values(-2, -2))[0].Num; r != -2 {
+			t.Fatalf("math.random(-2, -2) = %v", r)
+		}
+	}
+
+	for _, test := range []struct {
+		args []*Value
+		want string
+	}{
+		{values(0), "bad argument #1 to 'random' (interval is empty)"},
+		{values(0.5), "bad argument #1 to 'random' (interval is empty)"},
+		{values(2, 1), "bad argument #2 to 'random' (interval is empty)"},
+		{values(1, 2, 3), "wrong number of arguments"},
+		{values("x"), "bad argument #1 to 'random' (number expected, got string)"},
+		{values(1, nil), "bad argument #2 to 'random' (number expected, got nil)"},
+	} {
+		if _, err := vm.PCall(random, test.args); err == nil || err.Error() != test.want {
+			t.Errorf("math.random%v: got %v, want %q", test.args, err, test.want)
+		}
+	}
+
+	a := NewVM(WithRandomSeed(7))
+	b := NewVM(WithRandomSeed(7))
+	for l1 := 0; l1 < 10; l1++ {
+		x := a.Call(mathFn(a, "random"), values(100))[0].Num
+		y := b.Call(mathFn(b, "random"), values(100))[0].Num
+		if x != y {
+			t.Fatalf("VMs seeded alike diverged: %v and %v", x, y)
+		}
+	}
+}
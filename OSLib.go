@@ -0,0 +1,195 @@
+package LuaVM
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+var clockStart = time.Now()
+
+func openOS(v *VM) *Table {
+	t := NewTable()
+	t.SetFunc("clock", os_clock)
+	t.SetFunc("date", os_date)
+	t.SetFunc("difftime", os_difftime)
+	t.SetFunc("time", os_time)
+	if !v.sandbox {
+		t.SetFunc("execute", os_execute)
+		t.SetFunc("exit", os_exit)
+		t.SetFunc("getenv", os_getenv)
+		t.SetFunc("remove", os_remove)
+		t.SetFunc("rename", os_rename)
+		t.SetFunc("tmpname", os_tmpname)
+	}
+	return t
+}
+
+func os_clock(params []*Value, v *VM) []*Value {
+	return []*Value{NewNumber(time.Since(clockStart).Seconds())}
+}
+
+func os_difftime(params []*Value, v *VM) []*Value {
+	t2 := v.checkNumber(params, 1, "difftime")
+	t1 := v.optNumber(params, 2, "difftime", 0)
+	return []*Value{NewNumber(float64(t2 - t1))}
+}
+
+func os_time(params []*Value, v *VM) []*Value {
+	if arg(params, 1).Type == NIL {
+		return []*Value{NewNumber(float64(time.Now().Unix()))}
+	}
+	t := v.checkTable(params, 1, "time")
+	field := func(name string, def int) int {
+		f := t.Get(Value{Type: STRING, Val: name})
+		if f.Type == NUMBER {
+			return int(f.Num)
+		}
+		if def < 0 {
+			v.Error("field '%s' missing in date table", name)
+		}
+		return def
+	}
+	d := time.Date(field("year", -1), time.Month(field("month", -1)), field("day", -1),
+		field("hour", 12), field("min", 0), field("sec", 0), 0, time.Local)
+	return []*Value{NewNumber(float64(d.Unix()))}
+}
+
+func os_date(params []*Value, v *VM) []*Value {
+	format := v.optString(params, 1, "date", "%c")
+	t := time.Now()
+	if arg(params, 2).Type != NIL {
+		t = time.Unix(int64(v.checkNumber(params, 2, "date")), 0)
+	}
+	if strings.HasPrefix(format, "!") {
+		t = t.UTC()
+		format = format[1:]
+	}
+	if strings.HasPrefix(format, "*t") {
+		d := NewTable()
+		d.SetNumber("year", float64(t.Year()))
+		d.SetNumber("month", float64(t.Month()))
+		d.SetNumber("day", float64(t.Day()))
+		d.SetNumber("hour", float64(t.Hour()))
+		d.SetNumber("min", float64(t.Minute()))
+		d.SetNumber("sec", float64(t.Second()))
+		d.SetNumber("wday", float64(t.Weekday()+1))
+		d.SetNumber("yday", float64(t.YearDay()))
+		d.Set(Value{Type: STRING, Val: "isdst"}, NewBool(false))
+		return []*Value{{Type: TABLE, Val: d}}
+	}
+	return []*Value{NewString(strftime(format, t))}
+}
+
+func strftime(format string, t time.Time) string {
+	var b strings.Builder
+	for l1 := 0; l1 < len(format); l1++ {
+		if format[l1] != '%' || l1+1 == len(format) {
+			b.WriteByte(format[l1])
+			continue
+		}
+		l1++
+		switch format[l1] {
+		case 'a':
+			b.WriteString(t.Format("Mon"))
+		case 'A':
+			b.WriteString(t.Format("Monday"))
+		case 'b':
+			b.WriteString(t.Format("Jan"))
+		case 'B':
+			b.WriteString(t.Format("January"))
+		case 'c':
+			b.WriteString(t.Format("Mon Jan  2 15:04:05 2006"))
+		case 'd':
+			fmt.Fprintf(&b, "%02d", t.Day())
+		case 'H':
+			fmt.Fprintf(&b, "%02d", t.Hour())
+		case 'I':
+			fmt.Fprintf(&b, "%02d", (t.Hour()+11)%12+1)
+		case 'j':
+			fmt.Fprintf(&b, "%03d", t.YearDay())
+		case 'm':
+			fmt.Fprintf(&b, "%02d", t.Month())
+		case 'M':
+			fmt.Fprintf(&b, "%02d", t.Minute())
+		case 'p':
+			b.WriteString(t.Format("PM"))
+		case 'S':
+			fmt.Fprintf(&b, "%02d", t.Second())
+		case 'w':
+			fmt.Fprintf(&b, "%d", t.Weekday())
+		case 'x':
+			b.WriteString(t.Format("01/02/06"))
+		case 'X':
+			b.WriteString(t.Format("15:04:05"))
+		case 'y':
+			fmt.Fprintf(&b, "%02d", t.Year()%100)
+		case 'Y':
+			fmt.Fprintf(&b, "%d", t.Year())
+		case 'Z':
+			b.WriteString(t.Format("MST"))
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(format[l1])
+		}
+	}
+	return b.String()
+}
+
+func os_execute(params []*Value, v *VM) []*Value {
+	if arg(params, 1).Type == NIL {
+		return []*Value{NewNumber(1)}
+	}
+	cmd := exec.Command("/bin/sh", "-c", v.checkString(params, 1, "execute"))
+	cmd.Stdout = v.Stdout
+	cmd.Stdin = v.Stdin
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		if e, ok := err.(*exec.ExitError); ok {
+			return []*Value{NewNumber(float64(e.ExitCode()))}
+		}
+		return []*Value{NewNumber(-1)}
+	}
+	return []*Value{NewNumber(0)}
+}
+
+func os_exit(params []*Value, v *VM) []*Value {
+	os.Exit(v.optInt(params, 1, "exit", 0))
+	return nil
+}
+
+func os_getenv(params []*Value, v *VM) []*Value {
+	val, ok := os.LookupEnv(v.checkString(params, 1, "getenv"))
+	if !ok {
+		return []*Value{NewNil()}
+	}
+	return []*Value{NewString(val)}
+}
+
+func osResult(err error) []*Value {
+	if err != nil {
+		return []*Value{NewNil(), NewString(err.Error())}
+	}
+	return []*Value{NewBool(true)}
+}
+
+func os_remove(params []*Value, v *VM) []*Value {
+	return osResult(os.Remove(v.checkString(params, 1, "remove")))
+}
+
+func os_rename(params []*Value, v *VM) []*Value {
+	return osResult(os.Rename(v.checkString(params, 1, "rename"), v.checkString(params, 2, "rename")))
+}
+
+func os_tmpname(params []*Value, v *VM) []*Value {
+	f, err := os.CreateTemp("", "lua_")
+	if err != nil {
+		v.Error("unable to generate a unique filename")
+	}
+	f.Close()
+	return []*Value{NewString(f.Name())}
+}
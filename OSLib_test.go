@@ -0,0 +1,80 @@
+package LuaVM
+
+import (
+	"testing"
+	"time"
+)
+
+func osFunc(vm *VM, name string) *Value {
+	return vm.G.Get(str("os")).Val.(*Table).Get(str(name))
+}
+
+func TestOSDate(t *testing.T) {
+	vm := NewVM()
+	for _, test := range []struct {
+		format string
+		want   string
+	}{
+		{"!%Y-%m-%d %H:%M:%S", "1970-01-02 03:04:05"},
+		{"!%a %A %b %B %j %w %y", "Fri Friday Jan January 002 5 70"},
+		{"!%I %p %%", "03 AM %"},
+		{"!%c", "Fri Jan  2 03:04:05 1970"},
+		{"!%x %X", "01/02/70 03:04:05"},
+	} {
+		r, err := vm.PCall(osFunc(vm, "date"), values(test.format, 97445))
+		if err != nil || r[0].String() != test.want {
+			t.Errorf("os.date(%q) = %v, %v, want %q", test.format, r, err, test.want)
+		}
+	}
+
+	d := vm.Call(osFunc(vm, "date"), values("!*t", 97445))[0].Val.(*Table)
+	for field, want := range map[string]Number{"year": 1970, "month": 1, "day": 2, "hour": 3, "min": 4, "sec": 5, "wday": 6, "yday": 2} {
+		if got := d.Get(str(field)).Num; got != want {
+			t.Errorf("os.date(\"!*t\").%s = %v, want %v", field, got, want)
+		}
+	}
+}
+
+func TestOSTime(t *testing.T) {
+	vm := NewVM()
+	now := float64(time.Now().Unix())
+	if got := vm.Call(osFunc(vm, "time"), nil)[0].Num; float64(got) < now {
+		t.Errorf("os.time() = %v, before %v", got, now)
+	}
+
+	// A table from os.date("*t") turns back into the same time.
+	d := vm.Call(osFunc(vm, "date"), values("*t", 1700000000))[0]
+	if got := vm.Call(osFunc(vm, "time"), []*Value{d})[0].Num; got != 1700000000 {
+		t.Errorf("os.time(os.date(\"*t\", 1700000000)) = %v", got)
+	}
+	noon := NewTable()
+	noon.SetNumber("year", 2024)
+	noon.SetNumber("month", 1)
+	noon.SetNumber("day", 15)
+	got := vm.Call(osFunc(vm, "time"), []*Value{{Type: TABLE, Val: noon}})[0].Num
+	if want := time.Date(2024, 1, 15, 12, 0, 0, 0, time.Local).Unix(); got != Number(want) {
+		t.Errorf("os.time{year=2024, month=1, day=15} = %v, want %v", got, want)
+	}
+
+	noon.Set(str("day"), NewNil())
+	if _, err := vm.PCall(osFunc(vm, "time"), []*Value{{Type: TABLE, Val: noon}}); err == nil || err.Error() != "field 'day' missing in date table" {
+		t.Errorf("os.time without a day: got %v", err)
+	}
+	if got := vm.Call(osFunc(vm, "difftime"), values(10, 4))[0].Num; got != 6 {
+		t.Errorf("os.difftime(10, 4) = %v", got)
+	}
+}
+
+func TestOSSandbox(t *testing.T) {
+	vm := NewVM(Sandbox())
+	for _, name := range []string{"execute", "exit", "getenv", "remove", "rename", "tmpname"} {
+		if osFunc(vm, name).Type != NIL {
+			t.Errorf("os.%s is installed in a sandbox", name)
+		}
+	}
+	for _, name := range []string{"clock", "date", "difftime", "time"} {
+		if osFunc(vm, name).Type == NIL {
+			t.Errorf("os.%s is missing from a sandbox", name)
+		}
+	}
+}
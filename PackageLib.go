@@ -0,0 +1,62 @@
+package LuaVM
+
+import (
+	"os"
+	"strings"
+)
+
+func openPackage(v *VM) *Table {
+	t := NewTable()
+	t.SetTable("loaded", v.loaded)
+	t.SetTable("preload", NewTable())
+	t.SetString("path", "./?.luac")
+	v.G.SetFunc("require", base_require)
+	return t
+}
+
+func base_require(params []*Value, v *VM) []*Value {
+	name := v.checkString(params, 1, "require")
+	key := Value{Type: STRING, Val: name}
+	if m := v.loaded.Get(key); m.Type != NIL {
+		return []*Value{m}
+	}
+	pkg := v.loaded.Get(Value{Type: STRING, Val: "package"})
+	if pkg.Type != TABLE {
+		v.Error("'package' table not loaded")
+	}
+	loader := findLoader(pkg.Val.(*Table), name, v)
+	r := v.Call(loader, []*Value{NewString(name)})
+	if len(r) > 0 && r[0].Type != NIL {
+		v.loaded.Set(key, r[0].Copy())
+	}
+	if m := v.loaded.Get(key); m.Type != NIL {
+		return []*Value{m}
+	}
+	v.loaded.Set(key, NewBool(true))
+	return []*Value{NewBool(true)}
+}
+
+func findLoader(pkg *Table, name string, v *VM) *Value {
+	msg := ""
+	preload := pkg.Get(Value{Type: STRING, Val: "preload"})
+	if preload.Type == TABLE {
+		if l := preload.Val.(*Table).Get(Value{Type: STRING, Val: name}); l.Type != NIL {
+			return l
+		}
+	}
+	msg += "\n\tno field package.preload['" + name + "']"
+	path := pkg.Get(Value{Type: STRING, Val: "path"})
+	if path.Type == STRING {
+		file := strings.ReplaceAll(name, ".", string(os.PathSeparator))
+		for _, template := range strings.Split(path.Val.(string), ";") {
+			filename := strings.ReplaceAll(template, "?", file)
+			r := base_loadfile([]*Value{NewString(filename)}, v)
+			if r[0].Type != NIL {
+				return r[0]
+			}
+			msg += "\n\tno file '" + filename + "'"
+		}
+	}
+	v.Error("module '%s' not found:%s", name, msg)
+	return nil
+}
@@ -0,0 +1,47 @@
+package LuaVM
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRequire(t *testing.T) {
+	vm := NewVM()
+	require := vm.G.Get(str("require"))
+	pkg := vm.G.Get(str("package")).Val.(*Table)
+
+	loads := 0
+	loader := NewGoFunction(func(params []*Value, v *VM) []*Value {
+		loads++
+		return values("module " + params[0].String())
+	})
+	pkg.Get(str("preload")).Val.(*Table).Set(str("mod"), loader)
+	for l1 := 0; l1 < 2; l1++ {
+		r, err := vm.PCall(require, values("mod"))
+		if err != nil || r[0].String() != "module mod" {
+			t.Errorf("require(\"mod\") = %v, %v", r, err)
+		}
+	}
+	if loads != 1 {
+		t.Errorf("the loader ran %d times, want once", loads)
+	}
+	if got := vm.Call(require, values("string"))[0]; got.Val != vm.G.Get(str("string")).Val {
+		t.Error("require(\"string\") is not the string library")
+	}
+
+	// A loader that returns nothing leaves true in package.loaded.
+	pkg.Get(str("preload")).Val.(*Table).Set(str("quiet"), NewGoFunction(func(params []*Value, v *VM) []*Value {
+		return nil
+	}))
+	if r := vm.Call(require, values("quiet")); r[0].Type != BOOLEAN || !truthy(r[0]) {
+		t.Errorf("require(\"quiet\") = %v, want true", r[0])
+	}
+
+	pkg.SetString("path", "./testdata/?.none;./missing/?.none")
+	_, err := vm.PCall(require, values("a.b"))
+	if err == nil || !strings.Contains(err.Error(), "module 'a.b' not found:") ||
+		!strings.Contains(err.Error(), "no field package.preload['a.b']") ||
+		!strings.Contains(err.Error(), "no file './missing/a/b.none'") {
+		t.Errorf("require of a missing module: got %v", err)
+	}
+}
@@ -0,0 +1,398 @@
+package LuaVM
+
+// Lua pattern matching, as lstrlib.c implements it for string.find,
+// string.match, string.gmatch and string.gsub. Positions are byte offsets
+// into the subject or the pattern, and -1 stands for no match.
+
+// maxCaptures is how many captures a pattern may have, as LUA_MAXCAPTURES.
+const maxCaptures = 32
+
+// maxMatchCalls bounds how deeply matching may recurse, so that a pattern
+// cannot exhaust the Go stack.
+const maxMatchCalls = 200
+
+// patternSpecials are the characters that make a pattern more than a plain
+// substring for string.find.
+const patternSpecials = "^$*+?.([%-"
+
+const (
+	capUnfinished = -1
+	capPosition   = -2
+)
+
+type capture struct {
+	init int
+	len  int
+}
+
+// matchState holds a subject, a pattern and the captures of the match in
+// progress.
+type matchState struct {
+	v       *VM
+	src     string
+	pat     string
+	level   int
+	depth   int
+	capture [maxCaptures]capture
+}
+
+func newMatchState(v *VM, src string, pat string) *matchState {
+	return &matchState{v: v, src: src, pat: pat}
+}
+
+// classEnd returns the position just past the single character class that
+// starts at p.
+func (ms *matchState) classEnd(p int) int {
+	c := ms.pat[p]
+	p++
+	switch c {
+	case '%':
+		if p >= len(ms.pat) {
+			ms.v.Error("malformed pattern (ends with '%%')")
+		}
+		return p + 1
+	case '[':
+		if p < len(ms.pat) && ms.pat[p] == '^' {
+			p++
+		}
+		// The first character of a set is never its end, so "[]]" is a set.
+		for {
+			if p >= len(ms.pat) {
+				ms.v.Error("malformed pattern (missing ']')")
+			}
+			c := ms.pat[p]
+			p++
+			if c == '%' && p < len(ms.pat) {
+				p++
+			}
+			if p < len(ms.pat) && ms.pat[p] == ']' {
+				return p + 1
+			}
+		}
+	}
+	return p
+}
+
+func isAlpha(c byte) bool  { return isLower(c) || isUpper(c) }
+func isLower(c byte) bool  { return 'a' <= c && c <= 'z' }
+func isUpper(c byte) bool  { return 'A' <= c && c <= 'Z' }
+func isDigit(c byte) bool  { return '0' <= c && c <= '9' }
+func isAlnum(c byte) bool  { return isAlpha(c) || isDigit(c) }
+func isCntrl(c byte) bool  { return c < ' ' || c == 0x7f }
+func isPunct(c byte) bool  { return '!' <= c && c <= '~' && !isAlnum(c) }
+func isSpace(c byte) bool  { return c == ' ' || '\t' <= c && c <= '\r' }
+func isXDigit(c byte) bool { return isDigit(c) || 'a' <= c|0x20 && c|0x20 <= 'f' }
+
+// matchClass reports whether c is in the class named by cl, the letter after
+// a '%'. Any other character stands for itself.
+func matchClass(c byte, cl byte) bool {
+	var res bool
+	switch cl | 0x20 {
+	case 'a':
+		res = isAlpha(c)
+	case 'c':
+		res = isCntrl(c)
+	case 'd':
+		res = isDigit(c)
+	case 'l':
+		res = isLower(c)
+	case 'p':
+		res = isPunct(c)
+	case 's':
+		res = isSpace(c)
+	case 'u':
+		res = isUpper(c)
+	case 'w':
+		res = isAlnum(c)
+	case 'x':
+		res = isXDigit(c)
+	case 'z':
+		res = c == 0
+	default:
+		return cl == c
+	}
+	if isUpper(cl) {
+		return !res
+	}
+	return res
+}
+
+// matchBracketClass reports whether c is in the set that runs from the '['
+// at p to the ']' at ec.
+func (ms *matchState) matchBracketClass(c byte, p int, ec int) bool {
+	sig := true
+	if ms.pat[p+1] == '^' {
+		sig = false
+		p++
+	}
+	for p++; p < ec; p++ {
+		switch {
+		case ms.pat[p] == '%':
+			p++
+			if matchClass(c, ms.pat[p]) {
+				return sig
+			}
+		case ms.pat[p+1] == '-' && p+2 < ec:
+			p += 2
+			if ms.pat[p-2] <= c && c <= ms.pat[p] {
+				return sig
+			}
+		case ms.pat[p] == c:
+			return sig
+		}
+	}
+	return !sig
+}
+
+// singleMatch reports whether the subject has a character at s and it is in
+// the class from p to ep.
+func (ms *matchState) singleMatch(s int, p int, ep int) bool {
+	if s >= len(ms.src) {
+		return false
+	}
+	c := ms.src[s]
+	switch ms.pat[p] {
+	case '.':
+		return true
+	case '%':
+		return matchClass(c, ms.pat[p+1])
+	case '[':
+		return ms.matchBracketClass(c, p, ep-1)
+	}
+	return ms.pat[p] == c
+}
+
+// match matches the pattern from p against the subject from s, and returns
+// where the match ends.
+func (ms *matchState) match(s int, p int) int {
+	ms.depth++
+	if ms.depth > maxMatchCalls {
+		ms.v.Error("pattern too complex")
+	}
+	ms.v.charge(1)
+	s = ms.doMatch(s, p)
+	ms.depth--
+	return s
+}
+
+func (ms *matchState) doMatch(s int, p int) int {
+	for p < len(ms.pat) {
+		switch ms.pat[p] {
+		case '(':
+			if p+1 < len(ms.pat) && ms.pat[p+1] == ')' {
+				return ms.startCapture(s, p+2, capPosition)
+			}
+			return ms.startCapture(s, p+1, capUnfinished)
+		case ')':
+			return ms.endCapture(s, p+1)
+		case '%':
+			if p+1 >= len(ms.pat) {
+				break
+			}
+			switch c := ms.pat[p+1]; {
+			case c == 'b':
+				if s = ms.matchBalance(s, p+2); s == -1 {
+					return -1
+				}
+				p += 4
+				continue
+			case c == 'f':
+				p += 2
+				if p >= len(ms.pat) || ms.pat[p] != '[' {
+					ms.v.Error("missing '[' after '%%f' in pattern")
+				}
+				ep := ms.classEnd(p)
+				var prev, cur byte
+				if s > 0 {
+					prev = ms.src[s-1]
+				}
+				if s < len(ms.src) {
+					cur = ms.src[s]
+				}
+				if ms.matchBracketClass(prev, p, ep-1) || !ms.matchBracketClass(cur, p, ep-1) {
+					return -1
+				}
+				p = ep
+				continue
+			case isDigit(c):
+				if s = ms.matchCapture(s, c); s == -1 {
+					return -1
+				}
+				p += 2
+				continue
+			}
+		case '$':
+			if p+1 == len(ms.pat) {
+				if s == len(ms.src) {
+					return s
+				}
+				return -1
+			}
+		}
+
+		ep := ms.classEnd(p)
+		m := ms.singleMatch(s, p, ep)
+		if ep < len(ms.pat) {
+			switch ms.pat[ep] {
+			case '?':
+				if m {
+					if r := ms.match(s+1, ep+1); r != -1 {
+						return r
+					}
+				}
+				p = ep + 1
+				continue
+			case '*':
+				return ms.maxExpand(s, p, ep)
+			case '+':
+				if !m {
+					return -1
+				}
+				return ms.maxExpand(s+1, p, ep)
+			case '-':
+				return ms.minExpand(s, p, ep)
+			}
+		}
+		if !m {
+			return -1
+		}
+		s++
+		p = ep
+	}
+	return s
+}
+
+func (ms *matchState) maxExpand(s int, p int, ep int) int {
+	i := 0
+	for ms.singleMatch(s+i, p, ep) {
+		i++
+	}
+	ms.v.charge(i)
+	for ; i >= 0; i-- {
+		if r := ms.match(s+i, ep+1); r != -1 {
+			return r
+		}
+	}
+	return -1
+}
+
+func (ms *matchState) minExpand(s int, p int, ep int) int {
+	for {
+		if r := ms.match(s, ep+1); r != -1 {
+			return r
+		}
+		if !ms.singleMatch(s, p, ep) {
+			return -1
+		}
+		s++
+	}
+}
+
+func (ms *matchState) startCapture(s int, p int, what int) int {
+	if ms.level >= maxCaptures {
+		ms.v.Error("too many captures")
+	}
+	ms.capture[ms.level] = capture{init: s, len: what}
+	ms.level++
+	r := ms.match(s, p)
+	if r == -1 {
+		ms.level--
+	}
+	return r
+}
+
+func (ms *matchState) endCapture(s int, p int) int {
+	l := ms.captureToClose()
+	ms.capture[l].len = s - ms.capture[l].init
+	r := ms.match(s, p)
+	if r == -1 {
+		ms.capture[l].len = capUnfinished
+	}
+	return r
+}
+
+func (ms *matchState) captureToClose() int {
+	for l := ms.level - 1; l >= 0; l-- {
+		if ms.capture[l].len == capUnfinished {
+			return l
+		}
+	}
+	ms.v.Error("invalid pattern capture")
+	return 0
+}
+
+// matchBalance matches %bxy, where x and y are the two characters at p.
+func (ms *matchState) matchBalance(s int, p int) int {
+	if p+1 >= len(ms.pat) {
+		ms.v.Error("malformed pattern (missing arguments to '%%b')")
+	}
+	if s >= len(ms.src) || ms.src[s] != ms.pat[p] {
+		return -1
+	}
+	b, e := ms.pat[p], ms.pat[p+1]
+	cont := 1
+	for l1 := s + 1; l1 < len(ms.src); l1++ {
+		if ms.src[l1] == e {
+			if cont--; cont == 0 {
+				ms.v.charge(l1 - s)
+				return l1 + 1
+			}
+		} else if ms.src[l1] == b {
+			cont++
+		}
+	}
+	ms.v.charge(len(ms.src) - s)
+	return -1
+}
+
+// matchCapture matches a back reference to the capture numbered by the digit
+// l.
+func (ms *matchState) matchCapture(s int, l byte) int {
+	c := ms.capture[ms.checkCapture(l)]
+	if len(ms.src)-s >= c.len && ms.src[c.init:c.init+c.len] == ms.src[s:s+c.len] {
+		return s + c.len
+	}
+	return -1
+}
+
+func (ms *matchState) checkCapture(l byte) int {
+	n := int(l) - '1'
+	// A position capture has no text to match again.
+	if n < 0 || n >= ms.level || ms.capture[n].len < 0 {
+		ms.v.Error("invalid capture index")
+	}
+	return n
+}
+
+// getCapture returns capture i of the match from s to e. A pattern without
+// captures has the whole match as its only one.
+func (ms *matchState) getCapture(i int, s int, e int) *Value {
+	if i >= ms.level {
+		if i != 0 {
+			ms.v.Error("invalid capture index")
+		}
+		return NewString(ms.src[s:e])
+	}
+	c := ms.capture[i]
+	switch c.len {
+	case capUnfinished:
+		ms.v.Error("unfinished capture")
+	case capPosition:
+		return NewNumber(float64(c.init + 1))
+	}
+	return NewString(ms.src[c.init : c.init+c.len])
+}
+
+// captures returns the captures of the match from s to e, or of the last
+// match if s is -1, in which case a pattern without captures has none.
+func (ms *matchState) captures(s int, e int) []*Value {
+	n := ms.level
+	if n == 0 && s != -1 {
+		n = 1
+	}
+	ret := make([]*Value, n)
+	for l1 := range ret {
+		ret[l1] = ms.getCapture(l1, s, e)
+	}
+	return ret
+}
@@ -0,0 +1,360 @@
+package LuaVM
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+func openString(v *VM) *Table {
+	t := NewTable()
+	t.SetFunc("len", str_len)
+	t.SetFunc("sub", str_sub)
+	t.SetFunc("upper", str_upper)
+	t.SetFunc("lower", str_lower)
+	t.SetFunc("rep", str_rep)
+	t.SetFunc("reverse", str_reverse)
+	t.SetFunc("byte", str_byte)
+	t.SetFunc("char", str_char)
+	t.SetFunc("format", str_format)
+	t.SetFunc("find", str_find)
+	t.SetFunc("match", str_match)
+	t.SetFunc("gmatch", str_gmatch)
+	t.SetFunc("gsub", str_gsub)
+	v.stringMeta = NewTable()
+	v.stringMeta.SetTable("__index", t)
+	return t
+}
+
+// strRange converts Lua's 1-based, possibly negative, inclusive string
+// indices into a Go slice range.
+func strRange(l int, i int, j int) (int, int) {
+	if i < 0 {
+		i = l + i + 1
+	}
+	if j < 0 {
+		j = l + j + 1
+	}
+	if i < 1 {
+		i = 1
+	}
+	if j > l {
+		j = l
+	}
+	if i > j {
+		return 0, 0
+	}
+	return i - 1, j
+}
+
+func str_len(params []*Value, v *VM) []*Value {
+	s := v.checkString(params, 1, "len")
+	return []*Value{NewNumber(float64(len(s)))}
+}
+
+func str_sub(params []*Value, v *VM) []*Value {
+	s := v.checkString(params, 1, "sub")
+	i, j := strRange(len(s), v.optInt(params, 2, "sub", 1), v.optInt(params, 3, "sub", -1))
+	return []*Value{NewString(s[i:j])}
+}
+
+func str_upper(params []*Value, v *VM) []*Value {
+	return []*Value{NewString(strings.ToUpper(v.checkString(params, 1, "upper")))}
+}
+
+func str_lower(params []*Value, v *VM) []*Value {
+	return []*Value{NewString(strings.ToLower(v.checkString(params, 1, "lower")))}
+}
+
+func str_rep(params []*Value, v *VM) []*Value {
+	s := v.checkString(params, 1, "rep")
+	n := math.Trunc(float64(v.checkNumber(params, 2, "rep")))
+	if n <= 0 || s == "" {
+		return []*Value{NewString("")}
+	}
+	v.checkStringSize(float64(len(s)) * n)
+	return []*Value{NewString(strings.Repeat(s, int(n)))}
+}
+
+func str_reverse(params []*Value, v *VM) []*Value {
+	s := []byte(v.checkString(params, 1, "reverse"))
+	for l1, l2 := 0, len(s)-1; l1 < l2; l1, l2 = l1+1, l2-1 {
+		s[l1], s[l2] = s[l2], s[l1]
+	}
+	return []*Value{NewString(string(s))}
+}
+
+func str_byte(params []*Value, v *VM) []*Value {
+	s := v.checkString(params, 1, "byte")
+	i := v.optInt(params, 2, "byte", 1)
+	i, j := strRange(len(s), i, v.optInt(params, 3, "byte", i))
+	ret := make([]*Value, 0, j-i)
+	for _, c := range []byte(s[i:j]) {
+		ret = append(ret, NewNumber(float64(c)))
+	}
+	return ret
+}
+
+func str_char(params []*Value, v *VM) []*Value {
+	b := make([]byte, len(params))
+	for k := range params {
+		c := v.checkInt(params, k+1, "char")
+		if c < 0 || c > 255 {
+			v.argError(k+1, "char", "invalid value")
+		}
+		b[k] = byte(c)
+	}
+	return []*Value{NewString(string(b))}
+}
+
+func str_format(params []*Value, v *VM) []*Value {
+	format := v.checkString(params, 1, "format")
+	var b strings.Builder
+	n := 1
+	for l1 := 0; l1 < len(format); l1++ {
+		c := format[l1]
+		if c != '%' {
+			b.WriteByte(c)
+			continue
+		}
+		l1++
+		if l1 < len(format) && format[l1] == '%' {
+			b.WriteByte('%')
+			continue
+		}
+		start := l1
+		for l1 < len(format) && strings.IndexByte("-+ #0123456789.", format[l1]) >= 0 {
+			l1++
+		}
+		if l1 >= len(format) {
+			v.Error("invalid option to 'format'")
+		}
+		spec := "%" + format[start:l1]
+		n++
+		switch conv := format[l1]; conv {
+		case 'd', 'i':
+			fmt.Fprintf(&b, spec+"d", int64(v.checkNumber(params, n, "format")))
+		case 'o', 'x', 'X':
+			fmt.Fprintf(&b, spec+string(conv), int64(v.checkNumber(params, n, "format")))
+		case 'u':
+			fmt.Fprintf(&b, spec+"d", uint64(v.checkNumber(params, n, "format")))
+		case 'c':
+			b.WriteByte(byte(v.checkNumber(params, n, "format")))
+		case 'e', 'E', 'f', 'g', 'G':
+			formatFloat(&b, spec, conv, float64(v.checkNumber(params, n, "format")))
+		case 'q':
+			quoteString(&b, v.checkString(params, n, "format"))
+		case 's':
+			fmt.Fprintf(&b, spec+"s", v.checkString(params, n, "format"))
+		default:
+			v.Error("invalid option '%%%c' to 'format'", conv)
+		}
+	}
+	return []*Value{NewString(b.String())}
+}
+
+// posrelat converts a possibly negative string position into a 1-based one,
+// or 0 if it lies before the start of the string.
+func posrelat(pos int, l int) int {
+	if pos < 0 {
+		pos += l + 1
+	}
+	return max(pos, 0)
+}
+
+func str_find(params []*Value, v *VM) []*Value {
+	return strFind(params, v, "find")
+}
+
+func str_match(params []*Value, v *VM) []*Value {
+	return strFind(params, v, "match")
+}
+
+// strFind implements string.find and string.match, which differ only in
+// what they return for a match.
+func strFind(params []*Value, v *VM, fname string) []*Value {
+	s := v.checkString(params, 1, fname)
+	pat := v.checkString(params, 2, fname)
+	init := min(posrelat(v.optInt(params, 3, fname, 1), len(s))-1, len(s))
+	init = max(init, 0)
+	find := fname == "find"
+	if find && (truthy(arg(params, 4)) || !strings.ContainsAny(pat, patternSpecials)) {
+		if i := strings.Index(s[init:], pat); i >= 0 {
+			return []*Value{NewNumber(float64(init + i + 1)), NewNumber(float64(init + i + len(pat)))}
+		}
+		return []*Value{NewNil()}
+	}
+	anchor := strings.HasPrefix(pat, "^")
+	if anchor {
+		pat = pat[1:]
+	}
+	ms := newMatchState(v, s, pat)
+	for s1 := init; ; s1++ {
+		ms.level = 0
+		if e := ms.match(s1, 0); e != -1 {
+			if find {
+				return append([]*Value{NewNumber(float64(s1 + 1)), NewNumber(float64(e))}, ms.captures(-1, -1)...)
+			}
+			return ms.captures(s1, e)
+		}
+		if anchor || s1 >= len(s) {
+			return []*Value{NewNil()}
+		}
+	}
+}
+
+func str_gmatch(params []*Value, v *VM) []*Value {
+	s := v.checkString(params, 1, "gmatch")
+	ms := newMatchState(v, s, v.checkString(params, 2, "gmatch"))
+	src := 0
+	return []*Value{NewGoFunction(func(params []*Value, v *VM) []*Value {
+		for ; src <= len(s); src++ {
+			ms.level = 0
+			if e := ms.match(src, 0); e != -1 {
+				start := src
+				// An empty match moves on a character, so as not to match
+				// at the same place again.
+				src = max(e, src+1)
+				return ms.captures(start, e)
+			}
+		}
+		return nil
+	})}
+}
+
+func str_gsub(params []*Value, v *VM) []*Value {
+	src := v.checkString(params, 1, "gsub")
+	pat := v.checkString(params, 2, "gsub")
+	repl := arg(params, 3)
+	switch repl.Type {
+	case NUMBER, STRING, TABLE, CLOSURE, GOFUNCTION:
+	default:
+		v.typeError(params, 3, "gsub", "string/function/table")
+	}
+	maxN := v.optInt(params, 4, "gsub", len(src)+1)
+	anchor := strings.HasPrefix(pat, "^")
+	if anchor {
+		pat = pat[1:]
+	}
+	ms := newMatchState(v, src, pat)
+	var b strings.Builder
+	n, s := 0, 0
+	for n < maxN {
+		ms.level = 0
+		e := ms.match(s, 0)
+		if e != -1 {
+			n++
+			ms.addValue(&b, s, e, repl)
+		}
+		switch {
+		case e != -1 && e > s:
+			s = e
+		case s < len(src):
+			b.WriteByte(src[s])
+			s++
+		default:
+			maxN = n
+		}
+		v.checkStringSize(float64(b.Len()))
+		if anchor {
+			break
+		}
+	}
+	b.WriteString(src[s:])
+	v.checkStringSize(float64(b.Len()))
+	return []*Value{NewString(b.String()), NewNumber(float64(n))}
+}
+
+// addValue writes the replacement for the match from s to e.
+func (ms *matchState) addValue(b *strings.Builder, s int, e int, repl *Value) {
+	var val *Value
+	switch repl.Type {
+	case NUMBER, STRING:
+		news := repl.String()
+		for l1 := 0; l1 < len(news); l1++ {
+			c := news[l1]
+			if c != '%' || l1+1 == len(news) {
+				b.WriteByte(c)
+				continue
+			}
+			l1++
+			switch c = news[l1]; {
+			case c == '0':
+				b.WriteString(ms.src[s:e])
+			case isDigit(c):
+				capture := ms.getCapture(int(c-'1'), s, e)
+				b.WriteString(capture.String())
+			default:
+				b.WriteByte(c)
+			}
+		}
+		return
+	case TABLE:
+		res := ms.v.getTable(repl, ms.getCapture(0, s, e))
+		val = &res
+	default:
+		val = arg(ms.v.Call(repl, ms.captures(s, e)), 1)
+	}
+	switch val.Type {
+	case NIL:
+		b.WriteString(ms.src[s:e])
+	case BOOLEAN:
+		if truthy(val) {
+			ms.v.Error("invalid replacement value (a %s)", val.TypeName())
+		}
+		b.WriteString(ms.src[s:e])
+	case NUMBER, STRING:
+		b.WriteString(val.String())
+	default:
+		ms.v.Error("invalid replacement value (a %s)", val.TypeName())
+	}
+}
+
+// formatFloat writes f the way C's printf does for the conversion conv.
+// Go's %g defaults to the shortest representation rather than a precision
+// of 6, and Go spells infinities and NaN differently.
+func formatFloat(b *strings.Builder, spec string, conv byte, f float64) {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		flags := spec[1 : 1+len(spec[1:])-len(strings.TrimLeft(spec[1:], "-+ #0"))]
+		width, _, _ := strings.Cut(spec[1+len(flags):], ".")
+		s := numberToString(Number(f))
+		switch {
+		case f < 0:
+		case strings.Contains(flags, "+"):
+			s = "+" + s
+		case strings.Contains(flags, " "):
+			s = " " + s
+		}
+		if conv == 'E' || conv == 'G' {
+			s = strings.ToUpper(s)
+		}
+		if strings.Contains(flags, "-") {
+			width = "-" + width
+		}
+		fmt.Fprintf(b, "%"+width+"s", s)
+		return
+	}
+	if (conv == 'g' || conv == 'G') && !strings.Contains(spec, ".") {
+		spec += ".6"
+	}
+	fmt.Fprintf(b, spec+string(conv), f)
+}
+
+// quoteString writes s the way %q does, so that it reads back in Lua.
+func quoteString(b *strings.Builder, s string) {
+	b.WriteByte('"')
+	for l1 := 0; l1 < len(s); l1++ {
+		switch c := s[l1]; c {
+		case '"', '\\', '\n':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case '\r':
+			b.WriteString("\\r")
+		case 0:
+			b.WriteString("\\000")
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('"')
+}
@@ -0,0 +1,282 @@
+package LuaVM
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func stringFunc(vm *VM, name string) *Value {
+	return vm.G.Get(str("string")).Val.(*Table).Get(str(name))
+}
+
+func TestStringRep(t *testing.T) {
+	vm := NewVM(WithMaxStringSize(100))
+	rep := stringFunc(vm, "rep")
+	for _, test := range []struct {
+		s    string
+		n    float64
+		want string
+	}{
+		{"ab", 3, "ababab"},
+		{"ab", 2.9, "abab"},
+		{"ab", 0, ""},
+		{"ab", -1, ""},
+		{"", 1e300, ""},
+		{"x", 100, strings.Repeat("x", 100)},
+	} {
+		r, err := vm.PCall(rep, []*Value{NewString(test.s), NewNumber(test.n)})
+		if err != nil || r[0].String() != test.want {
+			t.Errorf("string.rep(%q, %v) = %v, %v, want %q", test.s, test.n, r, err, test.want)
+		}
+	}
+	for _, n := range []float64{101, 1 << 31, 1e300} {
+		if _, err := vm.PCall(rep, []*Value{NewString("x"), NewNumber(n)}); err == nil || err.Error() != "resulting string too large" {
+			t.Errorf("string.rep(\"x\", %v): got %v", n, err)
+		}
+	}
+}
+
+func TestConcatStringLimit(t *testing.T) {
+	vm := NewVM(WithMaxStringSize(10))
+	concat := vm.G.Get(str("table")).Val.(*Table).Get(str("concat"))
+	if _, err := vm.PCall(concat, []*Value{seq(NewString("aaaa"), NewString("bbbb")), NewString(",")}); err != nil {
+		t.Errorf("table.concat under the limit: %v", err)
+	}
+	if _, err := vm.PCall(concat, []*Value{seq(NewString("aaaa"), NewString("bbbb"), NewString("ccc"))}); err == nil || err.Error() != "resulting string too large" {
+		t.Errorf("table.concat over the limit: got %v", err)
+	}
+}
+
+// values converts Go strings, numbers and booleans to Lua values, and
+// anything else to nil.
+func values(vals ...any) []*Value {
+	ret := make([]*Value, len(vals))
+	for l1, val := range vals {
+		switch val := val.(type) {
+		case string:
+			ret[l1] = NewString(val)
+		case float64:
+			ret[l1] = NewNumber(val)
+		case int:
+			ret[l1] = NewNumber(float64(val))
+		case bool:
+			ret[l1] = NewBool(val)
+		default:
+			ret[l1] = NewNil()
+		}
+	}
+	return ret
+}
+
+func sameValues(a []*Value, b []*Value) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for l1 := range a {
+		if !rawEquals(a[l1], b[l1]) {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStringFindMatch(t *testing.T) {
+	vm := NewVM()
+	for _, test := range []struct {
+		fname string
+		args  []*Value
+		want  []*Value
+	}{
+		{"find", values("hello world", "wor"), values(7, 9)},
+		{"find", values("hello world", "o", 6), values(8, 8)},
+		{"find", values("hello", "l+"), values(3, 4)},
+		{"find", values("hello", "(h)(e)"), values(1, 2, "h", "e")},
+		{"find", values("a.b", ".", 1, true), values(2, 2)},
+		{"find", values("hello", "xyz"), values(nil)},
+		{"find", values("hello", "", 10), values(6, 5)},
+		{"find", values("hello", "^l"), values(nil)},
+		{"find", values("hello", "^h"), values(1, 1)},
+		{"find", values("abc", "c", -1), values(3, 3)},
+		{"find", values("abc", "b", -1), values(nil)},
+		{"match", values("key = value", "(%w+)%s*=%s*(%w+)"), values("key", "value")},
+		{"match", values("hello 123", "%d+"), values("123")},
+		{"match", values("  trim  ", "^%s*(.-)%s*$"), values("trim")},
+		{"match", values("hello", "()ll()"), values(3, 5)},
+		{"match", values("THE (quick) fox", "%((%a+)%)"), values("quick")},
+		{"match", values("f(a(b)c)d", "%b()"), values("(a(b)c)")},
+		{"match", values("hello world", "%f[%w]%w+", 2), values("world")},
+		{"match", values("abcabc", "(abc)%1"), values("abc")},
+		{"match", values("_x1=1", "[%a_][%w_]*"), values("_x1")},
+		{"match", values("a]b", "[]]"), values("]")},
+		{"match", values("2024-01-15", "(%d+)-(%d+)-(%d+)"), values("2024", "01", "15")},
+		{"match", values("hello", "[^aeiou]+"), values("h")},
+		{"match", values("hello", "l*"), values("")},
+		{"match", values("hello", "l-o"), values("llo")},
+		{"match", values("aaa", "a?a?a?a"), values("aaa")},
+		{"match", values("a+b", "[%+%-]"), values("+")},
+		{"match", values("x9", "[a-z][0-9]$"), values("x9")},
+		{"match", values("tab\there", "%c"), values("\t")},
+		{"match", values("a\x00b", "%z"), values("\x00")},
+		{"match", values("end$", "d$"), values(nil)},
+		{"match", values("end$", "d%$"), values("d$")},
+	} {
+		r, err := vm.PCall(stringFunc(vm, test.fname), test.args)
+		if err != nil || !sameValues(r, test.want) {
+			t.Errorf("string.%s%v = %v, %v, want %v", test.fname, test.args, r, err, test.want)
+		}
+	}
+}
+
+func TestStringGmatch(t *testing.T) {
+	vm := NewVM()
+	for _, test := range []struct {
+		s, pat string
+		want   []string
+	}{
+		{"one two  three", "%a+", []string{"one", "two", "three"}},
+		{"k1=v1, k2=v2", "(%w+)=(%w+)", []string{"k1", "v1", "k2", "v2"}},
+		{"abc", "", []string{"", "", "", ""}},
+		{"^a^a", "^a", []string{"^a", "^a"}},
+	} {
+		iter := vm.Call(stringFunc(vm, "gmatch"), values(test.s, test.pat))[0]
+		var got []string
+		for {
+			r := vm.Call(iter, nil)
+			if len(r) == 0 {
+				break
+			}
+			for _, c := range r {
+				got = append(got, c.String())
+			}
+		}
+		if strings.Join(got, ",") != strings.Join(test.want, ",") || len(got) != len(test.want) {
+			t.Errorf("string.gmatch(%q, %q) produced %q, want %q", test.s, test.pat, got, test.want)
+		}
+	}
+}
+
+func TestStringGsub(t *testing.T) {
+	vm := NewVM()
+	vars := NewTable()
+	vars.Set(str("name"), NewString("Bob"))
+	double := NewGoFunction(func(params []*Value, v *VM) []*Value {
+		return []*Value{NewNumber(float64(v.checkNumber(params, 1, "double")) * 2)}
+	})
+	keep := NewGoFunction(func(params []*Value, v *VM) []*Value {
+		return []*Value{NewBool(false)}
+	})
+	for _, test := range []struct {
+		args []*Value
+		want []*Value
+	}{
+		{values("hello world", "o", "0"), values("hell0 w0rld", 2)},
+		{values("hello world", "(%w+)", "<%1>"), values("<hello> <world>", 2)},
+		{values("hello world", "%w+", "%0 %0", 1), values("hello hello world", 1)},
+		{values("abc", "", "-"), values("-a-b-c-", 4)},
+		{values("hello", "^h", "H"), values("Hello", 1)},
+		{values("hello", "^", ">"), values(">hello", 1)},
+		{values("abc", "b", "%%"), values("a%c", 1)},
+		{values("abc", "b", 5), values("a5c", 1)},
+		{values("abc", "()b", "%1"), values("a2c", 1)},
+		{append(values("$name is $age", "%$(%w+)"), &Value{Type: TABLE, Val: vars}), values("Bob is $age", 2)},
+		{append(values("1 2 3", "%d"), double), values("2 4 6", 3)},
+		{append(values("1 2 3", "%d"), keep), values("1 2 3", 3)},
+	} {
+		r, err := vm.PCall(stringFunc(vm, "gsub"), test.args)
+		if err != nil || !sameValues(r, test.want) {
+			t.Errorf("string.gsub%v = %v, %v, want %v", test.args, r, err, test.want)
+		}
+	}
+
+	table := NewGoFunction(func(params []*Value, v *VM) []*Value {
+		return []*Value{{Type: TABLE, Val: NewTable()}}
+	})
+	for _, test := range []struct {
+		args []*Value
+		want string
+	}{
+		{values("abc", "%w", "%2"), "invalid capture index"},
+		{append(values("abc", "%w"), NewBool(true)), "bad argument #3 to 'gsub' (string/function/table expected, got boolean)"},
+		{append(values("abc", "%w"), table), "invalid replacement value (a table)"},
+	} {
+		if _, err := vm.PCall(stringFunc(vm, "gsub"), test.args); err == nil || err.Error() != test.want {
+			t.Errorf("string.gsub%v: got %v, want %q", test.args, err, test.want)
+		}
+	}
+}
+
+func TestPatternErrors(t *testing.T) {
+	vm := NewVM()
+	for _, test := range []struct {
+		s, pat string
+		want   string
+	}{
+		{"a", "%", "malformed pattern (ends with '%')"},
+		{"a", "[a", "malformed pattern (missing ']')"},
+		{"a", "(a", "unfinished capture"},
+		{"a", "a)", "invalid pattern capture"},
+		{"a", "%1", "invalid capture index"},
+		{"a", "%f", "missing '[' after '%f' in pattern"},
+		{"a", "%b(", "malformed pattern (missing arguments to '%b')"},
+		{"a", strings.Repeat("()", maxCaptures+1), "too many captures"},
+		{strings.Repeat("a", 300), strings.Repeat("a?", 300), "pattern too complex"},
+	} {
+		if _, err := vm.PCall(stringFunc(vm, "match"), values(test.s, test.pat)); err == nil || err.Error() != test.want {
+			t.Errorf("string.match(%q, %q): got %v, want %q", test.s, test.pat, err, test.want)
+		}
+	}
+}
+
+func TestBackReferenceToPosition(t *testing.T) {
+	vm := NewVM()
+	// A position capture has no text, so referring back to it is an error
+	// rather than a match against a negative length.
+	for _, pat := range []string{"()%1", "(a)()%2"} {
+		for _, fname := range []string{"find", "match", "gsub"} {
+			args := values("abc", pat)
+			if fname == "gsub" {
+				args = append(args, NewString("x"))
+			}
+			if _, err := vm.PCall(stringFunc(vm, fname), args); err == nil || err.Error() != "invalid capture index" {
+				t.Errorf("string.%s(\"abc\", %q): got %v", fname, pat, err)
+			}
+		}
+	}
+}
+
+func TestStringFormat(t *testing.T) {
+	vm := NewVM()
+	for _, test := range []struct {
+		format string
+		arg    any
+		want   string
+	}{
+		{"%g", 0.1, "0.1"},
+		{"%g", 1.0 / 3, "0.333333"},
+		{"%g", 100000.0, "100000"},
+		{"%g", 1e6, "1e+06"},
+		{"%g", 1e20, "1e+20"},
+		{"%G", 1e-10, "1E-10"},
+		{"%.3g", 2.0 / 3, "0.667"},
+		{"%10g", 1.5, "       1.5"},
+		{"%.14g", 0.1, "0.1"},
+		{"%e", 12345.678, "1.234568e+04"},
+		{"%.2f", 2.5, "2.50"},
+		{"%5.1f", math.Inf(1), "  inf"},
+		{"%-5g|", math.Inf(1), "inf  |"},
+		{"%+e", math.Inf(1), "+inf"},
+		{"%g", math.Inf(-1), "-inf"},
+		{"%G", math.Inf(1), "INF"},
+		{"%5d", 42.0, "   42"},
+		{"%x", 255.0, "ff"},
+		{"%5.2s", "abc", "   ab"},
+		{"%q", "a\nb\"c\"", `"a\
+b\"c\""`},
+	} {
+		r, err := vm.PCall(stringFunc(vm, "format"), values(test.format, test.arg))
+		if err != nil || r[0].String() != test.want {
+			t.Errorf("string.format(%q, %v) = %v, %v, want %q", test.format, test.arg, r, err, test.want)
+		}
+	}
+}
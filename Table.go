@@ -1,83 +1,448 @@
 package LuaVM
 
-import "math"
+import (
+	"math"
+	"reflect"
+)
 
+// A Table is split, as in the reference implementation, into an array part
+// holding the integer keys 1..ArraySize and a hash part holding the rest.
+// When a new key finds the hash part full, the table is rehashed: the array
+// part is resized to the largest power of two that would be more than half
+// full, and keys migrate between the parts to match.
+//
+// The hash part keeps its entries in insertion order, with Hash mapping
+// each key to its index in Entries, so that next can continue from any key
+// in constant time. Assigning nil to a field leaves its entry in place as a
+// dead entry, which keeps a traversal that clears fields valid as Lua
+// requires; dead entries are only dropped when the table is rehashed, and
+// until then they count toward the capacity of the hash part, so that
+// clearing old fields and setting new ones cannot grow it without bound.
 type Table struct {
-	Array     []*Value
-	Hash      map[Value]*Value
+	Array     []Value
+	Hash      map[Value]int
+	Entries   []HashEntry
 	ArraySize uint64
-	MaxN      uint64
 	Metatable *Table
+
+	dead    int
+	hashCap int
+	vm      *VM // owner of a metatable made by VM.NewMetatable
+}
+
+// HashEntry is a key/value pair in the hash part of a Table.
+type HashEntry struct {
+	Key Value
+	Val Value
 }
 
 //TODO: add metamethod support
 
 func NewTable() *Table {
+	return NewTableSize(0, 0)
+}
+
+// NewTableSize returns a table with room for narray array elements and
+// nhash other fields before it needs to be rehashed.
+func NewTableSize(narray int, nhash int) *Table {
 	t := &Table{}
-	t.ArraySize = 0
-	t.Hash = make(map[Value]*Value)
+	t.ArraySize = uint64(narray)
+	t.Array = make([]Value, narray)
+	t.Hash = make(map[Value]int, nhash)
+	t.hashCap = nhash
 	return t
 }
 
+// arrayIndex returns the array part index for key, or -1 if key does not
+// belong in the array part.
+func (t *Table) arrayIndex(key Value) int {
+	if key.Type != NUMBER {
+		return -1
+	}
+	n := float64(key.Num)
+	if n >= 1 && n <= float64(t.ArraySize) && math.Floor(n) == n {
+		return int(n) - 1
+	}
+	return -1
+}
+
+// normKey returns the form key is stored under: -0 is stored as 0 so that
+// both find the same field.
+func normKey(key Value) Value {
+	if key.Type == NUMBER && key.Num == 0 {
+		key.Num = 0
+	}
+	return key
+}
+
+// identityKey is what a light userdata is hashed under when its Go value
+// cannot be a map key: the type, and the address the slice, map or func
+// refers to, with a slice's length.
+type identityKey struct {
+	typ reflect.Type
+	ptr uintptr
+	len int
+}
+
+// hashKey returns the form key is looked up under in Hash, which is the
+// key itself unless identity says otherwise. A key that can be neither
+// compared nor identified raises a Lua error.
+func hashKey(key Value) Value {
+	id, ok := identity(&key)
+	if !ok {
+		throw("table index is not comparable")
+	}
+	key.Val = id
+	return key
+}
+
+// identity returns what val is compared and hashed by: its Go value, or an
+// identityKey for a light userdata, or a Go function not held in a
+// GoFunction, whose Go value cannot be compared. ok is false for a value
+// that can be neither compared nor identified, such as a struct holding a
+// slice.
+func identity(val *Value) (id interface{}, ok bool) {
+	if val.Type != LIGHTUSERDATA && val.Type != GOFUNCTION {
+		return val.Val, true
+	}
+	if _, held := val.Val.(*GoFunction); held {
+		return val.Val, true
+	}
+	rv := reflect.ValueOf(val.Val)
+	if !rv.IsValid() || rv.Comparable() {
+		return val.Val, true
+	}
+	switch rv.Kind() {
+	case reflect.Slice:
+		return identityKey{rv.Type(), rv.Pointer(), rv.Len()}, true
+	case reflect.Map, reflect.Func:
+		return identityKey{rv.Type(), rv.Pointer(), 0}, true
+	}
+	return nil, false
+}
+
+// Set sets t[key] to val. A nil or NaN key raises a Lua error.
 func (t *Table) Set(key Value, val *Value) {
-	if key.Type == NUMBER {
-		if math.Floor(float64(key.Val.(Number))) == float64(key.Val.(Number)) && uint64(key.Val.(Number)) < t.ArraySize {
-			t.Array[uint64(key.Val.(Number))] = val
-			t.CalcMaxN()
-			return
+	t.set(key, deref(val))
+}
+
+func (t *Table) set(key Value, val Value) {
+	key = normKey(key)
+	if key.Type == NIL {
+		throw("table index is nil")
+	}
+	if key.Type == NUMBER && key.Num != key.Num {
+		throw("table index is NaN")
+	}
+	if idx := t.arrayIndex(key); idx >= 0 {
+		t.Array[idx] = val
+		return
+	}
+	hk := hashKey(key)
+	if idx, ok := t.Hash[hk]; ok {
+		e := &t.Entries[idx]
+		if e.Val.Type == NIL && val.Type != NIL {
+			t.dead--
+		} else if e.Val.Type != NIL && val.Type == NIL {
+			t.dead++
 		}
+		e.Val = val
+		return
 	}
-	t.Hash[key] = val
+	if val.Type == NIL {
+		return
+	}
+	if len(t.Entries) >= t.hashCap {
+		t.rehash(key)
+		t.set(key, val)
+		return
+	}
+	t.Hash[hk] = len(t.Entries)
+	t.Entries = append(t.Entries, HashEntry{Key: key, Val: val})
 }
 
+// Get returns a copy of t[key].
 func (t *Table) Get(key Value) *Value {
-	if key.Type == NUMBER {
-		if math.Floor(float64(key.Val.(Number))) == float64(key.Val.(Number)) && uint64(key.Val.(Number)) < t.ArraySize {
-			return t.Array[uint64(key.Val.(Number))]
+	val := t.get(key)
+	return &val
+}
+
+func (t *Table) get(key Value) Value {
+	key = normKey(key)
+	if idx := t.arrayIndex(key); idx >= 0 {
+		return t.Array[idx]
+	}
+	if idx, ok := t.Hash[hashKey(key)]; ok {
+		return t.Entries[idx].Val
+	}
+	return Value{}
+}
+
+// GetInt returns a copy of t[i].
+func (t *Table) GetInt(i int) *Value {
+	val := t.getInt(i)
+	return &val
+}
+
+func (t *Table) getInt(i int) Value {
+	if i >= 1 && uint64(i) <= t.ArraySize {
+		return t.Array[i-1]
+	}
+	return t.get(Value{Type: NUMBER, Num: Number(i)})
+}
+
+// SetInt sets t[i] to val.
+func (t *Table) SetInt(i int, val *Value) {
+	t.set(Value{Type: NUMBER, Num: Number(i)}, deref(val))
+}
+
+// maxBits bounds the array part at 2^maxBits elements.
+const maxBits = 26
+
+// countInt adds key to nums, the histogram of integer keys by power-of-two
+// slice, if it is a candidate for the array part.
+func countInt(key Value, nums *[maxBits + 1]int) bool {
+	if key.Type != NUMBER {
+		return false
+	}
+	n := float64(key.Num)
+	if n < 1 || n > 1<<maxBits || math.Floor(n) != n {
+		return false
+	}
+	nums[ceilLog2(uint64(n))]++
+	return true
+}
+
+// ceilLog2 returns the smallest b with 1<<b >= x.
+func ceilLog2(x uint64) int {
+	b := 0
+	for uint64(1)<<b < x {
+		b++
+	}
+	return b
+}
+
+// computeSizes picks the largest power of two n such that more than half of
+// the slots 1..n would be in use, given nums and the number of integer
+// keys na. It returns n and how many keys would move into the array part.
+func computeSizes(nums *[maxBits + 1]int, na int) (int, int) {
+	a := 0
+	inArray := 0
+	n := 0
+	for l1, twotoi := 0, 1; l1 <= maxBits && twotoi/2 < na; l1, twotoi = l1+1, twotoi*2 {
+		if nums[l1] > 0 {
+			a += nums[l1]
+			if a > twotoi/2 {
+				n = twotoi
+				inArray = a
+			}
+		}
+		if a == na {
+			break
 		}
 	}
+	return n, inArray
+}
 
-	v, ok := t.Hash[key]
-	if !ok {
-		v = &Value{Type: NIL}
+// rehash resizes both parts of t to fit its live keys plus extra.
+func (t *Table) rehash(extra Value) {
+	var nums [maxBits + 1]int
+	na := 0
+	total := 1
+	if countInt(extra, &nums) {
+		na++
+	}
+	for l1, v := range t.Array {
+		if v.Type != NIL {
+			nums[ceilLog2(uint64(l1+1))]++
+			na++
+			total++
+		}
 	}
-	return v
+	for _, e := range t.Entries {
+		if e.Val.Type != NIL {
+			if countInt(e.Key, &nums) {
+				na++
+			}
+			total++
+		}
+	}
+	narray, inArray := computeSizes(&nums, na)
+	t.resize(narray, total-inArray)
 }
 
-func (t *Table) CalcMaxN() {
-	for k, v := range t.Array {
-		if v == nil || v.Type == NIL {
-			t.MaxN = uint64(k - 1)
-			return
+func (t *Table) resize(narray int, nhash int) {
+	oldArray := t.Array
+	oldEntries := t.Entries
+	hashCap := 1
+	for hashCap < nhash {
+		hashCap <<= 1
+	}
+	if nhash == 0 {
+		hashCap = 0
+	}
+	t.Array = make([]Value, narray)
+	copy(t.Array, oldArray)
+	t.ArraySize = uint64(narray)
+	t.Hash = make(map[Value]int, hashCap)
+	t.Entries = make([]HashEntry, 0, hashCap)
+	t.hashCap = hashCap
+	t.dead = 0
+	for l1 := narray; l1 < len(oldArray); l1++ {
+		if v := oldArray[l1]; v.Type != NIL {
+			t.insertHash(Value{Type: NUMBER, Num: Number(l1 + 1)}, v)
 		}
 	}
-	t.MaxN = uint64(len(t.Array))
+	for _, e := range oldEntries {
+		if e.Val.Type == NIL {
+			continue
+		}
+		if idx := t.arrayIndex(e.Key); idx >= 0 {
+			t.Array[idx] = e.Val
+		} else {
+			t.insertHash(e.Key, e.Val)
+		}
+	}
+}
+
+// insertHash appends a new entry to the hash part without checking its
+// capacity.
+func (t *Table) insertHash(key Value, val Value) {
+	t.Hash[hashKey(key)] = len(t.Entries)
+	t.Entries = append(t.Entries, HashEntry{Key: key, Val: val})
+}
+
+// border returns an n such that t[n] is non-nil and t[n+1] is nil, or 0 if
+// t[1] is nil. It binary searches the array part if it ends in nil, and
+// otherwise probes the hash part with doubling steps before searching.
+func (t *Table) border() int {
+	j := int(t.ArraySize)
+	if j > 0 && t.Array[j-1].Type == NIL {
+		i := 0
+		for j-i > 1 {
+			m := (i + j) / 2
+			if t.Array[m-1].Type == NIL {
+				j = m
+			} else {
+				i = m
+			}
+		}
+		return i
+	}
+	if len(t.Entries) == t.dead {
+		return j
+	}
+	i := j
+	j++
+	for t.getInt(j).Type != NIL {
+		i = j
+		if j > math.MaxInt32/2 {
+			// Built to defeat the search: fall back to a linear scan.
+			i = 1
+			for t.getInt(i).Type != NIL {
+				i++
+			}
+			return i - 1
+		}
+		j *= 2
+	}
+	for j-i > 1 {
+		m := (i + j) / 2
+		if t.getInt(m).Type == NIL {
+			j = m
+		} else {
+			i = m
+		}
+	}
+	return i
+}
+
+// Next returns the entry following key in a traversal of t: the array part
+// in index order, then the hash part in insertion order. A nil key starts
+// the traversal and a nil returned key ends it. ok is false if key is not
+// in t.
+func (t *Table) Next(key Value) (k Value, val *Value, ok bool) {
+	key = normKey(key)
+	l1 := 0
+	if idx := t.arrayIndex(key); idx >= 0 || key.Type == NIL {
+		for l1 = idx + 1; l1 < len(t.Array); l1++ {
+			if val := t.Array[l1]; val.Type != NIL {
+				return Value{Type: NUMBER, Num: Number(l1 + 1)}, &val, true
+			}
+		}
+		l1 = 0
+	} else {
+		idx, found := t.Hash[hashKey(key)]
+		if !found {
+			return Value{Type: NIL}, nil, false
+		}
+		l1 = idx + 1
+	}
+	for ; l1 < len(t.Entries); l1++ {
+		if e := t.Entries[l1]; e.Val.Type != NIL {
+			return e.Key, &e.Val, true
+		}
+	}
+	return Value{Type: NIL}, &Value{Type: NIL}, true
 }
 
 func getmetatable(params []*Value, v *VM) []*Value {
-	t := params[0].Val.(*Table)
-	if t.Metatable == nil {
+	mt := v.getMetatable(v.checkAny(params, 1, "getmetatable"))
+	if mt == nil {
 		return []*Value{{Type: NIL}}
 	}
-	return []*Value{{Type: TABLE, Val: t}}
+	if protected := mt.Get(Value{Type: STRING, Val: "__metatable"}); protected.Type != NIL {
+		return []*Value{protected}
+	}
+	return []*Value{{Type: TABLE, Val: mt}}
 }
 
 func setmetatable(params []*Value, v *VM) []*Value {
-	t := params[0].Val.(*Table)
-	t.Metatable = params[1].Val.(*Table)
-	return nil
+	t := v.checkTable(params, 1, "setmetatable")
+	mt := arg(params, 2)
+	if mt.Type != NIL && mt.Type != TABLE {
+		v.typeError(params, 2, "setmetatable", "nil or table")
+	}
+	if t.Metatable != nil && t.Metatable.Get(Value{Type: STRING, Val: "__metatable"}).Type != NIL {
+		v.Error("cannot change a protected metatable")
+	}
+	if mt.Type == NIL {
+		v.SetMetatable(params[0], nil)
+	} else {
+		v.SetMetatable(params[0], mt.Val.(*Table))
+	}
+	return params[:1]
+}
+
+// SetMetatable sets the metatable of obj. If mt has a __gc field at this
+// point, obj is registered to have it called once obj becomes unreachable.
+func (v *VM) SetMetatable(obj *Value, mt *Table) {
+	switch obj.Type {
+	case TABLE:
+		obj.Val.(*Table).Metatable = mt
+	case USERDATA:
+		obj.Val.(*UserData).Metatable = mt
+	default:
+		v.Error("cannot set the metatable of a %s value", obj.TypeName())
+	}
+	if mt != nil && mt.Get(Value{Type: STRING, Val: "__gc"}).Type != NIL {
+		v.registerFinalizer(obj)
+	}
 }
 
+// Len returns #t, a border of t as defined by the Lua 5.1 manual: any n
+// with t[n] non-nil and t[n+1] nil, or 0 if t[1] is nil. When t has holes
+// any of its borders may be returned.
 func (t *Table) Len() *Value {
-	return &Value{Type: NUMBER, Val: float64(t.MaxN)}
+	return &Value{Type: NUMBER, Num: Number(t.border())}
 }
 
 func (t *Table) SetFunc(name string, function GOFUNC) {
-	t.Set(Value{Type: STRING, Val: name}, &Value{Type: GOFUNCTION, Val: function})
+	t.Set(Value{Type: STRING, Val: name}, NewGoFunction(function))
 }
 
 func (t *Table) SetNumber(name string, number float64) {
-	t.Set(Value{Type: STRING, Val: name}, &Value{Type: NUMBER, Val: Number(number)})
+	t.Set(Value{Type: STRING, Val: name}, &Value{Type: NUMBER, Num: Number(number)})
 }
 
 func (t *Table) SetString(name string, str string) {
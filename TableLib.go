@@ -0,0 +1,270 @@
+package LuaVM
+
+import (
+	"math"
+	"strings"
+)
+
+func openTable(v *VM) *Table {
+	t := NewTable()
+	t.SetFunc("concat", tab_concat)
+	t.SetFunc("foreach", tab_foreach)
+	t.SetFunc("foreachi", tab_foreachi)
+	t.SetFunc("getn", tab_getn)
+	t.SetFunc("insert", tab_insert)
+	t.SetFunc("maxn", tab_maxn)
+	t.SetFunc("remove", tab_remove)
+	t.SetFunc("setn", tab_setn)
+	t.SetFunc("sort", tab_sort)
+	t.SetFunc("unpack", tab_unpack)
+	return t
+}
+
+func tab_concat(params []*Value, v *VM) []*Value {
+	t := v.checkTable(params, 1, "concat")
+	sep := v.optString(params, 2, "concat", "")
+	i := v.optInt(params, 3, "concat", 1)
+	j := v.optInt(params, 4, "concat", 0)
+	if arg(params, 4).Type == NIL {
+		j = t.border()
+	}
+	var b strings.Builder
+	for l1 := i; l1 <= j; l1++ {
+		v.charge(1)
+		val := t.GetInt(l1)
+		if val.Type != STRING && val.Type != NUMBER {
+			v.Error("invalid value (at index %d) in table for 'concat'", l1)
+		}
+		b.WriteString(val.String())
+		if l1 != j {
+			b.WriteString(sep)
+		}
+		v.checkStringSize(float64(b.Len()))
+	}
+	return []*Value{NewString(b.String())}
+}
+
+func tab_foreach(params []*Value, v *VM) []*Value {
+	t := v.checkTable(params, 1, "foreach")
+	f := v.checkFunction(params, 2, "foreach")
+	for k, val := range t.Array {
+		v.charge(1)
+		if val.Type == NIL {
+			continue
+		}
+		r := v.Call(f, []*Value{NewNumber(float64(k + 1)), val.Copy()})
+		if len(r) > 0 && r[0].Type != NIL {
+			return r[:1]
+		}
+	}
+	for _, e := range t.Entries {
+		v.charge(1)
+		if e.Val.Type == NIL {
+			continue
+		}
+		r := v.Call(f, []*Value{e.Key.Copy(), e.Val.Copy()})
+		if len(r) > 0 && r[0].Type != NIL {
+			return r[:1]
+		}
+	}
+	return nil
+}
+
+func tab_foreachi(params []*Value, v *VM) []*Value {
+	t := v.checkTable(params, 1, "foreachi")
+	f := v.checkFunction(params, 2, "foreachi")
+	n := t.border()
+	for l1 := 1; l1 <= n; l1++ {
+		v.charge(1)
+		r := v.Call(f, []*Value{NewNumber(float64(l1)), t.GetInt(l1)})
+		if len(r) > 0 && r[0].Type != NIL {
+			return r[:1]
+		}
+	}
+	return nil
+}
+
+func tab_getn(params []*Value, v *VM) []*Value {
+	t := v.checkTable(params, 1, "getn")
+	return []*Value{NewNumber(float64(t.border()))}
+}
+
+func tab_setn(params []*Value, v *VM) []*Value {
+	v.checkTable(params, 1, "setn")
+	v.Error("'setn' is obsolete")
+	return nil
+}
+
+func tab_insert(params []*Value, v *VM) []*Value {
+	t := v.checkTable(params, 1, "insert")
+	e := t.border() + 1
+	var pos int
+	switch len(params) {
+	case 2:
+		pos = e
+	case 3:
+		pos = v.checkInt(params, 2, "insert")
+		// Checked before shifting, so a huge position cannot loop for ever.
+		if pos < 1 || pos > e {
+			v.argError(2, "insert", "position out of bounds")
+		}
+		v.charge(e - pos)
+		for l1 := e; l1 > pos; l1-- {
+			t.SetInt(l1, t.GetInt(l1-1))
+		}
+	default:
+		v.Error("wrong number of arguments to 'insert'")
+	}
+	t.SetInt(pos, arg(params, len(params)).Copy())
+	return nil
+}
+
+func tab_remove(params []*Value, v *VM) []*Value {
+	t := v.checkTable(params, 1, "remove")
+	e := t.border()
+	pos := v.optInt(params, 2, "remove", e)
+	if pos < 1 || pos > e {
+		return nil
+	}
+	ret := t.GetInt(pos)
+	v.charge(e - pos)
+	for ; pos < e; pos++ {
+		t.SetInt(pos, t.GetInt(pos+1))
+	}
+	t.SetInt(e, NewNil())
+	return []*Value{ret}
+}
+
+func tab_maxn(params []*Value, v *VM) []*Value {
+	t := v.checkTable(params, 1, "maxn")
+	v.charge(len(t.Array) + len(t.Entries))
+	max := Number(0)
+	for k, val := range t.Array {
+		if val.Type != NIL && Number(k+1) > max {
+			max = Number(k + 1)
+		}
+	}
+	for _, e := range t.Entries {
+		if e.Key.Type == NUMBER && e.Val.Type != NIL && e.Key.Num > max {
+			max = e.Key.Num
+		}
+	}
+	return []*Value{{Type: NUMBER, Num: max}}
+}
+
+// maxUnpack bounds the number of values unpack may push, as Lua's C stack
+// limit does.
+const maxUnpack = 8000
+
+func tab_unpack(params []*Value, v *VM) []*Value {
+	t := v.checkTable(params, 1, "unpack")
+	// The bounds are checked as numbers, since j-i can overflow an int.
+	i := math.Trunc(float64(v.optNumber(params, 2, "unpack", 1)))
+	j := math.Trunc(float64(v.optNumber(params, 3, "unpack", 0)))
+	if arg(params, 3).Type == NIL {
+		j = float64(t.border())
+	}
+	if i > j {
+		return nil
+	}
+	if !(j-i < maxUnpack) {
+		v.Error("too many results to unpack")
+	}
+	v.charge(int(j-i) + 1)
+	ret := make([]*Value, 0, int(j-i)+1)
+	for l1 := int(i); l1 <= int(j); l1++ {
+		ret = append(ret, t.GetInt(l1))
+	}
+	return ret
+}
+
+func tab_sort(params []*Value, v *VM) []*Value {
+	t := v.checkTable(params, 1, "sort")
+	n := t.border()
+	var comp *Value
+	if arg(params, 2).Type != NIL {
+		comp = v.checkFunction(params, 2, "sort")
+	}
+	s := &sorter{v: v, comp: comp, a: make([]*Value, n+2)}
+	for l1 := 1; l1 <= n; l1++ {
+		s.a[l1] = t.GetInt(l1)
+	}
+	s.a[0], s.a[n+1] = NewNil(), NewNil()
+	s.sort(1, n)
+	for l1 := 1; l1 <= n; l1++ {
+		t.SetInt(l1, s.a[l1])
+	}
+	return nil
+}
+
+// sorter is the quicksort from Lua 5.1's ltablib.c. It is used rather than
+// package sort so that an inconsistent comparator is reported the way Lua
+// reports it instead of silently producing garbage.
+type sorter struct {
+	v    *VM
+	comp *Value
+	a    []*Value // 1-based, with nil sentinels at both ends
+}
+
+func (s *sorter) less(a *Value, b *Value) bool {
+	s.v.charge(1)
+	if s.comp == nil {
+		return s.v.lessThan(a, b)
+	}
+	r := s.v.Call(s.comp, []*Value{a, b})
+	return len(r) > 0 && truthy(r[0])
+}
+
+func (s *sorter) get(i int) *Value {
+	if i < 0 || i >= len(s.a) {
+		return NewNil()
+	}
+	return s.a[i]
+}
+
+func (s *sorter) sort(l int, u int) {
+	a := s.a
+	for l < u {
+		if s.less(a[u], a[l]) {
+			a[l], a[u] = a[u], a[l]
+		}
+		if u-l == 1 {
+			break
+		}
+		i := (l + u) / 2
+		if s.less(a[i], a[l]) {
+			a[i], a[l] = a[l], a[i]
+		} else if s.less(a[u], a[i]) {
+			a[i], a[u] = a[u], a[i]
+		}
+		if u-l == 2 {
+			break
+		}
+		p := a[i]
+		a[i], a[u-1] = a[u-1], a[i]
+		i, j := l, u-1
+		for {
+			for i++; s.less(s.get(i), p); i++ {
+				if i > u {
+					s.v.Error("invalid order function for sorting")
+				}
+			}
+			for j--; s.less(p, s.get(j)); j-- {
+				if j < l {
+					s.v.Error("invalid order function for sorting")
+				}
+			}
+			if j < i {
+				break
+			}
+			a[i], a[j] = a[j], a[i]
+		}
+		a[u-1], a[i] = a[i], a[u-1]
+		if i-l < u-i {
+			j, i, l = l, i-1, i+1
+		} else {
+			j, i, u = i+1, u, i-1
+		}
+		s.sort(j, i)
+	}
+}
@@ -0,0 +1,200 @@
+package LuaVM
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestTableSort(t *testing.T) {
+	vm := NewVM()
+	tb := NewTable()
+	for l1, n := range []float64{5, 3, 9, 1, 7, 3, 8, 2} {
+		tb.SetInt(l1+1, NewNumber(n))
+	}
+	sort := vm.G.Get(Value{Type: STRING, Val: "table"}).Val.(*Table).Get(Value{Type: STRING, Val: "sort"})
+	greater := NewGoFunction(func(params []*Value, v *VM) []*Value {
+		return []*Value{NewBool(params[0].Num > params[1].Num)}
+	})
+	if _, err := vm.PCall(sort, []*Value{{Type: TABLE, Val: tb}, greater}); err != nil {
+		t.Fatal("sort failed: ", err)
+	}
+	for l1, n := range []Number{9, 8, 7, 5, 3, 3, 2, 1} {
+		if got := tb.GetInt(l1 + 1).Num; got != n {
+			t.Errorf("t[%d] = %v, want %v", l1+1, got, n)
+		}
+	}
+
+	always := NewGoFunction(func(params []*Value, v *VM) []*Value {
+		return []*Value{NewBool(true)}
+	})
+	_, err := vm.PCall(sort, []*Value{{Type: TABLE, Val: tb}, always})
+	if err == nil || err.Error() != "invalid order function for sorting" {
+		t.Error("expected invalid order function error, got ", err)
+	}
+}
+
+func tableFunc(vm *VM, name string) *Value {
+	return vm.G.Get(str("table")).Val.(*Table).Get(str(name))
+}
+
+func seq(vals ...*Value) *Value {
+	t := NewTable()
+	for l1, val := range vals {
+		t.SetInt(l1+1, val)
+	}
+	return &Value{Type: TABLE, Val: t}
+}
+
+// contents returns the elements of t from 1 up to its border.
+func contents(t *Value) []string {
+	var s []string
+	tb := t.Val.(*Table)
+	for l1 := 1; l1 <= tb.border(); l1++ {
+		s = append(s, tb.GetInt(l1).String())
+	}
+	return s
+}
+
+func TestTableSortLuaComparator(t *testing.T) {
+	// function(a, b) return a > b end
+	greater := &Value{Type: CLOSURE, Val: &Closure{Function: &FunctionPrototype{
+		Instructions: []Instr{
+			{Opcode: OP_LT, A: 1, B: 1, C: 0},
+			{Opcode: OP_JMP, B: 1},
+			{Opcode: OP_LOADBOOL, A: 2, B: 0, C: 1},
+			{Opcode: OP_LOADBOOL, A: 2, B: 1, C: 0},
+			{Opcode: OP_RETURN, A: 2, B: 2},
+		},
+		Parameters:   2,
+		MaxStackSize: 3,
+	}}}
+	vm := NewVM()
+	tb := seq(NewString("b"), NewString("d"), NewString("a"), NewString("c"))
+	if _, err := vm.PCall(tableFunc(vm, "sort"), []*Value{tb, greater}); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(contents(tb), " "); got != "d c b a" {
+		t.Errorf("sorted with a > b: %s", got)
+	}
+}
+
+func TestTableInsertRemove(t *testing.T) {
+	vm := NewVM()
+	insert, remove := tableFunc(vm, "insert"), tableFunc(vm, "remove")
+	tb := seq(NewNumber(1), NewNumber(2), NewNumber(3))
+	for _, params := range [][]*Value{
+		{tb, NewNumber(4)},
+		{tb, NewNumber(1), NewNumber(0)},
+		{tb, NewNumber(3), NewString("x")},
+	} {
+		if _, err := vm.PCall(insert, params); err != nil {
+			t.Fatal("insert: ", err)
+		}
+	}
+	if got := strings.Join(contents(tb), " "); got != "0 1 x 2 3 4" {
+		t.Errorf("after inserts: %s", got)
+	}
+	_, err := vm.PCall(insert, []*Value{tb, NewNumber(1), NewNumber(2), NewNumber(3)})
+	if err == nil || err.Error() != "wrong number of arguments to 'insert'" {
+		t.Errorf("insert with 4 arguments: got %v", err)
+	}
+	for _, pos := range []float64{0, 8, 1e15} {
+		_, err := vm.PCall(insert, []*Value{tb, NewNumber(pos), NewNumber(0)})
+		if err == nil || err.Error() != "bad argument #2 to 'insert' (position out of bounds)" {
+			t.Errorf("insert at %g: got %v", pos, err)
+		}
+	}
+
+	for _, test := range []struct {
+		pos  *Value
+		want string
+	}{
+		{NewNil(), "4"},
+		{NewNumber(1), "0"},
+		{NewNumber(2), "x"},
+	} {
+		r, err := vm.PCall(remove, []*Value{tb, test.pos})
+		if err != nil || len(r) != 1 || r[0].String() != test.want {
+			t.Errorf("remove(t, %s): got %v, %v, want %s", test.pos.String(), r, err, test.want)
+		}
+	}
+	if got := strings.Join(contents(tb), " "); got != "1 2 3" {
+		t.Errorf("after removes: %s", got)
+	}
+	if r, err := vm.PCall(remove, []*Value{seq()}); err != nil || len(r) != 0 {
+		t.Errorf("remove({}): got %v, %v, want nothing", r, err)
+	}
+}
+
+func TestTableConcat(t *testing.T) {
+	vm := NewVM()
+	concat := tableFunc(vm, "concat")
+	tb := seq(NewString("a"), NewNumber(1), NewString("c"))
+	for _, test := range []struct {
+		params []*Value
+		want   string
+	}{
+		{[]*Value{tb}, "a1c"},
+		{[]*Value{tb, NewString(", ")}, "a, 1, c"},
+		{[]*Value{tb, NewString("-"), NewNumber(2)}, "1-c"},
+		{[]*Value{tb, NewString("-"), NewNumber(2), NewNumber(2)}, "1"},
+		{[]*Value{tb, NewString("-"), NewNumber(3), NewNumber(2)}, ""},
+	} {
+		r, err := vm.PCall(concat, test.params)
+		if err != nil || r[0].String() != test.want {
+			t.Errorf("concat%v: got %v, %v, want %q", test.params[1:], r, err, test.want)
+		}
+	}
+	_, err := vm.PCall(concat, []*Value{seq(NewString("a"), NewBool(true))})
+	if err == nil || err.Error() != "invalid value (at index 2) in table for 'concat'" {
+		t.Errorf("concat of a boolean: got %v", err)
+	}
+}
+
+func TestTableMaxnGetn(t *testing.T) {
+	vm := NewVM()
+	tb := seq(NewNumber(1), NewNumber(2))
+	tb.Val.(*Table).Set(*NewNumber(10.5), NewBool(true))
+	tb.Val.(*Table).Set(*NewString("x"), NewNumber(100))
+	if r, _ := vm.PCall(tableFunc(vm, "maxn"), []*Value{tb}); r[0].Num != 10.5 {
+		t.Errorf("maxn = %v, want 10.5", r[0].Num)
+	}
+	if r, _ := vm.PCall(tableFunc(vm, "maxn"), []*Value{seq()}); r[0].Num != 0 {
+		t.Errorf("maxn({}) = %v, want 0", r[0].Num)
+	}
+	if r, _ := vm.PCall(tableFunc(vm, "getn"), []*Value{tb}); r[0].Num != 2 {
+		t.Errorf("getn = %v, want 2", r[0].Num)
+	}
+}
+
+func TestTableUnpack(t *testing.T) {
+	vm := NewVM()
+	unpack := tableFunc(vm, "unpack")
+	tb := seq(NewNumber(1), NewNumber(2), NewNumber(3))
+	for _, test := range []struct {
+		params []*Value
+		want   string
+	}{
+		{[]*Value{tb}, "1 2 3"},
+		{[]*Value{tb, NewNumber(2)}, "2 3"},
+		{[]*Value{tb, NewNumber(2), NewNumber(5)}, "2 3 NIL NIL"},
+		{[]*Value{tb, NewNumber(0), NewNumber(1)}, "NIL 1"},
+		{[]*Value{tb, NewNumber(3), NewNumber(2)}, ""},
+	} {
+		r, err := vm.PCall(unpack, test.params)
+		var got []string
+		for _, val := range r {
+			got = append(got, val.String())
+		}
+		if err != nil || strings.Join(got, " ") != test.want {
+			t.Errorf("unpack%v: got %v, %v, want %q", test.params[1:], got, err, test.want)
+		}
+	}
+	for _, bounds := range [][2]float64{{1, 1e4}, {1, 1e300}, {-9.2e18, 4.6e18}, {math.Inf(-1), math.Inf(1)}} {
+		_, err := vm.PCall(unpack, []*Value{tb, NewNumber(bounds[0]), NewNumber(bounds[1])})
+		if err == nil || err.Error() != "too many results to unpack" {
+			t.Errorf("unpack(t, %g, %g): got %v", bounds[0], bounds[1], err)
+		}
+	}
+}
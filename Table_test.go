@@ -0,0 +1,232 @@
+package LuaVM
+
+import (
+	"math"
+	"testing"
+)
+
+func TestNextClearingFields(t *testing.T) {
+	tb := NewTable()
+	keys := []string{"e", "b", "d", "a", "c"}
+	for _, k := range keys {
+		tb.Set(Value{Type: STRING, Val: k}, NewString(k))
+	}
+	var visited []string
+	k, _, ok := tb.Next(Value{Type: NIL})
+	for ok && k.Type != NIL {
+		visited = append(visited, k.Val.(string))
+		tb.Set(k, NewNil())
+		k, _, ok = tb.Next(k)
+	}
+	if !ok {
+		t.Fatal("traversal lost its place after clearing a field")
+	}
+	if len(visited) != len(keys) {
+		t.Fatal("visited ", visited, ", want ", keys)
+	}
+	for l1 := range keys {
+		if visited[l1] != keys[l1] {
+			t.Fatal("visited ", visited, ", want insertion order ", keys)
+		}
+	}
+	if k, _, _ := tb.Next(Value{Type: NIL}); k.Type != NIL {
+		t.Error("cleared table still has key ", k.Val)
+	}
+}
+
+func TestChurnStaysBounded(t *testing.T) {
+	tb := NewTable()
+	// Each key is set and cleared again, leaving a dead entry that must be
+	// reclaimed rather than piling up.
+	for l1 := 0; l1 < 100000; l1++ {
+		k := Value{Type: STRING, Val: string(rune('a'+l1%26)) + string(rune(l1))}
+		tb.Set(k, NewNumber(float64(l1)))
+		tb.Set(k, NewNil())
+	}
+	if len(tb.Entries) > 4 || len(tb.Hash) > 4 {
+		t.Error("churn left ", len(tb.Entries), " entries and ", len(tb.Hash), " hash slots")
+	}
+}
+
+func TestRehashGrowsArray(t *testing.T) {
+	tb := NewTable()
+	for l1 := 1; l1 <= 1000; l1++ {
+		tb.SetInt(tb.border()+1, NewNumber(float64(l1)))
+	}
+	if len(tb.Entries) != 0 {
+		t.Error("appended elements landed in the hash part: ", len(tb.Entries))
+	}
+	if tb.ArraySize < 1000 {
+		t.Error("array part only holds ", tb.ArraySize, " elements")
+	}
+	if n := tb.border(); n != 1000 {
+		t.Error("border is ", n, ", want 1000")
+	}
+
+	// Keys set in reverse start out in the hash part and must migrate
+	// once they become dense.
+	tb = NewTable()
+	for l1 := 64; l1 >= 1; l1-- {
+		tb.SetInt(l1, NewNumber(float64(l1)))
+	}
+	tb.Set(Value{Type: STRING, Val: "x"}, NewNumber(0))
+	if tb.ArraySize != 64 {
+		t.Error("array part holds ", tb.ArraySize, " elements, want 64")
+	}
+	for l1 := 1; l1 <= 64; l1++ {
+		if got := tb.GetInt(l1); got.Type != NUMBER || got.Num != Number(l1) {
+			t.Fatal("t[", l1, "] = ", got, " after migration")
+		}
+	}
+}
+
+func checkBorder(t *testing.T, name string, tb *Table) {
+	n := int(tb.Len().Num)
+	if n < 0 || (n > 0 && tb.GetInt(n).Type == NIL) || tb.GetInt(n+1).Type != NIL {
+		t.Errorf("%s: #t = %d is not a border", name, n)
+	}
+}
+
+func TestLenBorders(t *testing.T) {
+	tb := NewTableSize(4, 0)
+	tb.SetInt(1, NewNumber(1))
+	tb.SetInt(2, NewNumber(2))
+	tb.SetInt(4, NewNumber(4))
+	checkBorder(t, "hole in array part", tb)
+
+	tb = NewTableSize(0, 16)
+	for l1 := 1; l1 <= 10; l1++ {
+		tb.SetInt(l1, NewNumber(float64(l1)))
+	}
+	if tb.ArraySize != 0 {
+		t.Fatal("sequence was not kept in the hash part")
+	}
+	checkBorder(t, "sequence in hash part", tb)
+	if n := tb.Len().Num; n != 10 {
+		t.Error("#t = ", n, " for a 10 element sequence in the hash part")
+	}
+
+	tb = NewTableSize(2, 4)
+	tb.SetInt(1, NewNumber(1))
+	tb.SetInt(2, NewNumber(2))
+	tb.SetInt(3, NewNumber(3))
+	tb.SetInt(4, NewNumber(4))
+	checkBorder(t, "sequence spanning both parts", tb)
+	if n := tb.Len().Num; n != 4 {
+		t.Error("#t = ", n, " for a sequence spanning both parts")
+	}
+
+	tb = NewTableSize(0, 4)
+	tb.SetInt(2, NewNumber(2))
+	if n := tb.Len().Num; n != 0 {
+		t.Error("#t = ", n, " when t[1] is nil")
+	}
+}
+
+func TestLenSetList(t *testing.T) {
+	s := &Stackframe{Regs: make([]Value, 61)}
+	// 31 is 60 encoded as a floating point byte.
+	Op_NewTable(&Instr{Opcode: OP_NEWTABLE, A: 0, B: 31}, s, NewVM())
+	if tb := s.Regs[0].Val.(*Table); tb.ArraySize != 60 {
+		t.Fatal("OP_NEWTABLE sized the array part ", tb.ArraySize)
+	}
+	for l1 := 1; l1 <= 60; l1++ {
+		s.Regs[l1] = *NewNumber(float64(l1))
+	}
+	Op_SetList(&Instr{Opcode: OP_SETLIST, A: 0, B: 50, C: 1}, s, nil)
+	copy(s.Regs[1:], s.Regs[51:61])
+	Op_SetList(&Instr{Opcode: OP_SETLIST, A: 0, B: 10, C: 2}, s, nil)
+	tb := s.Regs[0].Val.(*Table)
+	checkBorder(t, "table built by OP_SETLIST", tb)
+	if n := tb.Len().Num; n != 60 {
+		t.Error("#t = ", n, " after OP_SETLIST stored 60 elements")
+	}
+	if len(tb.Entries) != 0 {
+		t.Error("OP_SETLIST elements landed in the hash part")
+	}
+}
+
+func TestKeyNormalisation(t *testing.T) {
+	tb := NewTable()
+	for _, test := range []struct {
+		key Value
+		msg string
+	}{
+		{Value{Type: NIL}, "table index is nil"},
+		{Value{Type: NUMBER, Num: Number(math.NaN())}, "table index is NaN"},
+	} {
+		func() {
+			defer func() {
+				e, ok := recover().(*LuaError)
+				if !ok || e.Error() != test.msg {
+					t.Errorf("Set(%v) raised %v, want %q", test.key, e, test.msg)
+				}
+			}()
+			tb.Set(test.key, NewNumber(1))
+		}()
+	}
+	if got := tb.Get(Value{Type: NIL}); got.Type != NIL {
+		t.Error("t[nil] = ", got)
+	}
+
+	tb.Set(Value{Type: NUMBER, Num: Number(math.Copysign(0, -1))}, NewString("zero"))
+	if got := tb.Get(Value{Type: NUMBER, Num: Number(0)}); got.Type != STRING {
+		t.Error("t[-0] was not stored as t[0]")
+	}
+	k, _, _ := tb.Next(Value{Type: NIL})
+	if math.Signbit(float64(k.Num)) {
+		t.Error("next returned the key as -0")
+	}
+
+	// 2.0 must find the same field whichever part holds it.
+	for _, tb := range []*Table{NewTableSize(4, 0), NewTableSize(0, 4)} {
+		tb.Set(Value{Type: NUMBER, Num: Number(2.0)}, NewString("two"))
+		if got := tb.GetInt(2); got.Type != STRING {
+			t.Error("t[2.0] and t[2] are different fields")
+		}
+	}
+}
+
+func TestFunctionAndLightUserDataKeys(t *testing.T) {
+	vm := NewVM()
+	tb := NewTable()
+	print, typ := vm.G.Get(str("print")), vm.G.Get(str("type"))
+	tb.Set(*print, NewBool(true))
+	if got := tb.Get(*vm.G.Get(str("print"))); !truthy(got) {
+		t.Error("t[print] = ", got.String())
+	}
+	if got := tb.Get(*typ); got.Type != NIL {
+		t.Error("t[type] = ", got.String(), ", want nil")
+	}
+
+	// A slice or map, which Go cannot hash, is a key by what it refers to,
+	// and next hands back the value it was stored under.
+	xs, m := []int{1, 2}, map[string]int{}
+	tb.Set(*NewLightUserData(xs), NewString("slice"))
+	tb.Set(*NewLightUserData(m), NewString("map"))
+	if got := tb.Get(*NewLightUserData(xs)); got.String() != "slice" {
+		t.Error("t[xs] = ", got.String())
+	}
+	if got := tb.Get(*NewLightUserData(xs[:1])); got.Type != NIL {
+		t.Error("t[xs[:1]] = ", got.String(), ", want nil")
+	}
+	if got := tb.Get(*NewLightUserData(m)); got.String() != "map" {
+		t.Error("t[m] = ", got.String())
+	}
+	if !rawEquals(NewLightUserData(xs), NewLightUserData(xs)) || rawEquals(NewLightUserData(xs), NewLightUserData([]int{1, 2})) {
+		t.Error("light userdata slices compare by value")
+	}
+	k, _, _ := tb.Next(*print)
+	if _, ok := k.Val.([]int); !ok {
+		t.Errorf("next returned a %T key for the slice", k.Val)
+	}
+
+	// Raised as a Lua error, which pcall can catch, rather than a Go panic.
+	_, err := vm.PCall(NewGoFunction(func(params []*Value, v *VM) []*Value {
+		tb.Set(*NewLightUserData(struct{ xs []int }{xs}), NewBool(true))
+		return nil
+	}), nil)
+	if err == nil || err.Error() != "table index is not comparable" {
+		t.Errorf("struct holding a slice as a key: got %v", err)
+	}
+}
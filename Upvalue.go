@@ -0,0 +1,52 @@
+package LuaVM
+
+import "slices"
+
+// An Upvalue is a local variable of an enclosing function as a closure sees
+// it. While the variable is in scope the upvalue is open: it refers to the
+// variable's stack slot, which the function and every closure that captured
+// the variable share. Once the variable goes out of scope the upvalue is
+// closed, and holds the last value itself.
+//
+// As in the reference implementation, each thread keeps its open upvalues
+// sorted by stack slot, so that a variable captured twice is found again
+// and the upvalues leaving scope are the last ones. Growing the stack moves
+// it, so it repoints them at the copy.
+type Upvalue struct {
+	v      *Value
+	closed Value
+	index  int // stack slot, while open
+}
+
+// newUpvalue returns a closed upvalue holding val.
+func newUpvalue(val Value) *Upvalue {
+	u := &Upvalue{closed: val}
+	u.v = &u.closed
+	return u
+}
+
+// findUpvalue returns the open upvalue for stack slot index, opening one if
+// no closure has captured the slot yet.
+func (v *VM) findUpvalue(index int) *Upvalue {
+	l1 := len(v.openUpvalues)
+	for ; l1 > 0 && v.openUpvalues[l1-1].index >= index; l1-- {
+		if u := v.openUpvalues[l1-1]; u.index == index {
+			return u
+		}
+	}
+	u := &Upvalue{v: &v.stack[index], index: index}
+	v.openUpvalues = slices.Insert(v.openUpvalues, l1, u)
+	return u
+}
+
+// closeUpvalues closes the open upvalues for stack slots level and above.
+func (v *VM) closeUpvalues(level int) {
+	l1 := len(v.openUpvalues)
+	for ; l1 > 0 && v.openUpvalues[l1-1].index >= level; l1-- {
+		u := v.openUpvalues[l1-1]
+		u.closed = *u.v
+		u.v = &u.closed
+	}
+	clear(v.openUpvalues[l1:])
+	v.openUpvalues = v.openUpvalues[:l1]
+}
@@ -0,0 +1,85 @@
+package LuaVM
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// UserData is the payload of a full userdata value: a Go value exposed to
+// Lua, with a metatable of its own.
+type UserData struct {
+	Value     interface{}
+	Metatable *Table
+}
+
+// NewUserData wraps goValue as a full userdata with metatable mt, which may
+// be nil. If mt came from VM.NewMetatable and has a __gc field, the
+// userdata is registered with that VM to be finalised.
+func NewUserData(goValue interface{}, mt *Table) *Value {
+	val := &Value{Type: USERDATA, Val: &UserData{Value: goValue, Metatable: mt}}
+	if mt != nil && mt.vm != nil && mt.Get(Value{Type: STRING, Val: "__gc"}).Type != NIL {
+		mt.vm.registerFinalizer(val)
+	}
+	return val
+}
+
+// NewLightUserData wraps p as a light userdata. Light userdata have no
+// metatable and are compared by value, or, for slices, maps and funcs,
+// which Go cannot compare, by what they refer to. Other values Go cannot
+// compare, such as structs holding slices, are not valid table keys.
+func NewLightUserData(p interface{}) *Value {
+	return &Value{Type: LIGHTUSERDATA, Val: p}
+}
+
+// NewMetatable returns the metatable registered under name, creating it if
+// there is none yet; created reports whether it was. Metatables are kept in
+// Registry, as luaL_newmetatable keeps them in the Lua registry.
+func (v *VM) NewMetatable(name string) (mt *Table, created bool) {
+	key := Value{Type: STRING, Val: name}
+	if existing := v.Registry.Get(key); existing.Type == TABLE {
+		return existing.Val.(*Table), false
+	}
+	mt = NewTable()
+	mt.vm = v
+	v.Registry.Set(key, &Value{Type: TABLE, Val: mt})
+	return mt, true
+}
+
+// GetMetatable returns the metatable registered under name, or nil.
+func (v *VM) GetMetatable(name string) *Table {
+	mt := v.Registry.Get(Value{Type: STRING, Val: name})
+	if mt.Type != TABLE {
+		return nil
+	}
+	return mt.Val.(*Table)
+}
+
+// CheckUserData returns the Go value held by the userdata val, failing if
+// val is not a userdata or holds a value of another type.
+func CheckUserData[T any](val *Value) (T, error) {
+	var zero T
+	var got interface{}
+	switch val.Type {
+	case USERDATA:
+		got = val.Val.(*UserData).Value
+	case LIGHTUSERDATA:
+		got = val.Val
+	default:
+		return zero, fmt.Errorf("%v expected, got %s", reflect.TypeOf(&zero).Elem(), val.TypeName())
+	}
+	t, ok := got.(T)
+	if !ok {
+		return zero, fmt.Errorf("%v expected, got userdata holding %T", reflect.TypeOf(&zero).Elem(), got)
+	}
+	return t, nil
+}
+
+// CheckUserDataName is CheckUserData for userdata that must also carry the
+// metatable registered under name.
+func CheckUserDataName[T any](v *VM, val *Value, name string) (T, error) {
+	if val.Type != USERDATA || val.Val.(*UserData).Metatable == nil || val.Val.(*UserData).Metatable != v.GetMetatable(name) {
+		var zero T
+		return zero, fmt.Errorf("%s expected, got %s", name, val.TypeName())
+	}
+	return CheckUserData[T](val)
+}
@@ -0,0 +1,52 @@
+package LuaVM
+
+import "testing"
+
+type testFile struct {
+	name   string
+	closed bool
+}
+
+func TestUserData(t *testing.T) {
+	vm := NewVM()
+	mt, created := vm.NewMetatable("testFile")
+	if !created {
+		t.Fatal("NewMetatable did not create the metatable")
+	}
+	if again, created := vm.NewMetatable("testFile"); created || again != mt {
+		t.Fatal("NewMetatable did not return the registered metatable")
+	}
+	mt.SetFunc("__gc", func(params []*Value, v *VM) []*Value {
+		f, err := CheckUserDataName[*testFile](v, params[0], "testFile")
+		if err != nil {
+			t.Error("__gc got ", err)
+			return nil
+		}
+		f.closed = true
+		return nil
+	})
+
+	f := &testFile{name: "data.txt"}
+	ud := NewUserData(f, mt)
+	if ud.TypeName() != "userdata" {
+		t.Error("type(ud) = ", ud.TypeName())
+	}
+	got, err := CheckUserData[*testFile](ud)
+	if err != nil || got != f {
+		t.Error("CheckUserData returned ", got, err)
+	}
+	if _, err := CheckUserData[string](ud); err == nil {
+		t.Error("CheckUserData accepted the wrong Go type")
+	}
+	if _, err := CheckUserData[*testFile](NewNumber(1)); err == nil {
+		t.Error("CheckUserData accepted a number")
+	}
+	if _, err := CheckUserDataName[*testFile](vm, NewUserData(f, nil), "testFile"); err == nil {
+		t.Error("CheckUserDataName accepted userdata without the named metatable")
+	}
+
+	vm.Collect()
+	if !f.closed {
+		t.Error("unreachable userdata was not finalised")
+	}
+}
@@ -1,128 +1,378 @@
 package LuaVM
 
+import (
+	"bufio"
+	"io"
+	"math/rand"
+	"os"
+	"weak"
+)
+
 type VM struct {
 	G          *Table
+	Registry   *Table
 	FrameStack []*Stackframe
 	S          *Stackframe
+
+	Stdout io.Writer
+	Stdin  io.Reader
+
+	libs    Lib
+	sandbox bool
+	loaded  *Table
+	stdin   *bufio.Reader
+	current *Coroutine
+	rand    *rand.Rand
+	collate func(a, b string) int
+
+	// Coroutines that may still run, which the collector treats as roots
+	// since Go code such as coroutine.wrap can hold them out of its sight.
+	// They are held weakly, so as not to keep abandoned ones alive, and
+	// swept of collected ones whenever the map doubles in size.
+	coroutines     map[weak.Pointer[Coroutine]]bool
+	coroutineSweep int
+	stringMeta     *Table
+
+	// Objects awaiting finalisation, in the order they were registered,
+	// and the same keyed by identity. Once there are finalizerCollect of
+	// them, collectDue is set and checkGC runs a collection.
+	finalizers       []*Value
+	finalizerSet     map[interface{}]bool
+	finalizerCollect int
+	collectDue       bool
+
+	// Instructions left before the VM raises an error, if limited.
+	limited bool
+	budget  int64
+
+	// The value stack of the running thread. Frames are windows on it, and
+	// top is the first free slot, or just past the values an open call or
+	// OP_VARARG left for the instruction after it. openUpvalues are the
+	// upvalues still referring to slots of it.
+	stack        []Value
+	top          int
+	openUpvalues []*Upvalue
+	maxCalls     int
+	spare        []*Stackframe
+
+	// The longest string the string, table and io libraries and OP_CONCAT
+	// may build.
+	maxStringSize int
 }
 
-func NewVM() *VM {
+// defaultMaxCalls is how deeply Lua calls may nest by default, as
+// LUAI_MAXCALLS is in the reference implementation.
+const defaultMaxCalls = 20000
+
+// defaultMaxStringSize is the longest string a VM builds by default.
+const defaultMaxStringSize = 1 << 28
+
+// minCoroutineSweep is the fewest coroutines the VM holds before it
+// sweeps out collected ones.
+const minCoroutineSweep = 64
+
+// minFinalizerCollect is the fewest objects awaiting finalisation that
+// trigger a collection when another is registered.
+const minFinalizerCollect = 64
+
+// basicStackSize is the size a thread's value stack starts at.
+const basicStackSize = 64
+
+func NewVM(opts ...Option) *VM {
 	vm := &VM{
-		G: NewTable(),
+		G:        NewTable(),
+		Registry: NewTable(),
+		Stdout:   os.Stdout,
+		Stdin:    os.Stdin,
+		libs:     AllLibs,
+		loaded:   NewTable(),
+		rand:     rand.New(rand.NewSource(0)),
+		maxCalls: defaultMaxCalls,
+
+		maxStringSize: defaultMaxStringSize,
+		coroutines:    make(map[weak.Pointer[Coroutine]]bool),
+
+		finalizerSet:     make(map[interface{}]bool),
+		finalizerCollect: minFinalizerCollect,
+	}
+	for _, opt := range opts {
+		opt(vm)
 	}
-	vm.G.SetFunc("getmetatable", getmetatable)
-	vm.G.SetFunc("setmetatable", setmetatable)
+	vm.openLibs()
 
 	return vm
 }
 
-func (v *VM) RunClosure(c *Closure) {
-	v.S = &Stackframe{
-		Closure: c,
-		Regs:    make([]*Value, c.Function.MaxStackSize),
+// RunClosure runs c as a main chunk and returns the error it raised, if any.
+func (v *VM) RunClosure(c *Closure) error {
+	_, err := v.PCall(&Value{Type: CLOSURE, Val: c}, nil)
+	return err
+}
+
+// Call calls fn with params and returns its results. Closures are run on a
+// nested dispatch loop, so a GOFUNC may use Call to call back into Lua.
+func (v *VM) Call(fn *Value, params []*Value) []*Value {
+	switch fn.Type {
+	case GOFUNCTION:
+		return fn.Val.(*GoFunction).Fn(params, v)
+	case CLOSURE:
+		top := v.top
+		v.growStack(top + 1 + len(params))
+		v.stack[top] = *fn
+		for k, p := range params {
+			v.stack[top+1+k] = deref(p)
+		}
+		v.call(top, len(params), -1)
+		results := goParams(v.stack[top:v.top])
+		v.top = top
+		return results
 	}
-	v.DispatchLoop()
+	v.Error("attempt to call a %s value", fn.TypeName())
+	return nil
 }
 
-func (v *VM) runClosure(c *Closure, params []*Value, returnfunc func(*Stackframe, *VM, []*Value)) *Stackframe {
-	s := &Stackframe{
-		Closure:    c,
-		Regs:       make([]*Value, c.Function.MaxStackSize),
-		Params:     make([]*Value, len(params)),
-		ReturnFunc: returnfunc,
+// WithMaxCalls bounds how deeply calls to Lua functions may nest. A call
+// past n raises the Lua error "stack overflow".
+func WithMaxCalls(n int) Option {
+	return func(v *VM) {
+		v.maxCalls = n
 	}
-	for k, val := range params {
-		s.Regs[k] = val.Copy()
-		s.Params[k] = val.Copy()
+}
+
+// WithMaxStringSize bounds the length of the strings string.rep, io.read,
+// table.concat and the concatenation operator may build, so that a script
+// cannot exhaust the host's memory with one. Building a longer one raises
+// the Lua error "resulting string too large".
+func WithMaxStringSize(n int) Option {
+	return func(v *VM) {
+		v.maxStringSize = n
+	}
+}
+
+// checkStringSize raises an error if a string of n bytes is longer than the
+// VM allows. n is a float so that sizes computed from Lua numbers cannot
+// overflow.
+func (v *VM) checkStringSize(n float64) {
+	if n > float64(v.maxStringSize) {
+		v.Error("resulting string too large")
+	}
+}
+
+// growStack makes the stack hold at least n values. Moving it to a larger
+// array repoints the registers of the running thread's frames, and its open
+// upvalues, at the copy.
+func (v *VM) growStack(n int) {
+	if n <= len(v.stack) {
+		return
+	}
+	stack := make([]Value, max(n, 2*len(v.stack), basicStackSize))
+	copy(stack, v.stack)
+	v.stack = stack
+	for _, u := range v.openUpvalues {
+		u.v = &v.stack[u.index]
+	}
+	v.frameView(v.S)
+	for _, s := range v.FrameStack {
+		v.frameView(s)
+	}
+}
+
+func (v *VM) frameView(s *Stackframe) {
+	if s != nil {
+		s.Varargs = v.stack[s.Base-len(s.Varargs) : s.Base]
+		s.Regs = v.stack[s.Base : s.Base+len(s.Regs)]
+	}
+}
+
+// frameTop moves top back to the end of the running frame, once the values
+// an open call left above its registers have been used.
+func (v *VM) frameTop() {
+	if v.S != nil {
+		v.top = v.S.Base + len(v.S.Regs)
 	}
-	return s
 }
 
+// precall calls the function in stack slot fn with the nargs arguments
+// above it. Its results go from slot fn on: nresults of them, padded with
+// nil, or all of them with top just past them if nresults is -1. A Go
+// function runs to completion, and precall returns false. A Lua function
+// gets a frame on the stack, which the dispatch loop goes on to run, and
+// precall returns true.
+func (v *VM) precall(fn, nargs, nresults int) bool {
+	switch f := &v.stack[fn]; f.Type {
+	case CLOSURE:
+		c := f.Val.(*Closure)
+		p := c.Function
+		if len(v.FrameStack) >= v.maxCalls {
+			v.Error("stack overflow")
+		}
+		if !p.lowered {
+			p.lower()
+		}
+		base, nparams, nvarargs := fn+1, int(p.Parameters), 0
+		if p.IsVararg != 0 {
+			// As in the reference implementation, the fixed parameters
+			// move above the extra arguments, which stay where they are
+			// for OP_VARARG.
+			v.growStack(base + max(nargs, nparams) + nparams)
+			for ; nargs < nparams; nargs++ {
+				v.stack[base+nargs] = Value{}
+			}
+			nvarargs = nargs - nparams
+			copy(v.stack[base+nargs:], v.stack[base:base+nparams])
+			base += nargs
+			nargs = nparams
+		}
+		end := base + int(p.MaxStackSize)
+		v.growStack(end)
+		clear(v.stack[base+min(nargs, nparams) : end])
+
+		s := v.newFrame()
+		s.Closure = c
+		s.Base = base
+		s.Regs = v.stack[base:end]
+		s.Varargs = v.stack[base-nvarargs : base]
+		s.fn = fn
+		s.nresults = nresults
+		v.FrameStack = append(v.FrameStack, v.S)
+		v.S = s
+		v.top = end
+		return true
+	case GOFUNCTION:
+		v.top = fn + 1 + nargs
+		rparams := f.Val.(*GoFunction).Fn(goParams(v.stack[fn+1:v.top]), v)
+		n := nresults
+		if n < 0 {
+			n = len(rparams)
+		}
+		v.growStack(fn + n)
+		for k := 0; k < n; k++ {
+			if k < len(rparams) {
+				v.stack[fn+k] = deref(rparams[k])
+			} else {
+				v.stack[fn+k] = Value{}
+			}
+		}
+		if nresults < 0 {
+			v.top = fn + n
+		} else {
+			v.frameTop()
+		}
+		return false
+	}
+	v.Error("attempt to call a %s value", v.stack[fn].TypeName())
+	return false
+}
+
+// call is precall followed by running a Lua function to completion on a
+// nested dispatch loop.
+func (v *VM) call(fn, nargs, nresults int) {
+	depth := len(v.FrameStack)
+	if v.precall(fn, nargs, nresults) {
+		v.execute(depth)
+	}
+}
+
+// newFrame returns a frame for a call, reusing one a call has returned from
+// if there is one.
+func (v *VM) newFrame() *Stackframe {
+	if n := len(v.spare); n > 0 {
+		s := v.spare[n-1]
+		v.spare = v.spare[:n-1]
+		return s
+	}
+	return &Stackframe{}
+}
+
+// poscall ends the running frame s, moving its n results from stack slot
+// first down to where its caller wants them, and returns to the caller.
+func (v *VM) poscall(s *Stackframe, first, n int) {
+	copy(v.stack[s.fn:], v.stack[first:first+n])
+	if s.nresults < 0 {
+		v.top = s.fn + n
+	} else if n < s.nresults {
+		clear(v.stack[s.fn+n : s.fn+s.nresults])
+	}
+	v.S = v.FrameStack[len(v.FrameStack)-1]
+	v.FrameStack = v.FrameStack[:len(v.FrameStack)-1]
+	if s.nresults >= 0 {
+		v.frameTop()
+	}
+	*s = Stackframe{}
+	v.spare = append(v.spare, s)
+}
+
+// PCall is Call in protected mode: a Lua error raised by fn is returned
+// instead of propagated, and the frame stack is unwound to where it was.
+func (v *VM) PCall(fn *Value, params []*Value) (results []*Value, err error) {
+	depth := len(v.FrameStack)
+	s, top := v.S, v.top
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		switch e := r.(type) {
+		case *LuaError:
+			err = e
+		case string:
+			err = &LuaError{Value: NewString(e)}
+		default:
+			panic(r)
+		}
+		v.FrameStack = v.FrameStack[:depth]
+		v.closeUpvalues(top)
+		v.S, v.top = s, top
+	}()
+	return v.Call(fn, params), nil
+}
+
+// DispatchLoop runs instructions until the frame stack is empty.
 func (v *VM) DispatchLoop() {
+	v.execute(0)
+}
+
+// WithInstructionLimit bounds the number of instructions the VM runs over
+// its lifetime. Once n have run, the next raises the Lua error
+// "instruction limit exceeded", which scripts can catch with pcall but not
+// get past, since every instruction after it fails in the same way.
+// Instructions and library functions that loop over many values, such as
+// OP_NEWTABLE, pattern matching and table.sort, count each step of the loop
+// as an instruction, so that one call cannot do unbounded work.
+func WithInstructionLimit(n int64) Option {
+	return func(v *VM) {
+		v.limited = true
+		v.budget = n
+	}
+}
+
+// charge counts n steps of work done by the running instruction or library
+// function against the instruction limit, raising the error at once if that
+// exhausts it.
+func (v *VM) charge(n int) {
+	if v.limited {
+		v.budget -= int64(n)
+		if v.budget < 0 {
+			v.Error("instruction limit exceeded")
+		}
+	}
+}
+
+// execute runs instructions until the frame stack unwinds back to depth.
+func (v *VM) execute(depth int) {
 	for {
-		i := &v.S.Closure.Function.Instructions[v.S.PC]
-		v.S.PC++
-		switch i.Opcode {
-		case OP_MOVE:
-			Op_Move(i, v.S, v)
-		case OP_LOADK:
-			Op_LoadK(i, v.S, v)
-		case OP_LOADBOOL:
-			Op_LoadBool(i, v.S, v)
-		case OP_LOADNIL:
-			Op_LoadNil(i, v.S, v)
-		case OP_GETUPVAL:
-			Op_GetUpVal(i, v.S, v)
-		case OP_GETGLOBAL:
-			Op_GetGlobal(i, v.S, v)
-		case OP_GETTABLE:
-			Op_GetTable(i, v.S, v)
-		case OP_SETGLOBAL:
-			Op_SetGlobal(i, v.S, v)
-		case OP_SETUPVAL:
-			Op_SetUpVal(i, v.S, v)
-		case OP_SETTABLE:
-			Op_SetTable(i, v.S, v)
-		case OP_NEWTABLE:
-			Op_NewTable(i, v.S, v)
-		case OP_SELF:
-			Op_Self(i, v.S, v)
-		case OP_ADD:
-			Op_Add(i, v.S, v)
-		case OP_SUB:
-			Op_Sub(i, v.S, v)
-		case OP_MUL:
-			Op_Mul(i, v.S, v)
-		case OP_DIV:
-			Op_Div(i, v.S, v)
-		case OP_MOD:
-			Op_Mod(i, v.S, v)
-		case OP_POW:
-			Op_Pow(i, v.S, v)
-		case OP_UNM:
-			Op_Unm(i, v.S, v)
-		case OP_NOT:
-			Op_Not(i, v.S, v)
-		case OP_LEN:
-			Op_Len(i, v.S, v)
-		case OP_CONCAT:
-			Op_Concat(i, v.S, v)
-		case OP_JMP:
-			Op_Jmp(i, v.S, v)
-		case OP_EQ:
-			Op_Eq(i, v.S, v)
-		case OP_LT:
-			Op_Lt(i, v.S, v)
-		case OP_LE:
-			Op_Le(i, v.S, v)
-		case OP_TEST:
-			Op_Test(i, v.S, v)
-		case OP_TESTSET:
-			Op_TestSet(i, v.S, v)
-		case OP_CALL:
-			Op_Call(i, v.S, v)
-		case OP_TAILCALL:
-			Op_TailCall(i, v.S, v)
-		case OP_RETURN:
-			Op_Return(i, v.S, v)
-		case OP_FORLOOP:
-			Op_ForLoop(i, v.S, v)
-		case OP_FORPREP:
-			Op_ForPrep(i, v.S, v)
-		case OP_TFORLOOP:
-			Op_TForLoop(i, v.S, v)
-		case OP_SETLIST:
-			Op_SetList(i, v.S, v)
-		case OP_CLOSE:
-			Op_Close(i, v.S, v)
-		case OP_CLOSURE:
-			Op_Closure(i, v.S, v)
-		case OP_VARARG:
-			Op_Vararg(i, v.S, v)
+		if v.limited {
+			if v.budget <= 0 {
+				v.Error("instruction limit exceeded")
+			}
+			v.budget--
 		}
-		if v.S == nil {
+		s := v.S
+		i := &s.Closure.Function.Instructions[s.PC]
+		s.PC++
+		i.handler(i, s, v)
+		if v.S == nil || len(v.FrameStack) == depth {
 			break
 		}
 	}
-
 }
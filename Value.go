@@ -2,7 +2,10 @@
 package LuaVM
 
 import (
+	"fmt"
+	"math"
 	"strconv"
+	"strings"
 )
 
 type ValueType uint8
@@ -10,32 +13,54 @@ type ValueType uint8
 const (
 	NIL ValueType = iota
 	BOOLEAN
-	_
+	LIGHTUSERDATA
 	NUMBER
 	STRING
 	TABLE
 	FUNCTION
 	CLOSURE
 	GOFUNCTION
+	THREAD
+	USERDATA
 )
 
 type GOFUNC func(params []*Value, v *VM) []*Value
 
+// GoFunction holds the GOFUNC of a GOFUNCTION value. Go funcs can be neither
+// compared nor hashed, so a Go function's identity is the pointer to its
+// holder: it equals only itself, and can be a table key.
+type GoFunction struct {
+	Fn GOFUNC
+}
+
+// NewGoFunction returns fn as a Lua function value. Each call makes a new
+// function, distinct from any other, as each evaluation of a function
+// expression does in Lua.
+func NewGoFunction(fn GOFUNC) *Value {
+	return &Value{Type: GOFUNCTION, Val: &GoFunction{Fn: fn}}
+}
+
 type Number float64
 
+// Value is a Lua value. It is small enough to be copied freely, and the VM
+// stores it inline in registers and tables, so that arithmetic does not
+// allocate: numbers are held in Num, and every other payload (a string,
+// *Table, *Closure and so on) in Val. *Value is only used where values
+// cross into Go, as in GOFUNC parameters and results.
 type Value struct {
 	Type ValueType
+	Num  Number
 	Val  interface{}
 }
 
 func (v *Value) String() string {
 	switch v.Type {
 	case NUMBER:
-		return strconv.FormatFloat(float64(v.Val.(Number)), 'G', -1, 64)
+		return numberToString(v.Num)
 	case STRING:
 		return v.Val.(string)
 	case BOOLEAN:
-		return strconv.FormatBool(v.Val.(Integer) == 0)
+		return strconv.FormatBool(v.Val.(bool))
 	case NIL:
 		return "NIL"
 	case GOFUNCTION:
@@ -46,10 +71,40 @@ func (v *Value) String() string {
 		return "CLOSURE"
 	case TABLE:
 		return "TABLE"
+	case THREAD:
+		return "THREAD"
+	case USERDATA, LIGHTUSERDATA:
+		return "USERDATA"
 	}
 	return ""
 }
 
+// TypeName returns the name Lua's type() reports for the value.
+func (v *Value) TypeName() string {
+	if v == nil {
+		return "nil"
+	}
+	switch v.Type {
+	case NIL:
+		return "nil"
+	case BOOLEAN:
+		return "boolean"
+	case NUMBER:
+		return "number"
+	case STRING:
+		return "string"
+	case TABLE:
+		return "table"
+	case FUNCTION, CLOSURE, GOFUNCTION:
+		return "function"
+	case THREAD:
+		return "thread"
+	case USERDATA, LIGHTUSERDATA:
+		return "userdata"
+	}
+	return "no value"
+}
+
 func NewNil() *Value {
 	return &Value{Type: NIL}
 }
@@ -59,5 +114,86 @@ func NewString(str string) *Value {
 }
 
 func NewNumber(n float64) *Value {
-	return &Value{Type: NUMBER, Val: Number(n)}
+	return &Value{Type: NUMBER, Num: Number(n)}
+}
+
+// NewBool returns the boolean b. A BOOLEAN value always holds a Go bool in
+// Val.
+func NewBool(b bool) *Value {
+	return &Value{Type: BOOLEAN, Val: b}
+}
+
+// truthy reports whether v counts as true in a condition: everything but
+// nil and false does.
+func truthy(v *Value) bool {
+	switch v.Type {
+	case NIL:
+		return false
+	case BOOLEAN:
+		return v.Val.(bool)
+	}
+	return true
+}
+
+// numberToString formats n the way Lua does, with "%.14g".
+func numberToString(n Number) string {
+	f := float64(n)
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	case math.IsNaN(f):
+		return "nan"
+	}
+	return fmt.Sprintf("%.14g", f)
+}
+
+// str2number converts a numeric string the way Lua's lexer would: surrounding
+// whitespace is ignored and hexadecimal integers are accepted.
+func str2number(s string) (Number, bool) {
+	s = strings.Trim(s, " \t\n\v\f\r")
+	if s == "" {
+		return 0, false
+	}
+	if len(s) > 2 && s[0] == '0' && (s[1] == 'x' || s[1] == 'X') {
+		n, err := strconv.ParseUint(s[2:], 16, 64)
+		return Number(n), err == nil || isRangeError(err)
+	}
+	for l1 := 0; l1 < len(s); l1++ {
+		if strings.IndexByte("0123456789.eE+-", s[l1]) < 0 {
+			return 0, false
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	return Number(n), err == nil || isRangeError(err)
+}
+
+// toNumber converts val to a number the way arithmetic does: numbers are
+// taken as they are, and strings are converted if they are numeric.
+func toNumber(val *Value) (Number, bool) {
+	switch val.Type {
+	case NUMBER:
+		return val.Num, true
+	case STRING:
+		return str2number(val.Val.(string))
+	}
+	return 0, false
+}
+
+// toStr converts val to a string the way concatenation does: strings are
+// taken as they are, and numbers are formatted as numberToString does.
+func toStr(val *Value) (string, bool) {
+	switch val.Type {
+	case STRING:
+		return val.Val.(string), true
+	case NUMBER:
+		return numberToString(val.Num), true
+	}
+	return "", false
+}
+
+func isRangeError(err error) bool {
+	e, ok := err.(*strconv.NumError)
+	return ok && e.Err == strconv.ErrRange
 }
@@ -0,0 +1,66 @@
+package LuaVM
+
+import "testing"
+
+// sumLoop returns a closure for
+//
+//	local s = 0
+//	for i = 1, n do s = s + i * 2 end
+//	return s
+func sumLoop(n float64) *Value {
+	p := &FunctionPrototype{
+		Instructions: []Instr{
+			{Opcode: OP_LOADK, A: 0, B: 0},
+			{Opcode: OP_LOADK, A: 1, B: 1},
+			{Opcode: OP_LOADK, A: 2, B: 2},
+			{Opcode: OP_LOADK, A: 3, B: 1},
+			{Opcode: OP_FORPREP, A: 1, B: 2},
+			{Opcode: OP_MUL, A: 5, B: 4, C: 256 + 3},
+			{Opcode: OP_ADD, A: 0, B: 0, C: 5},
+			{Opcode: OP_FORLOOP, A: 1, B: -3},
+			{Opcode: OP_RETURN, A: 0, B: 2},
+			{Opcode: OP_RETURN, A: 0, B: 1},
+		},
+		Constants: []Value{
+			{Type: NUMBER, Num: 0},
+			{Type: NUMBER, Num: 1},
+			{Type: NUMBER, Num: Number(n)},
+			{Type: NUMBER, Num: 2},
+		},
+		MaxStackSize: 6,
+	}
+	return &Value{Type: CLOSURE, Val: &Closure{Function: p}}
+}
+
+func TestArithmeticDoesNotAllocate(t *testing.T) {
+	vm := NewVM()
+	if r := vm.Call(sumLoop(100), nil); r[0].Num != 10100 {
+		t.Fatal("sum = ", r[0])
+	}
+	short, long := sumLoop(10), sumLoop(10000)
+	a := testing.AllocsPerRun(100, func() { vm.Call(short, nil) })
+	b := testing.AllocsPerRun(100, func() { vm.Call(long, nil) })
+	if b > a {
+		t.Errorf("%v allocations for 10 iterations but %v for 10000", a, b)
+	}
+}
+
+func BenchmarkArithmeticLoop(b *testing.B) {
+	vm := NewVM()
+	fn := sumLoop(1000)
+	b.ReportAllocs()
+	for l1 := 0; l1 < b.N; l1++ {
+		vm.Call(fn, nil)
+	}
+}
+
+func BenchmarkTableReadWrite(b *testing.B) {
+	t := NewTableSize(1000, 0)
+	val := &Value{Type: NUMBER, Num: 1}
+	b.ReportAllocs()
+	for l1 := 0; l1 < b.N; l1++ {
+		i := l1%1000 + 1
+		t.set(Value{Type: NUMBER, Num: Number(i)}, t.getInt(i))
+		t.SetInt(i, val)
+	}
+}
@@ -0,0 +1,218 @@
+package LuaVM
+
+import "fmt"
+
+// The handlers index registers, constants and upvalues with the operands of
+// each instruction as they stand, so a prototype has to be checked before
+// it runs. verify makes the same checks as luaG_checkcode in the reference
+// implementation: every operand names a register below MaxStackSize, a
+// constant, upvalue or nested function that exists, and every jump lands
+// inside the function, so that no handler can index out of range whatever
+// the chunk contains.
+
+// maxStack is the largest frame luac 5.1 emits, MAXSTACK in lcode.h.
+const maxStack = 250
+
+func (p *FunctionPrototype) verify() error {
+	n := len(p.Instructions)
+	switch {
+	case int(p.MaxStackSize) > maxStack:
+		return p.badCode(-1, "stack size %d too large", p.MaxStackSize)
+	case int(p.Parameters)+int(p.IsVararg&uint8(VARARG_HASARG)) > int(p.MaxStackSize):
+		return p.badCode(-1, "parameters do not fit in the stack")
+	case p.IsVararg&uint8(VARARG_NEEDSARG) != 0 && p.IsVararg&uint8(VARARG_HASARG) == 0:
+		return p.badCode(-1, "bad vararg flags %#x", p.IsVararg)
+	case n == 0 || p.Instructions[n-1].Opcode != OP_RETURN:
+		return p.badCode(-1, "code does not end with a return")
+	}
+	for pc := 0; pc < n; pc++ {
+		if err := p.verifyInstr(pc); err != nil {
+			return err
+		}
+		if i := &p.Instructions[pc]; i.Opcode == OP_SETLIST && i.C == 0 {
+			// The next word is the block number, not an instruction.
+			pc++
+		}
+	}
+	for _, f := range p.Functions {
+		if err := f.verify(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *FunctionPrototype) verifyInstr(pc int) error {
+	i := &p.Instructions[pc]
+	a, b, c := int(i.A), int(i.B), int(i.C)
+	reg := func(r int) bool { return r < int(p.MaxStackSize) }
+	rk := func(x int) bool {
+		if x&256 != 0 {
+			return x&255 < len(p.Constants)
+		}
+		return reg(x)
+	}
+	bad := func() error {
+		return p.badCode(pc, "bad operands in %#08x", uint32(i.Raw))
+	}
+	if i.Opcode < OP_MOVE || i.Opcode > OP_VARARG {
+		return p.badCode(pc, "invalid opcode %d", i.Opcode)
+	}
+	switch i.Opcode {
+	case OP_JMP, OP_EQ, OP_LT, OP_LE, OP_RETURN:
+	default:
+		if !reg(a) {
+			return bad()
+		}
+	}
+	if testMode(i.Opcode) {
+		if pc+1 >= len(p.Instructions) || p.Instructions[pc+1].Opcode != OP_JMP {
+			return p.badCode(pc, "test not followed by a jump")
+		}
+	}
+
+	switch i.Opcode {
+	case OP_MOVE, OP_UNM, OP_NOT, OP_LEN, OP_LOADNIL, OP_TESTSET:
+		if !reg(b) {
+			return bad()
+		}
+	case OP_LOADK:
+		if b >= len(p.Constants) {
+			return bad()
+		}
+	case OP_GETGLOBAL, OP_SETGLOBAL:
+		if b >= len(p.Constants) || p.Constants[b].Type != STRING {
+			return bad()
+		}
+	case OP_GETUPVAL, OP_SETUPVAL:
+		if b >= int(p.Upvalues) {
+			return bad()
+		}
+	case OP_LOADBOOL:
+		if c != 0 && (pc+2 >= len(p.Instructions) || p.isSetListBlock(pc+2)) {
+			return bad()
+		}
+	case OP_GETTABLE:
+		if !reg(b) || !rk(c) {
+			return bad()
+		}
+	case OP_SELF:
+		if !reg(a+1) || !reg(b) || !rk(c) {
+			return bad()
+		}
+	case OP_SETTABLE, OP_ADD, OP_SUB, OP_MUL, OP_DIV, OP_MOD, OP_POW, OP_EQ, OP_LT, OP_LE:
+		if !rk(b) || !rk(c) {
+			return bad()
+		}
+	case OP_CONCAT:
+		if b >= c || !reg(c) {
+			return bad()
+		}
+	case OP_TFORLOOP:
+		if c < 1 || !reg(a+2+c) {
+			return bad()
+		}
+	case OP_FORLOOP, OP_FORPREP:
+		if !reg(a + 3) {
+			return bad()
+		}
+	case OP_CALL, OP_TAILCALL:
+		if b != 0 && !reg(a+b-1) {
+			return bad()
+		}
+		if c == 0 {
+			if !p.openConsumer(pc) {
+				return bad()
+			}
+		} else if c > 1 && !reg(a+c-2) {
+			return bad()
+		}
+	case OP_RETURN:
+		if a > int(p.MaxStackSize) || (b > 0 && a+b-1 > int(p.MaxStackSize)) {
+			return bad()
+		}
+	case OP_VARARG:
+		if p.IsVararg&uint8(VARARG_ISVARARG) == 0 || p.IsVararg&uint8(VARARG_NEEDSARG) != 0 {
+			return p.badCode(pc, "vararg outside a vararg function")
+		}
+		if b == 0 && !p.openConsumer(pc) || b > 1 && !reg(a+b-2) {
+			return bad()
+		}
+	case OP_SETLIST:
+		if b > 0 && !reg(a+b) {
+			return bad()
+		}
+		if c == 0 && pc+1 >= len(p.Instructions)-1 {
+			return bad()
+		}
+	case OP_CLOSURE:
+		if b >= len(p.Functions) {
+			return bad()
+		}
+		nup := int(p.Functions[b].Upvalues)
+		if pc+nup >= len(p.Instructions) {
+			return bad()
+		}
+		for l1 := 1; l1 <= nup; l1++ {
+			if op := p.Instructions[pc+l1].Opcode; op != OP_MOVE && op != OP_GETUPVAL {
+				return p.badCode(pc, "bad upvalue instruction after closure")
+			}
+		}
+	}
+
+	switch i.Opcode {
+	case OP_JMP, OP_FORLOOP, OP_FORPREP:
+		dest := pc + 1 + b
+		if dest < 0 || dest >= len(p.Instructions) || p.isSetListBlock(dest) {
+			return p.badCode(pc, "jump out of range")
+		}
+	}
+	return nil
+}
+
+// openConsumer reports whether the instruction after pc takes the variable
+// number of values that the instruction at pc leaves on the stack, as its
+// operand B of 0 says, and starts below them.
+func (p *FunctionPrototype) openConsumer(pc int) bool {
+	if pc+1 >= len(p.Instructions) {
+		return false
+	}
+	i, next := &p.Instructions[pc], &p.Instructions[pc+1]
+	if next.B != 0 {
+		return false
+	}
+	switch next.Opcode {
+	case OP_CALL, OP_TAILCALL, OP_SETLIST:
+		return next.A < i.A
+	case OP_RETURN:
+		return next.A <= i.A
+	}
+	return false
+}
+
+// isSetListBlock reports whether the word at pc is the block number of an
+// OP_SETLIST rather than an instruction.
+func (p *FunctionPrototype) isSetListBlock(pc int) bool {
+	if pc == 0 {
+		return false
+	}
+	prev := &p.Instructions[pc-1]
+	return prev.Opcode == OP_SETLIST && prev.C == 0
+}
+
+// testMode reports whether op is a test that skips the jump after it.
+func testMode(op OPCODE) bool {
+	switch op {
+	case OP_EQ, OP_LT, OP_LE, OP_TEST, OP_TESTSET, OP_TFORLOOP:
+		return true
+	}
+	return false
+}
+
+func (p *FunctionPrototype) badCode(pc int, format string, a ...interface{}) error {
+	msg := fmt.Sprintf(format, a...)
+	if pc >= 0 {
+		msg = fmt.Sprintf("instruction %d: %s", pc+1, msg)
+	}
+	return fmt.Errorf("%w: %s", BADCODE, msg)
+}
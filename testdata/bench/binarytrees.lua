@@ -0,0 +1,39 @@
+-- Binary trees, after the Computer Language Benchmarks Game: allocation of
+-- many short-lived tables.
+function BottomUpTree(depth)
+	if depth > 0 then
+		depth = depth - 1
+		local left, right = BottomUpTree(depth), BottomUpTree(depth)
+		return { left, right }
+	else
+		return {}
+	end
+end
+
+function ItemCheck(tree)
+	if tree[1] ~= nil then
+		return 1 + ItemCheck(tree[1]) + ItemCheck(tree[2])
+	else
+		return 1
+	end
+end
+
+local mindepth = 4
+local maxdepth = mindepth + 2
+if maxdepth < N then
+	maxdepth = N
+end
+
+local stretch = BottomUpTree(maxdepth + 1)
+local check = ItemCheck(stretch)
+
+local longlived = BottomUpTree(maxdepth)
+for depth = mindepth, maxdepth, 2 do
+	local iterations = 2 ^ (maxdepth - depth + mindepth)
+	for i = 1, iterations do
+		local tree = BottomUpTree(depth)
+		check = check + ItemCheck(tree)
+	end
+end
+
+result = check + ItemCheck(longlived)
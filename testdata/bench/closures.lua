@@ -0,0 +1,27 @@
+-- Closure creation and calls through upvalues.
+local function adder(x)
+	return function(y)
+		return x + y
+	end
+end
+
+local function counter()
+	local n = 0
+	return function()
+		n = n + 1
+		return n
+	end
+end
+
+local sum = 0
+for i = 1, N do
+	local add = adder(i)
+	sum = sum + add(1) + add(2)
+end
+
+local tick = counter()
+for i = 1, N do
+	sum = sum + tick()
+end
+
+result = sum
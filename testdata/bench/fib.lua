@@ -0,0 +1,9 @@
+-- Naive recursive Fibonacci: call and return overhead.
+function fib(n)
+	if n < 2 then
+		return n
+	end
+	return fib(n - 1) + fib(n - 2)
+end
+
+result = fib(N)
@@ -0,0 +1,25 @@
+-- Method calls on objects with a shared metatable.
+local Point = {}
+Point.__index = Point
+
+function Point.new(x, y)
+	return setmetatable({ x = x, y = y }, Point)
+end
+
+function Point:add(other)
+	return Point.new(self.x + other.x, self.y + other.y)
+end
+
+function Point:dot(other)
+	return self.x * other.x + self.y * other.y
+end
+
+local acc = Point.new(0, 0)
+local step = Point.new(1, 2)
+local sum = 0
+for i = 1, N do
+	acc = acc:add(step)
+	sum = sum + acc:dot(step)
+end
+
+result = sum
@@ -0,0 +1,14 @@
+-- String building: repeated concatenation, and table.concat over
+-- tostring'd numbers.
+local s = ""
+for i = 1, N do
+	s = s .. "ab"
+end
+
+local parts = {}
+for i = 1, N do
+	parts[#parts + 1] = tostring(i)
+end
+local joined = table.concat(parts, ",")
+
+result = #s + #joined + #string.rep("xy", N)
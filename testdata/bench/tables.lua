@@ -0,0 +1,19 @@
+-- Table insert and lookup over both the array and the hash part.
+local array = {}
+for i = 1, N do
+	table.insert(array, i * 2)
+end
+
+local hash = {}
+for i = 1, N do
+	hash["k" .. tostring(i)] = i
+end
+
+local sum = 0
+for round = 1, 4 do
+	for i = 1, N do
+		sum = sum + array[i] + hash["k" .. tostring(i)]
+	end
+end
+
+result = sum + #array
@@ -0,0 +1,12 @@
+-- ADD, SUB, MUL, DIV, MOD, POW and UNM on registers and constants.
+local a, b = 7, 2
+print(a + b, a - b, a * b, a / b, a % b, a ^ b, -a)
+print(a + 0.5, 10 - a, 3 * b, 1 / b, 10 % a, 2 ^ 10, -(-b))
+print(-7 % 3, 7 % -3, -7 % -3, 5.5 % 2)
+print(1 / 3, 100 / 7, 2 ^ 0.5, 2 ^ -1)
+print(1e15, 1e16, 123456789012345, 0.1 + 0.2)
+print(1 / 0, -1 / 0, 0 / 0 ~= 0 / 0)
+local x = 10
+x = x + 1
+x = x * x
+print(x, x - 21 * 5)
@@ -0,0 +1,28 @@
+-- CALL and RETURN with fixed and multiple results, and result adjustment.
+local function none() end
+local function one() return 1 end
+local function many() return 1, 2, 3 end
+print(none())
+print(one())
+print(many())
+print(many(), 10)
+print(10, many())
+print((many()))
+local a, b, c, d = many()
+print(a, b, c, d)
+local x, y = one()
+print(x, y)
+local p, q = 5
+print(p, q)
+local function pass(...) return ... end
+print(pass(many()))
+print(select("#", none()), select("#", many()), select("#", nil, nil))
+local function swap(m, n) return n, m end
+print(swap(1, 2))
+local t = {}
+t.a, t.b = swap("first", "second")
+print(t.a, t.b)
+local i, j = 1, 2
+i, j = j, i
+print(i, j)
+print(type(print), type(nil), type({}), type("s"), type(2), type(true))
@@ -0,0 +1,12 @@
+-- EQ, LT and LE in conditions and as values, on numbers and strings.
+local a, b = 1, 2
+print(a == b, a ~= b, a < b, a <= b, a > b, a >= b)
+print(b == b, b ~= b, b < b, b <= b, b > b, b >= b)
+print(a == 1, 2 < b, a <= 0, 3 > a, b >= 2)
+if a < b then print("a < b") else print("a >= b") end
+if a > b then print("a > b") else print("a <= b") end
+if not (a == b) then print("a ~= b") end
+local s, t = "abc", "abd"
+print(s == t, s ~= t, s == "abc", s < t, s <= t, s > t, t >= s)
+print("" < "a", "Z" < "a", "abc" < "abcd", "10" < "9")
+print(nil == false, 1 == "1", "x" == "x")
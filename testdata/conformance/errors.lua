@@ -0,0 +1,16 @@
+-- Errors raised with error and caught with pcall, and an uncaught error
+-- ending the chunk.
+print(pcall(error, "plain", 0))
+print(pcall(function() error("from function", 0) end))
+local ok, e = pcall(function() error({ code = 7 }) end)
+print(ok, type(e), e.code)
+print(pcall(function() return 1, 2 end))
+print(select("#", pcall(error)))
+local ok2 = pcall(function() local t = nil; return t.x end)
+print(ok2)
+local ok3 = pcall(function() return 1 + {} end)
+print(ok3)
+print(pcall(pcall, error, "nested", 0))
+print("before")
+error("uncaught", 0)
+print("after")
@@ -0,0 +1,32 @@
+-- TFORLOOP with pairs, ipairs, next and closure iterators.
+local t = { 10, 20, 30, nil, 50 }
+for i, v in ipairs(t) do io.write(i, "=", v, " ") end print()
+
+local h = { a = 1, b = 2, c = 3, 4, 5 }
+local keys, sum = 0, 0
+for k, v in pairs(h) do
+	keys = keys + 1
+	sum = sum + v
+end
+print(keys, sum)
+
+local n = 0
+for k, v in next, h do n = n + 1 end
+print(n)
+
+local function range(m)
+	local i = 0
+	return function()
+		i = i + 1
+		if i <= m then return i end
+	end
+end
+for i in range(4) do io.write(i, " ") end print()
+
+local function iter(s, c)
+	if c < s then return c + 1, c * c end
+end
+for a, b in iter, 3, 0 do io.write(a, ":", b, " ") end print()
+
+for k in pairs({}) do print("never") end
+print("done")
@@ -0,0 +1,25 @@
+-- FORPREP and FORLOOP: steps, bounds and loop variable scope.
+for i = 1, 3 do io.write(i, " ") end print()
+for i = 3, 1, -1 do io.write(i, " ") end print()
+for i = 1, 2, 0.5 do io.write(i, " ") end print()
+for i = 1, 0 do io.write("never") end print("empty")
+for i = 0, -1, 1 do io.write("never") end print("empty")
+for i = 1.5, 3 do io.write(i, " ") end print()
+for i = 10, 1, -3 do io.write(i, " ") end print()
+local n = 0
+for i = 1, 10 do
+	local i = i * 2
+	n = n + i
+end
+print(n)
+for i = 1, 3 do
+	for j = i, 3 do io.write(i, j, " ") end
+end
+print()
+local limit = 3
+for i = 1, limit do limit = 10 io.write(i, " ") end print()
+for i = 1, 3 do
+	if i == 2 then break end
+	io.write(i, " ")
+end
+print()
@@ -0,0 +1,16 @@
+-- NOT, TEST, TESTSET and LOADBOOL: Lua truthiness and and/or values.
+local t, f, n, z, s = true, false, nil, 0, ""
+print(not t, not f, not n, not z, not s, not {})
+print(t and 1, f and 1, n and 1, z and 1, s and 1)
+print(t or 1, f or 1, n or 1, z or 1, s or 1)
+print(n or f, f or n, z and n, nil and nil)
+print(1 and 2 or 3, nil and 2 or 3, false or nil or "last")
+if z then print("0 is true") end
+if s then print("empty string is true") end
+if not n then print("nil is false") end
+local x = 5
+local big = x > 3 and "big" or "small"
+local small = x > 8 and "big" or "small"
+print(big, small)
+local v = x == 5
+print(v, x ~= 5, not v)
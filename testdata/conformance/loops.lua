@@ -0,0 +1,29 @@
+-- JMP: while, repeat, break and nested control flow.
+local i = 0
+while i < 5 do i = i + 1 end
+print(i)
+repeat i = i - 2 until i < 0
+print(i)
+local n = 0
+while true do
+	n = n + 1
+	if n > 3 then break end
+end
+print(n)
+local out = {}
+for a = 1, 3 do
+	local b = 0
+	repeat
+		b = b + 1
+		if b == 2 then break end
+	until false
+	out[#out + 1] = a * 10 + b
+end
+print(out[1], out[2], out[3])
+local r = 0
+repeat local done = r >= 2 r = r + 1 until done
+print(r)
+local x = 15
+if x < 10 then print("small") elseif x < 20 then print("medium") else print("large") end
+do local x = 1 print(x) end
+print(x)
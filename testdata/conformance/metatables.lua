@@ -0,0 +1,21 @@
+-- __index, __newindex and rawget/rawset through setmetatable.
+local base = { greet = function(self) return "hi " .. self.name end }
+local obj = setmetatable({ name = "lua" }, { __index = base })
+print(obj:greet(), obj.missing, rawget(obj, "greet"))
+
+local log = {}
+local proxy = setmetatable({}, {
+	__index = function(t, k) return k .. "!" end,
+	__newindex = function(t, k, v) rawset(t, k, v * 2) end,
+})
+print(proxy.foo)
+proxy.n = 21
+print(proxy.n, rawget(proxy, "n"))
+print(getmetatable(proxy) ~= nil, getmetatable({}))
+
+local Class = {}
+Class.__index = Class
+function Class.new(v) return setmetatable({ v = v }, Class) end
+function Class:get() return self.v end
+local a, b = Class.new(1), Class.new(2)
+print(a:get(), b:get(), getmetatable(a) == Class)
@@ -0,0 +1,24 @@
+-- SETLIST in table constructors, including more than one flush of 50
+-- elements and a call or vararg expanding into the last slots.
+local big = {
+	1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20,
+	21, 22, 23, 24, 25, 26, 27, 28, 29, 30, 31, 32, 33, 34, 35, 36, 37, 38, 39, 40,
+	41, 42, 43, 44, 45, 46, 47, 48, 49, 50, 51, 52, 53, 54, 55, 56, 57, 58, 59, 60,
+	61, 62, 63, 64, 65, 66, 67, 68, 69, 70, 71, 72, 73, 74, 75, 76, 77, 78, 79, 80,
+	81, 82, 83, 84, 85, 86, 87, 88, 89, 90, 91, 92, 93, 94, 95, 96, 97, 98, 99, 100,
+	101, 102, 103, 104, 105, 106, 107, 108, 109, 110, 111, 112, 113, 114, 115,
+}
+print(#big, big[1], big[50], big[51], big[100], big[115])
+local sum = 0
+for i = 1, #big do sum = sum + big[i] end
+print(sum)
+
+local function three() return "a", "b", "c" end
+local t = { three() }
+print(#t, t[1], t[2], t[3])
+t = { three(), three() }
+print(#t, t[1], t[2], t[3], t[4])
+t = { (three()) }
+print(#t, t[1])
+local mixed = { "x", key = "value", "y", three() }
+print(#mixed, mixed[1], mixed[2], mixed[3], mixed[5], mixed.key)
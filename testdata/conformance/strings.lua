@@ -0,0 +1,11 @@
+-- CONCAT and LEN on strings, and coercion of numbers into concatenation.
+local a, b = "foo", "bar"
+print(a .. b, a .. " " .. b, #a, #(a .. b), #"")
+print("n=" .. 5, 1 .. 2, "x" .. 0.5, "big" .. 1e20)
+local parts = "a" .. "b" .. "c" .. "d" .. "e"
+print(parts, #parts)
+print(string.len("hello"), string.upper("abc"), string.sub("hello", 2, 4))
+print(string.rep("ab", 3), string.byte("A"), string.char(72, 105))
+print(string.format("%d %s %5.2f", 42, "str", 3.14159))
+print(tostring(12), tostring(1.5), tostring(nil), tostring(true))
+print("10" + 5, "3" * "4", 10 .. "")
@@ -0,0 +1,24 @@
+-- NEWTABLE, GETTABLE, SETTABLE, LEN, SELF, GETGLOBAL and SETGLOBAL.
+local t = { 10, 20, 30, x = "ex", ["y"] = "why", [1.5] = "float" }
+print(t[1], t[2], t[3], t.x, t.y, t[1.5], #t)
+t[4] = 40
+t.z = "zed"
+print(t[4], t.z, #t, t.missing)
+t[2] = nil
+print(t[2], t[3])
+local k = "x"
+print(t[k], t["x"])
+local nested = { inner = { value = 42 } }
+print(nested.inner.value)
+nested.inner.value = nested.inner.value + 1
+print(nested.inner.value)
+counter = 0
+counter = counter + 1
+print(counter, rawget(_G, "counter"))
+local obj = { n = 3 }
+function obj.get(self) return self.n end
+function obj:add(d) self.n = self.n + d return self end
+print(obj:get(), obj:add(2):get(), obj.n)
+local sum = 0
+for i = 1, 4 do if t[i] then sum = sum + t[i] end end
+print(sum)
@@ -0,0 +1,29 @@
+-- TAILCALL: deep tail recursion must not grow the stack, and tail calls
+-- into Go functions return their results.
+local function count(n, acc)
+	if n == 0 then
+		return acc
+	end
+	return count(n - 1, acc + 1)
+end
+print(count(100000, 0))
+
+local function even(n)
+	if n == 0 then return true end
+	return odd(n - 1)
+end
+function odd(n)
+	if n == 0 then return false end
+	return even(n - 1)
+end
+print(even(10), even(7))
+
+local function tostr(v)
+	return tostring(v)
+end
+print(tostr(42), tostr(nil))
+
+local function multi()
+	return select(2, "a", "b", "c")
+end
+print(multi())
@@ -0,0 +1,47 @@
+-- GETUPVAL, SETUPVAL, CLOSURE and CLOSE: closures share the variables they
+-- capture, and each loop iteration gets fresh locals.
+local function counter()
+	local n = 0
+	local function inc() n = n + 1 return n end
+	local function get() return n end
+	return inc, get
+end
+local inc, get = counter()
+inc()
+inc()
+print(get(), inc(), get())
+
+local x = 1
+local function setx(v) x = v end
+setx(5)
+print(x)
+
+local fns = {}
+for i = 1, 3 do
+	fns[i] = function() return i end
+end
+print(fns[1](), fns[2](), fns[3]())
+
+local acc = {}
+local j = 1
+while j <= 3 do
+	local k = j * 10
+	acc[j] = function() return k end
+	j = j + 1
+end
+print(acc[1](), acc[2](), acc[3]())
+
+local function fib(n)
+	if n < 2 then return n end
+	return fib(n - 1) + fib(n - 2)
+end
+print(fib(15))
+
+local function outer()
+	local a = "a"
+	return function()
+		local b = "b"
+		return function() return a .. b end
+	end
+end
+print(outer()()())
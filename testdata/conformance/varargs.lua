@@ -0,0 +1,39 @@
+-- VARARG: ... in calls, tables, select and adjusted assignments.
+local function count(...)
+	return select("#", ...)
+end
+print(count(), count(nil), count(1, nil, 3), count(nil, nil))
+
+local function first(a, ...)
+	return a, select("#", ...)
+end
+print(first(1, 2, 3))
+
+local function pack(...)
+	return { ... }
+end
+local t = pack(4, 5, 6)
+print(#t, t[1], t[3])
+
+local function tail(...)
+	local a, b = ...
+	return b, a
+end
+print(tail("x", "y", "z"))
+
+local function forward(...)
+	return ...
+end
+print(forward(1, 2, 3))
+print(forward())
+print((forward(7, 8)))
+
+local function sum(...)
+	local s = 0
+	for i = 1, select("#", ...) do
+		s = s + select(i, ...)
+	end
+	return s
+end
+print(sum(1, 2, 3, 4))
+print(select(-1, "a", "b", "c"))